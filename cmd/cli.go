@@ -5,11 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 
 	"github.com/lxc/crio-lxc/lxcontainer"
+	"github.com/lxc/crio-lxc/server"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rs/zerolog"
 	"github.com/urfave/cli/v2"
 )
 
@@ -19,7 +24,42 @@ var envFile = "/etc/default/crio-lxc"
 
 // The singelton that wraps the lxc.Container
 var clxc struct {
-	lxcontainer.Runtime
+	Runtime *lxcontainer.Runtime
+	lxcontainer.CreateOptions
+
+	// Client forwards the runtime commands to the runtime daemon if Socket is set.
+	Client      *server.Client
+	Socket      string
+	ContainerID string
+
+	// [ global settings ]
+	RuntimeRoot       string
+	LogFile           *os.File
+	LogFilePath       string
+	LogLevel          string
+	LogTimestamp      string
+	ContainerLogLevel string
+	SystemdCgroup     bool
+	MonitorCgroup     string
+
+	StartCommand  string
+	InitCommand   string
+	ContainerHook string
+
+	// feature gates
+	Seccomp       bool
+	Capabilities  bool
+	Apparmor      bool
+	CgroupDevices bool
+	Selinux       bool
+
+	SeccompNotifyProxy string
+
+	UsernsAuto bool
+	UsernsUser string
+	UsernsSize uint
+
+	Log zerolog.Logger
 
 	Command           string
 	CreateHook        string
@@ -33,6 +73,16 @@ var clxc struct {
 
 var version string
 
+// forwardedCommands are forwarded to the runtime daemon if the socket is set.
+// The create command is not forwarded, see doCreate.
+var forwardedCommands = map[string]bool{
+	"start":  true,
+	"state":  true,
+	"kill":   true,
+	"delete": true,
+	"exec":   true,
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "crio-lxc"
@@ -50,6 +100,8 @@ func main() {
 		&killCmd,
 		&deleteCmd,
 		&execCmd,
+		&serveCmd,
+		&gcCmd,
 		// TODO extend urfave/cli to render a default environment file.
 
 	}
@@ -66,14 +118,14 @@ func main() {
 			Name:        "container-log-level",
 			Usage:       "set the container process (liblxc) log level (trace|debug|info|notice|warn|error|crit|alert|fatal)",
 			EnvVars:     []string{"CRIO_LXC_CONTAINER_LOG_LEVEL"},
-			Value:       "warn",
+			Value:       lxcontainer.DefaultContainerLogLevel,
 			Destination: &clxc.ContainerLogLevel,
 		},
 		&cli.StringFlag{
 			Name:        "log-file",
 			Usage:       "path to the log file for runtime and container output",
 			EnvVars:     []string{"CRIO_LXC_LOG_FILE"},
-			Value:       "/var/log/crio-lxc/crio-lxc.log",
+			Value:       lxcontainer.DefaultContainerLogFile,
 			Destination: &clxc.LogFilePath,
 		},
 		&cli.StringFlag{
@@ -87,7 +139,7 @@ func main() {
 			Name:  "root",
 			Usage: "container runtime root where (logs, init and hook scripts). tmpfs is recommended.",
 			// exec permissions are not required because init is bind mounted into the root
-			Value:       "/run/crio-lxc",
+			Value:       lxcontainer.DefaultRuntimeRoot,
 			Destination: &clxc.RuntimeRoot,
 		},
 		&cli.BoolFlag{
@@ -100,27 +152,27 @@ func main() {
 			Usage:       "cgroup slice for liblxc monitor process and pivot path",
 			Destination: &clxc.MonitorCgroup,
 			EnvVars:     []string{"CRIO_LXC_MONITOR_CGROUP"},
-			Value:       "crio-lxc-monitor.slice",
+			Value:       lxcontainer.DefaultMonitorCgroup,
 		},
 		&cli.StringFlag{
 			Name:        "cmd-init",
 			Usage:       "absolute path to container init executable",
 			EnvVars:     []string{"CRIO_LXC_INIT_CMD"},
-			Value:       "/usr/local/bin/crio-lxc-init",
+			Value:       lxcontainer.DefaultInitCommand,
 			Destination: &clxc.InitCommand,
 		},
 		&cli.StringFlag{
 			Name:        "cmd-start",
 			Usage:       "absolute path to container start executable",
 			EnvVars:     []string{"CRIO_LXC_START_CMD"},
-			Value:       "/usr/local/bin/crio-lxc-start",
+			Value:       lxcontainer.DefaultStartCommand,
 			Destination: &clxc.StartCommand,
 		},
 		&cli.StringFlag{
 			Name:        "container-hook",
 			Usage:       "absolute path to container hook executable",
 			EnvVars:     []string{"CRIO_LXC_CONTAINER_HOOK"},
-			Value:       "/usr/local/bin/crio-lxc-container-hook",
+			Value:       lxcontainer.DefaultContainerHook,
 			Destination: &clxc.ContainerHook,
 		},
 		&cli.BoolFlag{
@@ -130,6 +182,13 @@ func main() {
 			EnvVars:     []string{"CRIO_LXC_APPARMOR"},
 			Value:       true,
 		},
+		&cli.BoolFlag{
+			Name:        "selinux",
+			Usage:       "set selinux process and mount labels defined in container spec",
+			Destination: &clxc.Selinux,
+			EnvVars:     []string{"CRIO_LXC_SELINUX"},
+			Value:       true,
+		},
 		&cli.BoolFlag{
 			Name:        "capabilities",
 			Usage:       "keep capabilities defined in container spec",
@@ -151,24 +210,59 @@ func main() {
 			EnvVars:     []string{"CRIO_LXC_SECCOMP"},
 			Value:       true,
 		},
+		&cli.StringFlag{
+			Name:        "seccomp-notify-proxy",
+			Usage:       "path to the unix socket of the liblxc seccomp notify proxy (overrides the seccomp listenerPath from the container spec)",
+			EnvVars:     []string{"CRIO_LXC_SECCOMP_NOTIFY_PROXY"},
+			Destination: &clxc.SeccompNotifyProxy,
+		},
+		&cli.BoolFlag{
+			Name:        "userns-auto",
+			Usage:       "allocate user namespace ID mappings per pod from the subordinate IDs of --userns-user",
+			EnvVars:     []string{"CRIO_LXC_USERNS_AUTO"},
+			Destination: &clxc.UsernsAuto,
+		},
+		&cli.StringFlag{
+			Name:        "userns-user",
+			Usage:       "user in /etc/subuid and /etc/subgid whose subordinate IDs are allocated",
+			EnvVars:     []string{"CRIO_LXC_USERNS_USER"},
+			Value:       lxcontainer.DefaultUsernsUser,
+			Destination: &clxc.UsernsUser,
+		},
+		&cli.UintFlag{
+			Name:        "userns-size",
+			Usage:       "number of user and group IDs allocated per pod",
+			EnvVars:     []string{"CRIO_LXC_USERNS_SIZE"},
+			Value:       lxcontainer.DefaultUsernsSize,
+			Destination: &clxc.UsernsSize,
+		},
+		&cli.StringFlag{
+			Name:        "socket",
+			Usage:       "forward runtime commands to the runtime daemon listening on this unix socket",
+			EnvVars:     []string{"CRIO_LXC_SOCKET"},
+			Destination: &clxc.Socket,
+		},
 	}
 
 	startTime := time.Now()
+	clxc.Log = zerolog.Nop()
 
 	// Environment variables must be injected from file before app.Run() is called.
 	// Otherwise the values are not set to the crioLXC instance.
 	// FIXME when calling '--help' defaults are overwritten with environment variables.
 	// So you will never see the real default value if either an environment file is present
 	// or an environment variable is set.
-	env, err := loadEnvFile(envFile)
-	if err != nil {
-		println(err.Error())
-		os.Exit(1)
-	}
-	if env != nil {
+	// The environment file is not read by commands forwarded to the runtime daemon
+	// if the socket is set in the environment. The settings are applied by the daemon.
+	if os.Getenv("CRIO_LXC_SOCKET") == "" || !forwardedCommands[commandName(os.Args, app.Commands)] {
+		env, err := loadEnvFile(envFile)
+		if err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
 		for key, val := range env {
 			if err := setEnv(key, val, false); err != nil {
-				err = fmt.Errorf("failed to set environment variable \"%s=%s\": %w", err)
+				err = fmt.Errorf("failed to set environment variable \"%s=%s\": %w", key, val, err)
 				println(err.Error())
 				os.Exit(1)
 			}
@@ -189,6 +283,9 @@ func main() {
 
 	app.Before = func(ctx *cli.Context) error {
 		clxc.Command = ctx.Args().Get(0)
+		if os.Geteuid() != 0 {
+			return setRootlessDefaults(ctx)
+		}
 		return nil
 	}
 
@@ -198,21 +295,38 @@ func main() {
 			return fmt.Errorf("missing container ID")
 		}
 		clxc.ContainerID = containerID
-		return clxc.ConfigureLogging(ctx.Command.Name)
+		// The runtime daemon logs the forwarded commands.
+		if clxc.Socket != "" && forwardedCommands[ctx.Command.Name] {
+			clxc.Client = server.NewClient(clxc.Socket)
+			return nil
+		}
+		if err := configureLogging(ctx.Command.Name); err != nil {
+			return err
+		}
+		rt, err := newRuntime(containerID)
+		if err != nil {
+			return err
+		}
+		clxc.Runtime = rt
+		// use the container logger for runtime command log output
+		clxc.Log = rt.Log
+		return nil
 	}
 
 	for _, cmd := range app.Commands {
-		cmd.Before = setupCmd
+		if cmd.Before == nil {
+			cmd.Before = setupCmd
+		}
 		cmd.OnUsageError = errUsage
 	}
 
-	err = app.Run(os.Args)
+	err := app.Run(os.Args)
 
 	cmdDuration := time.Since(startTime)
 
 	if err != nil {
 		clxc.Log.Error().Err(err).Dur("duration", cmdDuration).Msg("cmd failed")
-		clxc.Release()
+		release()
 		// exit with exit status of executed command
 		if err, yes := err.(execError); yes {
 			os.Exit(err.ExitStatus())
@@ -223,12 +337,75 @@ func main() {
 	}
 
 	clxc.Log.Debug().Dur("duration", cmdDuration).Msg("cmd completed")
-	if clxc.Release(); err != nil {
+	if err := release(); err != nil {
 		println(err.Error())
 		os.Exit(1)
 	}
 }
 
+// commandName returns the name of the command in the cmdline args.
+func commandName(args []string, cmds []*cli.Command) string {
+	for _, arg := range args[1:] {
+		for _, cmd := range cmds {
+			if cmd.Name == arg {
+				return arg
+			}
+		}
+	}
+	return ""
+}
+
+// setRootlessDefaults moves the default runtime root and log file,
+// which are not writable by an unprivileged user, to XDG_RUNTIME_DIR.
+func setRootlessDefaults(ctx *cli.Context) error {
+	if !ctx.IsSet("root") {
+		root, err := lxcontainer.RootlessRuntimeRoot()
+		if err != nil {
+			return fmt.Errorf("failed to set rootless runtime root: %w", err)
+		}
+		clxc.RuntimeRoot = root
+	}
+	if !ctx.IsSet("log-file") {
+		clxc.LogFilePath = filepath.Join(clxc.RuntimeRoot, "crio-lxc.log")
+	}
+	return nil
+}
+
+// newRuntime creates the runtime for the given container from the global settings.
+func newRuntime(containerID string) (*lxcontainer.Runtime, error) {
+	if clxc.UsernsSize > math.MaxUint32 {
+		return nil, fmt.Errorf("userns size %d is out of range", clxc.UsernsSize)
+	}
+	return lxcontainer.NewRuntime(containerID,
+		lxcontainer.WithLogger(clxc.Log),
+		lxcontainer.WithRuntimeRoot(clxc.RuntimeRoot),
+		lxcontainer.WithContainerLog(clxc.LogFilePath, clxc.ContainerLogLevel),
+		lxcontainer.WithSystemdCgroup(clxc.SystemdCgroup),
+		lxcontainer.WithMonitorCgroup(clxc.MonitorCgroup),
+		lxcontainer.WithCommands(clxc.StartCommand, clxc.InitCommand, clxc.ContainerHook),
+		lxcontainer.WithApparmor(clxc.Apparmor),
+		lxcontainer.WithSelinux(clxc.Selinux),
+		lxcontainer.WithCapabilities(clxc.Capabilities),
+		lxcontainer.WithCgroupDevices(clxc.CgroupDevices),
+		lxcontainer.WithSeccomp(clxc.Seccomp),
+		lxcontainer.WithSeccompNotifyProxy(clxc.SeccompNotifyProxy),
+		lxcontainer.WithUserns(clxc.UsernsAuto, clxc.UsernsUser, uint32(clxc.UsernsSize)),
+	)
+}
+
+// release releases the container and closes the log file.
+func release() error {
+	if clxc.Runtime != nil {
+		if err := clxc.Runtime.Release(); err != nil {
+			clxc.Log.Error().Err(err).Msg("failed to release container")
+		}
+	}
+	if clxc.LogFile != nil {
+		return clxc.LogFile.Close()
+	}
+	return nil
+}
+
 var createCmd = cli.Command{
 	Name:      "create",
 	Usage:     "create a container from a bundle directory",
@@ -278,7 +455,11 @@ func doCreate(unused *cli.Context) error {
 	ctx, cancel := context.WithTimeout(context.Background(), clxc.CreateTimeout)
 	defer cancel()
 
-	err := clxc.Create(ctx)
+	// The create command is not forwarded to the runtime daemon (unlike the other runtime commands),
+	// so that the container monitor process is a child of the calling process (conmon).
+	// conmon is the subreaper of the monitor process and receives the container exit status.
+	// The daemon can not create a child process of conmon.
+	err := clxc.Runtime.Create(ctx, clxc.CreateOptions)
 	if clxc.CreateHook != "" {
 		runCreateHook(err)
 	}
@@ -287,12 +468,12 @@ func doCreate(unused *cli.Context) error {
 
 func runCreateHook(err error) {
 	env := []string{
-		"CONTAINER_ID=" + clxc.ContainerID,
-		"LXC_CONFIG=" + clxc.ConfigFilePath(),
+		"CONTAINER_ID=" + clxc.Runtime.ContainerID,
+		"LXC_CONFIG=" + clxc.Runtime.ConfigFilePath(),
 		"RUNTIME_CMD=" + clxc.Command,
-		"RUNTIME_PATH=" + clxc.RuntimePath(),
-		"BUNDLE_PATH=" + clxc.BundlePath,
-		"SPEC_PATH=" + clxc.SpecPath(),
+		"RUNTIME_PATH=" + clxc.Runtime.RuntimePath(),
+		"BUNDLE_PATH=" + clxc.Runtime.BundlePath,
+		"SPEC_PATH=" + clxc.Runtime.SpecPath(),
 		"LOG_FILE=" + clxc.LogFilePath,
 	}
 	if err != nil {
@@ -331,7 +512,10 @@ starts <containerID>
 func doStart(unused *cli.Context) error {
 	ctx, cancel := context.WithTimeout(context.Background(), clxc.StartTimeout)
 	defer cancel()
-	return clxc.Start(ctx)
+	if clxc.Client != nil {
+		return clxc.Client.Start(ctx, clxc.ContainerID)
+	}
+	return clxc.Runtime.Start(ctx)
 }
 
 var stateCmd = cli.Command{
@@ -346,7 +530,13 @@ var stateCmd = cli.Command{
 }
 
 func doState(unused *cli.Context) error {
-	state, err := clxc.State()
+	var state *specs.State
+	var err error
+	if clxc.Client != nil {
+		state, err = clxc.Client.State(context.Background(), clxc.ContainerID)
+	} else {
+		state, err = clxc.Runtime.State(context.Background())
+	}
 	if err != nil {
 		return err
 	}
@@ -387,7 +577,10 @@ func doKill(ctx *cli.Context) error {
 	}
 	c, cancel := context.WithTimeout(context.Background(), clxc.KillTimeout)
 	defer cancel()
-	return clxc.Kill(c, signum)
+	if clxc.Client != nil {
+		return clxc.Client.Kill(c, clxc.ContainerID, signum)
+	}
+	return clxc.Runtime.Kill(c, signum)
 }
 
 var deleteCmd = cli.Command{
@@ -416,7 +609,12 @@ var deleteCmd = cli.Command{
 func doDelete(ctx *cli.Context) error {
 	c, cancel := context.WithTimeout(context.Background(), clxc.DeleteTimeout)
 	defer cancel()
-	err := clxc.Delete(c, ctx.Bool("force"))
+	var err error
+	if clxc.Client != nil {
+		err = clxc.Client.Delete(c, clxc.ContainerID, ctx.Bool("force"))
+	} else {
+		err = clxc.Runtime.Delete(c, ctx.Bool("force"))
+	}
 	if errors.Is(err, lxcontainer.ErrNotExist) {
 		clxc.Log.Warn().Msg("container does not exist")
 		return nil
@@ -424,6 +622,29 @@ func doDelete(ctx *cli.Context) error {
 	return err
 }
 
+var gcCmd = cli.Command{
+	Name:  "gc",
+	Usage: "removes the runtime resources that are not used by any container",
+	Description: `The cached seccomp profiles and the ID mapping allocations of deleted containers are removed.
+The seccomp profile cache hits and misses are logged.`,
+	Before: func(ctx *cli.Context) error {
+		return configureLogging(ctx.Command.Name)
+	},
+	Action: doGC,
+}
+
+func doGC(unused *cli.Context) error {
+	if err := lxcontainer.GC(clxc.RuntimeRoot); err != nil {
+		return err
+	}
+	stats, err := lxcontainer.ReadSeccompCacheStats(clxc.RuntimeRoot)
+	if err != nil {
+		return fmt.Errorf("failed to read seccomp profile cache stats: %w", err)
+	}
+	clxc.Log.Info().Uint64("hits", stats.Hits).Uint64("misses", stats.Misses).Msg("seccomp profile cache stats")
+	return nil
+}
+
 var execCmd = cli.Command{
 	Name:      "exec",
 	Usage:     "execute a new process in a running container",
@@ -481,7 +702,12 @@ func doExec(ctx *cli.Context) error {
 	}
 
 	if detach {
-		pid, err := clxc.ExecDetached(args, procSpec)
+		var pid int
+		if clxc.Client != nil {
+			pid, err = clxc.Client.ExecDetached(context.Background(), clxc.ContainerID, args, procSpec)
+		} else {
+			pid, err = clxc.Runtime.ExecDetached(context.Background(), args, procSpec)
+		}
 		if err != nil {
 			return err
 		}
@@ -489,7 +715,12 @@ func doExec(ctx *cli.Context) error {
 			return lxcontainer.CreatePidFile(pidFile, pid)
 		}
 	} else {
-		status, err := clxc.Exec(args, procSpec)
+		var status int
+		if clxc.Client != nil {
+			status, err = clxc.Client.Exec(context.Background(), clxc.ContainerID, args, procSpec)
+		} else {
+			status, err = clxc.Runtime.Exec(context.Background(), args, procSpec)
+		}
 		if err != nil {
 			return err
 		}
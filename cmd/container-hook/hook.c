@@ -7,12 +7,50 @@
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
+#include <stdint.h>
 #include <sys/mount.h>
 #include <sys/stat.h>
+#include <sys/syscall.h>
 #include <sys/sysmacros.h>
 #include <sys/types.h>
 #include <unistd.h>
 
+// The syscalls are not wrapped by glibc and may be missing in older headers.
+#ifndef __NR_openat2
+#define __NR_openat2 437
+#endif
+
+#ifndef __NR_mount_setattr
+#define __NR_mount_setattr 442
+#endif
+
+#ifndef AT_RECURSIVE
+#define AT_RECURSIVE 0x8000
+#endif
+
+#ifndef RESOLVE_NO_MAGICLINKS
+#define RESOLVE_NO_MAGICLINKS 0x02
+#endif
+
+#ifndef RESOLVE_IN_ROOT
+#define RESOLVE_IN_ROOT 0x10
+#endif
+
+// see `man 2 openat2`
+struct hook_open_how {
+	uint64_t flags;
+	uint64_t mode;
+	uint64_t resolve;
+};
+
+// see `man 2 mount_setattr`
+struct hook_mount_attr {
+	uint64_t attr_set;
+	uint64_t attr_clr;
+	uint64_t propagation;
+	uint64_t userns_fd;
+};
+
 #define ERROR(...)                   \
 	{                            \
 		printf(__VA_ARGS__); \
@@ -197,6 +235,97 @@ out:
 	return (errno == 0) ? 0 : -1;
 }
 
+/* applies the mount attributes from attrs recursively to the mounts in rootfs */
+int set_mount_attrs_at(int rootfs, int runtime, const char *attrs)
+{
+	// limits.h PATH_MAX
+	char line[PATH_MAX + 64];
+	const char *rel;
+	int fd;
+	FILE *f;
+
+	printf("reading file \"%s\" from runtime directory\n", attrs);
+	fd = openat(runtime, attrs, O_RDONLY);
+	if (fd == -1) {
+		if (errno == ENOENT) {
+			printf("file \"%s\" does not exist\n", attrs);
+			return 0;
+		}
+		return -1;
+	}
+
+	f = fdopen(fd, "r");
+	if (f == NULL) {
+		printf("file descriptor for runtime directory is null: %s",
+		       strerror(errno));
+		close(fd);
+		return -1;
+	}
+
+	for (int n = 0; fgets(line, sizeof(line), f) != NULL; n++) {
+		unsigned long long attr_set, attr_clr;
+		int optional, pos;
+
+		line[strcspn(line, "\n")] = '\0'; // remove newline
+		if (sscanf(line, "%llx %llx %d %n", &attr_set, &attr_clr,
+			   &optional, &pos) != 3) {
+			printf("%s:%d invalid format\n", attrs, n);
+			errno = EINVAL;
+			goto out;
+		}
+		rel = line + pos;
+		while (*rel == '/') // trim leading '/'
+			rel++;
+		if (*rel == '\0')
+			rel = ".";
+
+		// resolve symlinks within the rootfs
+		struct hook_open_how how = {
+			.flags = O_PATH | O_CLOEXEC,
+			.resolve = RESOLVE_IN_ROOT | RESOLVE_NO_MAGICLINKS,
+		};
+		fd = syscall(__NR_openat2, rootfs, rel, &how, sizeof(how));
+		if (fd == -1) {
+			if (optional && (errno == ENOENT || errno == ENOSYS)) {
+				printf("ignore mount attributes for %s: %s\n",
+				       rel, strerror(errno));
+				errno = 0;
+				continue;
+			}
+			printf("%s:%d failed to open \"%s\": %s\n", attrs, n,
+			       rel, strerror(errno));
+			goto out;
+		}
+
+		struct hook_mount_attr attr = {
+			.attr_set = attr_set,
+			.attr_clr = attr_clr,
+		};
+		printf("setting mount attributes set:%llx clear:%llx on %s\n",
+		       attr_set, attr_clr, rel);
+		if (syscall(__NR_mount_setattr, fd, "",
+			    AT_EMPTY_PATH | AT_RECURSIVE, &attr,
+			    sizeof(attr)) == -1) {
+			if (optional && errno == ENOSYS) {
+				printf("ignore mount attributes for %s: %s\n",
+				       rel, strerror(errno));
+				errno = 0;
+				close(fd);
+				continue;
+			}
+			printf("%s:%d failed to set mount attributes on \"%s\": %s\n",
+			       attrs, n, rel, strerror(errno));
+			close(fd);
+			goto out;
+		}
+		close(fd);
+	}
+	errno = 0;
+out:
+	fclose(f);
+	return (errno == 0) ? 0 : -1;
+}
+
 int main(int argc, char **argv)
 {
 	const char *rootfs_mount;
@@ -230,6 +359,10 @@ int main(int argc, char **argv)
 	if (create_devices_at(rootfs_fd, runtime_fd, "devices.txt") == -1)
 		ERROR("failed to create devices: %s", strerror(errno));
 
+	printf("setting mount attributes in container rootfs\n");
+	if (set_mount_attrs_at(rootfs_fd, runtime_fd, "mountattrs.txt") == -1)
+		ERROR("failed to set mount attributes: %s", strerror(errno));
+
 	printf("masking files and directories in container rootfs\n");
 	if (mask_paths_at(rootfs_fd, runtime_fd, "masked.txt") == -1)
 		ERROR("failed to mask paths: %s", strerror(errno));
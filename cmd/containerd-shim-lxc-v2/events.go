@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	eventsAPI "github.com/containerd/containerd/api/services/ttrpc/events/v1"
+	"github.com/containerd/containerd/api/types"
+	"github.com/containerd/ttrpc"
+	"github.com/containerd/typeurl/v2"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Event topics published by the shim.
+const (
+	topicTaskCreate      = "/tasks/create"
+	topicTaskStart       = "/tasks/start"
+	topicTaskExit        = "/tasks/exit"
+	topicTaskDelete      = "/tasks/delete"
+	topicTaskExecAdded   = "/tasks/exec-added"
+	topicTaskExecStarted = "/tasks/exec-started"
+	topicTaskPaused      = "/tasks/paused"
+	topicTaskResumed     = "/tasks/resumed"
+)
+
+// eventQueueSize is the number of events that are buffered
+// before Publish blocks.
+const eventQueueSize = 128
+
+type event struct {
+	topic     string
+	timestamp time.Time
+	event     interface{}
+}
+
+// publisher forwards task events to containerd.
+// Events are forwarded in order by a single goroutine.
+type publisher struct {
+	address   string
+	namespace string
+	log       zerolog.Logger
+
+	events chan event
+	done   chan struct{}
+	once   sync.Once
+
+	client *ttrpc.Client
+}
+
+// newPublisher returns a publisher that forwards events to the containerd
+// ttrpc events service at address. Events are discarded if address is empty.
+func newPublisher(address string, namespace string, log zerolog.Logger) *publisher {
+	p := &publisher{
+		address:   strings.TrimPrefix(address, "unix://"),
+		namespace: namespace,
+		log:       log,
+		events:    make(chan event, eventQueueSize),
+		done:      make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Publish queues the event for forwarding.
+func (p *publisher) Publish(topic string, ev interface{}) {
+	select {
+	case p.events <- event{topic: topic, timestamp: time.Now(), event: ev}:
+	case <-p.done:
+	}
+}
+
+// Close stops forwarding events. Queued events are forwarded before Close returns.
+func (p *publisher) Close() {
+	p.once.Do(func() {
+		close(p.events)
+		<-p.done
+	})
+}
+
+func (p *publisher) run() {
+	defer close(p.done)
+	for ev := range p.events {
+		if p.address == "" {
+			p.log.Debug().Str("topic", ev.topic).Msg("discard event")
+			continue
+		}
+		if err := p.forward(ev); err != nil {
+			p.log.Error().Err(err).Str("topic", ev.topic).Msg("failed to publish event")
+		}
+	}
+	if p.client != nil {
+		p.client.Close()
+	}
+}
+
+func (p *publisher) forward(ev event) error {
+	a, err := typeurl.MarshalAny(ev.event)
+	if err != nil {
+		return err
+	}
+	if p.client == nil {
+		conn, err := net.Dial("unix", p.address)
+		if err != nil {
+			return err
+		}
+		p.client = ttrpc.NewClient(conn)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	req := &eventsAPI.ForwardRequest{
+		Envelope: &types.Envelope{
+			Timestamp: timestamppb.New(ev.timestamp),
+			Namespace: p.namespace,
+			Topic:     ev.topic,
+			Event:     &anypb.Any{TypeUrl: a.GetTypeUrl(), Value: a.GetValue()},
+		},
+	}
+	_, err = eventsAPI.NewEventsClient(p.client).Forward(ctx, req)
+	if err == ttrpc.ErrClosed {
+		// reconnect on the next event
+		p.client.Close()
+		p.client = nil
+	}
+	return err
+}
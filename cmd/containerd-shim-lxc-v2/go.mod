@@ -0,0 +1,37 @@
+module github.com/lxc/crio-lxc/cmd/containerd-shim-lxc-v2
+
+go 1.21
+
+require (
+	github.com/containerd/cgroups/v3 v3.0.3
+	github.com/containerd/containerd/api v1.8.0
+	github.com/containerd/errdefs v0.1.0
+	github.com/containerd/ttrpc v1.2.5
+	github.com/containerd/typeurl/v2 v2.1.1
+	github.com/lxc/crio-lxc v0.0.0-00010101000000-000000000000
+	github.com/opencontainers/runtime-spec v1.1.0
+	github.com/rs/zerolog v1.20.0
+	github.com/stretchr/testify v1.8.2
+	golang.org/x/sys v0.18.0
+	google.golang.org/protobuf v1.33.0
+)
+
+require (
+	github.com/containerd/log v0.1.0 // indirect
+	github.com/creack/pty v1.1.11 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gogo/protobuf v1.3.2 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/opencontainers/go-digest v1.0.0 // indirect
+	github.com/opencontainers/image-spec v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/sirupsen/logrus v1.9.3 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240401170217-c3f982113cda // indirect
+	google.golang.org/grpc v1.59.0 // indirect
+	gopkg.in/lxc/go-lxc.v2 v2.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/lxc/crio-lxc => ../..
+
+replace gopkg.in/lxc/go-lxc.v2 v2.0.0 => github.com/Drachenfels-GmbH/go-lxc v0.0.0-20201106192530-079aead12fef
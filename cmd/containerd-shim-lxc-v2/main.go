@@ -0,0 +1,313 @@
+// containerd-shim-lxc-v2 is a containerd shim v2 for crio-lxc.
+//
+// containerd executes the shim binary with the action 'start' to start a shim,
+// and with the action 'delete' to clean up after a shim that died.
+// The started shim serves the task API (ttrpc) on a unix socket
+// and creates the containers with lxcontainer.Runtime. The container process
+// is started by crio-lxc-start (the container monitor process) just like with crio-lxc.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	taskAPI "github.com/containerd/containerd/api/runtime/task/v2"
+	"github.com/containerd/ttrpc"
+	"github.com/lxc/crio-lxc/lxcontainer"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// version is set at build time
+var version string
+
+// sandboxIDAnnotation is set by the containerd CRI plugin.
+// All containers of a pod are managed by a single shim.
+const sandboxIDAnnotation = "io.kubernetes.cri.sandbox-id"
+
+var (
+	namespaceFlag     string
+	idFlag            string
+	addressFlag       string
+	publishBinaryFlag string
+	bundleFlag        string
+	debugFlag         bool
+	versionFlag       bool
+)
+
+func parseFlags() {
+	flag.StringVar(&namespaceFlag, "namespace", "", "namespace that owns the shim")
+	flag.StringVar(&idFlag, "id", "", "id of the task")
+	flag.StringVar(&addressFlag, "address", "", "grpc address back to main containerd")
+	flag.StringVar(&publishBinaryFlag, "publish-binary", "containerd", "path to publish binary (used for publishing events)")
+	flag.StringVar(&bundleFlag, "bundle", "", "path to the bundle if not workdir")
+	flag.BoolVar(&debugFlag, "debug", false, "enable debug output in logs")
+	flag.BoolVar(&versionFlag, "v", false, "show the shim version and exit")
+	flag.Parse()
+}
+
+func main() {
+	parseFlags()
+	if versionFlag {
+		fmt.Printf("%s version: %s\n", filepath.Base(os.Args[0]), version)
+		os.Exit(0)
+	}
+	if namespaceFlag == "" {
+		fmt.Fprintln(os.Stderr, "shim namespace cannot be empty")
+		os.Exit(1)
+	}
+
+	var err error
+	switch action := flag.Arg(0); action {
+	case "start":
+		err = start()
+	case "delete":
+		err = deleteAction()
+	case "":
+		err = serve()
+	default:
+		err = fmt.Errorf("unsupported action %q", action)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filepath.Base(os.Args[0]), err)
+		os.Exit(1)
+	}
+}
+
+// runtimeRoot returns the runtime root for all containers in the namespace.
+func runtimeRoot(namespace string) string {
+	return filepath.Join(lxcontainer.DefaultRuntimeRoot, "containerd", namespace)
+}
+
+// socketPath returns the path of the shim socket for the given group ID.
+// The path length must not exceed the maximum length of a unix socket path (108).
+func socketPath(groupID string) string {
+	h := sha256.Sum256([]byte(addressFlag + "/" + namespaceFlag + "/" + groupID))
+	return filepath.Join(lxcontainer.DefaultRuntimeRoot, "s", hex.EncodeToString(h[:]))
+}
+
+// groupID returns the sandbox ID of the container in the bundle
+// or the container ID if the container is not part of a sandbox.
+func groupID(bundle string) (string, error) {
+	spec, err := lxcontainer.ReadSpec(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return "", err
+	}
+	if id, ok := spec.Annotations[sandboxIDAnnotation]; ok && id != "" {
+		return id, nil
+	}
+	return idFlag, nil
+}
+
+// start starts a new shim process or returns the address of the running shim
+// for the container group. The shim address is written to stdout.
+func start() error {
+	bundle, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	id, err := groupID(bundle)
+	if err != nil {
+		return fmt.Errorf("failed to read spec: %w", err)
+	}
+	sockPath := socketPath(id)
+	address := "unix://" + sockPath
+
+	if conn, err := net.Dial("unix", sockPath); err == nil {
+		// shim for the group is already running
+		conn.Close()
+		return writeAddress(bundle, address)
+	}
+	// remove a stale socket
+	if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(sockPath), 0700); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return fmt.Errorf("failed to create shim socket: %w", err)
+	}
+	socket, err := l.(*net.UnixListener).File()
+	if err != nil {
+		return err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"-namespace", namespaceFlag, "-id", idFlag, "-address", addressFlag, "-publish-binary", publishBinaryFlag}
+	if debugFlag {
+		args = append(args, "-debug")
+	}
+	// #nosec
+	cmd := exec.Command(self, args...)
+	cmd.Dir = bundle
+	cmd.Env = append(os.Environ(), "GOMAXPROCS=2")
+	cmd.ExtraFiles = []*os.File{socket}
+	// the shim must not be killed with containerd
+	cmd.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start shim: %w", err)
+	}
+	if err := writeAddress(bundle, address); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	// The listener is now owned by the shim.
+	socket.Close()
+	return nil
+}
+
+func writeAddress(bundle string, address string) error {
+	if err := os.WriteFile(filepath.Join(bundle, "address"), []byte(address), 0600); err != nil {
+		return err
+	}
+	_, err := io.WriteString(os.Stdout, address)
+	return err
+}
+
+// deleteAction deletes the container in the bundle after the shim died.
+// The delete response is written to stdout.
+func deleteAction() error {
+	bundle := bundleFlag
+	if bundle == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		bundle = wd
+	}
+	rt, err := lxcontainer.NewRuntime(idFlag, lxcontainer.WithRuntimeRoot(runtimeRoot(namespaceFlag)))
+	if err != nil {
+		return err
+	}
+	defer rt.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	if err := rt.Delete(ctx, true); err != nil {
+		return err
+	}
+	if err := unmountRootfs(filepath.Join(bundle, "rootfs")); err != nil {
+		return err
+	}
+	data, err := proto.Marshal(&taskAPI.DeleteResponse{
+		ExitedAt:   timestamppb.Now(),
+		ExitStatus: 128 + uint32(unix.SIGKILL),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// openLog opens the log fifo created by containerd in the bundle directory.
+func openLog() io.Writer {
+	// containerd opens the fifo for reading before the shim is started
+	f, err := os.OpenFile("log", os.O_WRONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return os.Stderr
+	}
+	if err := unix.SetNonblock(int(f.Fd()), false); err != nil {
+		f.Close()
+		return os.Stderr
+	}
+	return f
+}
+
+// serve serves the task API on the socket passed as file descriptor 3 by start.
+func serve() error {
+	log := zerolog.New(openLog()).With().Timestamp().
+		Str("namespace", namespaceFlag).Int("pid", os.Getpid()).Logger().Level(zerolog.InfoLevel)
+	if debugFlag {
+		log = log.Level(zerolog.DebugLevel)
+	}
+
+	// Exec processes are reparented to the shim when the attach helper process exits.
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set shim as child subreaper: %w", err)
+	}
+
+	l, err := net.FileListener(os.NewFile(3, "socket"))
+	if err != nil {
+		return fmt.Errorf("failed to create listener from socket: %w", err)
+	}
+
+	server, err := ttrpc.NewServer()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	publisher := newPublisher(os.Getenv("TTRPC_ADDRESS"), namespaceFlag, log)
+	defer publisher.Close()
+
+	svc := newService(namespaceFlag, runtimeRoot(namespaceFlag), publisher, log, cancel)
+	taskAPI.RegisterTaskService(server, svc)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGTERM, unix.SIGINT)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Info().Stringer("signal", sig).Msg("shim terminated")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	go func() {
+		err := server.Serve(ctx, l)
+		if err != nil && err != ttrpc.ErrServerClosed {
+			log.Error().Err(err).Msg("ttrpc server failed")
+		}
+		cancel()
+	}()
+
+	log.Info().Str("version", version).Msg("shim started")
+	<-ctx.Done()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Warn().Err(err).Msg("failed to shutdown ttrpc server")
+	}
+	if addr, ok := l.Addr().(*net.UnixAddr); ok {
+		os.Remove(addr.Name)
+	}
+	return nil
+}
+
+// readSpecProcess decodes a specs.Process encoded as JSON.
+// containerd encodes the process spec as JSON in the exec request.
+func readSpecProcess(data []byte) (*specs.Process, error) {
+	proc := new(specs.Process)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(proc); err != nil {
+		return nil, fmt.Errorf("failed to decode process spec: %w", err)
+	}
+	return proc, nil
+}
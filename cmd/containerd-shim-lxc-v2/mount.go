@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/containerd/containerd/api/types"
+)
+
+// mountFlags maps the mount options used by containerd snapshotters to mount flags.
+var mountFlags = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"async":         {true, unix.MS_SYNCHRONOUS},
+	"atime":         {true, unix.MS_NOATIME},
+	"bind":          {false, unix.MS_BIND},
+	"defaults":      {false, 0},
+	"dev":           {true, unix.MS_NODEV},
+	"diratime":      {true, unix.MS_NODIRATIME},
+	"dirsync":       {false, unix.MS_DIRSYNC},
+	"exec":          {true, unix.MS_NOEXEC},
+	"mand":          {false, unix.MS_MANDLOCK},
+	"noatime":       {false, unix.MS_NOATIME},
+	"nodev":         {false, unix.MS_NODEV},
+	"nodiratime":    {false, unix.MS_NODIRATIME},
+	"noexec":        {false, unix.MS_NOEXEC},
+	"nomand":        {true, unix.MS_MANDLOCK},
+	"norelatime":    {true, unix.MS_RELATIME},
+	"nostrictatime": {true, unix.MS_STRICTATIME},
+	"nosuid":        {false, unix.MS_NOSUID},
+	"rbind":         {false, unix.MS_BIND | unix.MS_REC},
+	"relatime":      {false, unix.MS_RELATIME},
+	"remount":       {false, unix.MS_REMOUNT},
+	"ro":            {false, unix.MS_RDONLY},
+	"rw":            {true, unix.MS_RDONLY},
+	"strictatime":   {false, unix.MS_STRICTATIME},
+	"suid":          {true, unix.MS_NOSUID},
+	"sync":          {false, unix.MS_SYNCHRONOUS},
+}
+
+// parseMountOptions returns the mount flags and the filesystem specific mount data.
+func parseMountOptions(options []string) (flags uintptr, data string) {
+	var dataOpts []string
+	for _, o := range options {
+		if f, exist := mountFlags[o]; exist {
+			if f.clear {
+				flags &^= f.flag
+			} else {
+				flags |= f.flag
+			}
+			continue
+		}
+		dataOpts = append(dataOpts, o)
+	}
+	return flags, strings.Join(dataOpts, ",")
+}
+
+// mountRootfs mounts the rootfs mounts from the create request to rootfs.
+func mountRootfs(rootfs string, mounts []*types.Mount) error {
+	if err := os.MkdirAll(rootfs, 0711); err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		flags, data := parseMountOptions(m.Options)
+		fsType := m.Type
+		if fsType == "bind" {
+			flags |= unix.MS_BIND
+			fsType = ""
+		}
+		if err := unix.Mount(m.Source, rootfs, fsType, flags, data); err != nil {
+			return fmt.Errorf("failed to mount %s (type:%s) to %s: %w", m.Source, m.Type, rootfs, err)
+		}
+		// The read-only flag is ignored for the initial bind mount.
+		if flags&unix.MS_BIND != 0 && flags&unix.MS_RDONLY != 0 {
+			err := unix.Mount("", rootfs, "", flags|unix.MS_REMOUNT, "")
+			if err != nil {
+				return fmt.Errorf("failed to remount %s read-only: %w", rootfs, err)
+			}
+		}
+	}
+	return nil
+}
+
+// unmountRootfs unmounts all mounts from rootfs.
+// It is not an error if rootfs is not mounted.
+func unmountRootfs(rootfs string) error {
+	for {
+		err := unix.Unmount(rootfs, unix.MNT_DETACH)
+		switch err {
+		case nil:
+			continue
+		case unix.EINVAL, unix.ENOENT:
+			return nil
+		default:
+			return fmt.Errorf("failed to unmount %s: %w", rootfs, err)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	flags, data := parseMountOptions([]string{"rbind", "ro", "nosuid"})
+	require.Equal(t, uintptr(unix.MS_BIND|unix.MS_REC|unix.MS_RDONLY|unix.MS_NOSUID), flags)
+	require.Equal(t, "", data)
+
+	flags, data = parseMountOptions([]string{"ro", "rw", "index=off", "lowerdir=/a:/b", "upperdir=/c"})
+	require.Equal(t, uintptr(0), flags)
+	require.Equal(t, "index=off,lowerdir=/a:/b,upperdir=/c", data)
+}
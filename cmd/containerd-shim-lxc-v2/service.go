@@ -0,0 +1,649 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	taskAPI "github.com/containerd/containerd/api/runtime/task/v2"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/typeurl/v2"
+	"github.com/lxc/crio-lxc/lxcontainer"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// process is a task process, either the container process or an exec process.
+type process struct {
+	id    string
+	stdio stdio
+
+	// spec is the process spec of an exec process
+	spec *specs.Process
+
+	pid        int
+	exited     chan struct{}
+	exitStatus uint32
+	exitedAt   time.Time
+}
+
+func newProcess(id string, s stdio) *process {
+	return &process{id: id, stdio: s, exited: make(chan struct{})}
+}
+
+func (p *process) setExited(status int) {
+	p.exitStatus = uint32(status)
+	p.exitedAt = time.Now()
+	close(p.exited)
+}
+
+func (p *process) hasExited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// container is a task managed by the shim.
+type container struct {
+	// mu serializes the Runtime calls.
+	mu     sync.Mutex
+	rt     *lxcontainer.Runtime
+	bundle string
+	rootfs string
+	paused bool
+
+	init  *process
+	execs map[string]*process
+}
+
+// service implements the containerd task API (shim v2).
+type service struct {
+	mu         sync.Mutex
+	namespace  string
+	root       string
+	log        zerolog.Logger
+	events     *publisher
+	containers map[string]*container
+	// shutdown stops the shim
+	shutdown func()
+
+	// newRuntime creates the Runtime for a new container.
+	newRuntime func(id string, spec *specs.Spec) (*lxcontainer.Runtime, error)
+}
+
+func newService(namespace string, root string, events *publisher, log zerolog.Logger, shutdown func()) *service {
+	s := &service{
+		namespace:  namespace,
+		root:       root,
+		log:        log,
+		events:     events,
+		containers: make(map[string]*container),
+		shutdown:   shutdown,
+	}
+	s.newRuntime = s.defaultRuntime
+	return s
+}
+
+func (s *service) defaultRuntime(id string, spec *specs.Spec) (*lxcontainer.Runtime, error) {
+	// containerd uses the systemd cgroup path format (slice:prefix:name) if the systemd cgroup driver is enabled.
+	systemdCgroup := spec.Linux != nil && strings.Count(spec.Linux.CgroupsPath, ":") == 2
+	level := "warn"
+	if debugFlag {
+		level = "debug"
+	}
+	return lxcontainer.NewRuntime(id,
+		lxcontainer.WithLogger(s.log),
+		lxcontainer.WithRuntimeRoot(s.root),
+		lxcontainer.WithContainerLog(lxcontainer.DefaultContainerLogFile, level),
+		lxcontainer.WithSystemdCgroup(systemdCgroup),
+	)
+}
+
+// toGRPC converts an error to a ttrpc error with a status code known by containerd.
+func toGRPC(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, lxcontainer.ErrNotExist):
+		err = fmt.Errorf("%s: %w", err, errdefs.ErrNotFound)
+	case errors.Is(err, lxcontainer.ErrExist):
+		err = fmt.Errorf("%s: %w", err, errdefs.ErrAlreadyExists)
+	}
+	return errdefs.ToGRPC(err)
+}
+
+func (s *service) getContainer(id string) (*container, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, exist := s.containers[id]
+	if !exist {
+		return nil, toGRPC(fmt.Errorf("container %s: %w", id, errdefs.ErrNotFound))
+	}
+	return c, nil
+}
+
+// getProcess returns the container process if execID is empty and the exec process otherwise.
+func (s *service) getProcess(id string, execID string) (*container, *process, error) {
+	c, err := s.getContainer(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if execID == "" {
+		return c, c.init, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, exist := c.execs[execID]
+	if !exist {
+		return nil, nil, toGRPC(fmt.Errorf("exec %s in container %s: %w", execID, id, errdefs.ErrNotFound))
+	}
+	return c, p, nil
+}
+
+// State implements taskAPI.TaskService
+func (s *service) State(ctx context.Context, req *taskAPI.StateRequest) (*taskAPI.StateResponse, error) {
+	c, p, err := s.getProcess(req.ID, req.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	resp := &taskAPI.StateResponse{
+		ID:       req.ID,
+		ExecID:   req.ExecID,
+		Bundle:   c.bundle,
+		Pid:      uint32(p.pid),
+		Stdin:    p.stdio.stdin,
+		Stdout:   p.stdio.stdout,
+		Stderr:   p.stdio.stderr,
+		Terminal: p.stdio.terminal,
+	}
+
+	switch {
+	case p.hasExited():
+		resp.Status = task.Status_STOPPED
+		resp.ExitStatus = p.exitStatus
+		resp.ExitedAt = timestamppb.New(p.exitedAt)
+	case req.ExecID != "":
+		if p.pid == 0 {
+			resp.Status = task.Status_CREATED
+		} else {
+			resp.Status = task.Status_RUNNING
+		}
+	default:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		state, err := c.rt.State(ctx)
+		if err != nil {
+			return nil, toGRPC(err)
+		}
+		resp.Status = taskStatus(state.Status, c.paused)
+	}
+	return resp, nil
+}
+
+func taskStatus(status specs.ContainerState, paused bool) task.Status {
+	switch status {
+	case specs.StateCreating, specs.StateCreated:
+		return task.Status_CREATED
+	case specs.StateRunning:
+		if paused {
+			return task.Status_PAUSED
+		}
+		return task.Status_RUNNING
+	case specs.StateStopped:
+		return task.Status_STOPPED
+	default:
+		return task.Status_UNKNOWN
+	}
+}
+
+// Create implements taskAPI.TaskService
+func (s *service) Create(ctx context.Context, req *taskAPI.CreateTaskRequest) (*taskAPI.CreateTaskResponse, error) {
+	s.mu.Lock()
+	_, exist := s.containers[req.ID]
+	s.mu.Unlock()
+	if exist {
+		return nil, toGRPC(fmt.Errorf("container %s: %w", req.ID, errdefs.ErrAlreadyExists))
+	}
+
+	c, err := s.create(ctx, req)
+	if err != nil {
+		s.log.Error().Err(err).Str("cid", req.ID).Msg("failed to create container")
+		return nil, toGRPC(err)
+	}
+
+	s.mu.Lock()
+	s.containers[req.ID] = c
+	s.mu.Unlock()
+
+	go s.waitInit(c, req.ID)
+
+	s.events.Publish(topicTaskCreate, &eventstypes.TaskCreate{
+		ContainerID: req.ID,
+		Bundle:      req.Bundle,
+		Rootfs:      req.Rootfs,
+		IO: &eventstypes.TaskIO{
+			Stdin:    req.Stdin,
+			Stdout:   req.Stdout,
+			Stderr:   req.Stderr,
+			Terminal: req.Terminal,
+		},
+		Checkpoint: req.Checkpoint,
+		Pid:        uint32(c.init.pid),
+	})
+	return &taskAPI.CreateTaskResponse{Pid: uint32(c.init.pid)}, nil
+}
+
+func (s *service) create(ctx context.Context, req *taskAPI.CreateTaskRequest) (*container, error) {
+	if req.Checkpoint != "" {
+		return nil, fmt.Errorf("checkpoint restore is not supported: %w", errdefs.ErrNotImplemented)
+	}
+	spec, err := lxcontainer.ReadSpec(filepath.Join(req.Bundle, "config.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec: %w", err)
+	}
+
+	c := &container{
+		bundle: req.Bundle,
+		init:   newProcess("", stdio{stdin: req.Stdin, stdout: req.Stdout, stderr: req.Stderr, terminal: req.Terminal}),
+		execs:  make(map[string]*process),
+	}
+
+	c.rt, err = s.newRuntime(req.ID, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := c.init.stdio.open()
+	if err != nil {
+		return nil, err
+	}
+	// The stdio files are inherited by the container monitor process.
+	defer closeStdio(files)
+
+	if len(req.Rootfs) > 0 {
+		c.rootfs = filepath.Join(req.Bundle, "rootfs")
+		if err := mountRootfs(c.rootfs, req.Rootfs); err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.rt.Create(ctx, lxcontainer.CreateOptions{
+		BundlePath: req.Bundle,
+		PidFile:    filepath.Join(req.Bundle, "monitor.pid"),
+		Stdio:      files,
+	})
+	if err == nil {
+		c.init.pid, err = c.rt.Pid()
+	}
+	if err != nil {
+		if err := c.rt.Delete(context.Background(), true); err != nil {
+			s.log.Warn().Err(err).Str("cid", req.ID).Msg("failed to cleanup container")
+		}
+		if err := unmountRootfs(c.rootfs); err != nil {
+			s.log.Warn().Err(err).Str("cid", req.ID).Msg("failed to cleanup rootfs")
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// waitInit waits for the container monitor process to exit.
+func (s *service) waitInit(c *container, id string) {
+	status, err := c.rt.Wait(context.Background())
+	if err != nil {
+		s.log.Error().Err(err).Str("cid", id).Msg("failed to wait for container process")
+	}
+	c.init.setExited(status)
+	s.log.Info().Str("cid", id).Int("status", status).Msg("container process exited")
+	s.events.Publish(topicTaskExit, &eventstypes.TaskExit{
+		ContainerID: id,
+		ID:          id,
+		Pid:         uint32(c.init.pid),
+		ExitStatus:  c.init.exitStatus,
+		ExitedAt:    timestamppb.New(c.init.exitedAt),
+	})
+}
+
+// waitExec waits for an exec process to exit.
+// The exec process is reparented to the shim (child subreaper) after the attach helper process exits.
+func (s *service) waitExec(id string, p *process) {
+	var ws unix.WaitStatus
+	status := 255
+	for {
+		_, err := unix.Wait4(p.pid, &ws, 0, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			s.log.Error().Err(err).Str("cid", id).Str("exec", p.id).Msg("failed to wait for exec process")
+		} else if ws.Signaled() {
+			status = 128 + int(ws.Signal())
+		} else {
+			status = ws.ExitStatus()
+		}
+		break
+	}
+	p.setExited(status)
+	s.events.Publish(topicTaskExit, &eventstypes.TaskExit{
+		ContainerID: id,
+		ID:          p.id,
+		Pid:         uint32(p.pid),
+		ExitStatus:  p.exitStatus,
+		ExitedAt:    timestamppb.New(p.exitedAt),
+	})
+}
+
+// Start implements taskAPI.TaskService
+func (s *service) Start(ctx context.Context, req *taskAPI.StartRequest) (*taskAPI.StartResponse, error) {
+	c, p, err := s.getProcess(req.ID, req.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	if p.hasExited() {
+		return nil, toGRPC(fmt.Errorf("process %s has exited: %w", p.id, errdefs.ErrFailedPrecondition))
+	}
+
+	if req.ExecID == "" {
+		c.mu.Lock()
+		err := c.rt.Start(ctx)
+		c.mu.Unlock()
+		if err != nil {
+			return nil, toGRPC(err)
+		}
+		s.events.Publish(topicTaskStart, &eventstypes.TaskStart{ContainerID: req.ID, Pid: uint32(p.pid)})
+		return &taskAPI.StartResponse{Pid: uint32(p.pid)}, nil
+	}
+
+	files, err := p.stdio.open()
+	if err != nil {
+		return nil, toGRPC(err)
+	}
+	// The stdio files are inherited by the exec process.
+	defer closeStdio(files)
+
+	c.mu.Lock()
+	if p.pid != 0 {
+		c.mu.Unlock()
+		return nil, toGRPC(fmt.Errorf("exec %s was already started: %w", p.id, errdefs.ErrFailedPrecondition))
+	}
+	pid, err := c.rt.ExecDetachedStdio(ctx, p.spec.Args, p.spec, files)
+	if err == nil {
+		p.pid = pid
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return nil, toGRPC(err)
+	}
+	go s.waitExec(req.ID, p)
+
+	s.events.Publish(topicTaskExecStarted, &eventstypes.TaskExecStarted{ContainerID: req.ID, ExecID: p.id, Pid: uint32(pid)})
+	return &taskAPI.StartResponse{Pid: uint32(pid)}, nil
+}
+
+// Delete implements taskAPI.TaskService
+func (s *service) Delete(ctx context.Context, req *taskAPI.DeleteRequest) (*taskAPI.DeleteResponse, error) {
+	c, p, err := s.getProcess(req.ID, req.ExecID)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.ExecID != "" {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if p.pid != 0 && !p.hasExited() {
+			return nil, toGRPC(fmt.Errorf("exec %s is running: %w", p.id, errdefs.ErrFailedPrecondition))
+		}
+		delete(c.execs, p.id)
+		return deleteResponse(p), nil
+	}
+
+	c.mu.Lock()
+	err = c.rt.Delete(ctx, true)
+	if err == nil {
+		err = unmountRootfs(c.rootfs)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return nil, toGRPC(err)
+	}
+
+	// The monitor process exits after the container is killed.
+	select {
+	case <-p.exited:
+	case <-ctx.Done():
+		return nil, toGRPC(ctx.Err())
+	}
+
+	s.mu.Lock()
+	delete(s.containers, req.ID)
+	s.mu.Unlock()
+	c.rt.Release()
+
+	s.events.Publish(topicTaskDelete, &eventstypes.TaskDelete{
+		ContainerID: req.ID,
+		ID:          req.ID,
+		Pid:         uint32(p.pid),
+		ExitStatus:  p.exitStatus,
+		ExitedAt:    timestamppb.New(p.exitedAt),
+	})
+	return deleteResponse(p), nil
+}
+
+func deleteResponse(p *process) *taskAPI.DeleteResponse {
+	resp := &taskAPI.DeleteResponse{Pid: uint32(p.pid)}
+	if p.hasExited() {
+		resp.ExitStatus = p.exitStatus
+		resp.ExitedAt = timestamppb.New(p.exitedAt)
+	}
+	return resp
+}
+
+// Pids implements taskAPI.TaskService
+func (s *service) Pids(ctx context.Context, req *taskAPI.PidsRequest) (*taskAPI.PidsResponse, error) {
+	c, err := s.getContainer(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pids, err := c.rt.Pids(ctx)
+	if err != nil {
+		return nil, toGRPC(err)
+	}
+	resp := &taskAPI.PidsResponse{}
+	for _, pid := range pids {
+		resp.Processes = append(resp.Processes, &task.ProcessInfo{Pid: uint32(pid)})
+	}
+	return resp, nil
+}
+
+// Pause implements taskAPI.TaskService
+func (s *service) Pause(ctx context.Context, req *taskAPI.PauseRequest) (*emptypb.Empty, error) {
+	c, err := s.getContainer(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.rt.Pause(ctx); err != nil {
+		return nil, toGRPC(err)
+	}
+	c.paused = true
+	s.events.Publish(topicTaskPaused, &eventstypes.TaskPaused{ContainerID: req.ID})
+	return &emptypb.Empty{}, nil
+}
+
+// Resume implements taskAPI.TaskService
+func (s *service) Resume(ctx context.Context, req *taskAPI.ResumeRequest) (*emptypb.Empty, error) {
+	c, err := s.getContainer(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.rt.Resume(ctx); err != nil {
+		return nil, toGRPC(err)
+	}
+	c.paused = false
+	s.events.Publish(topicTaskResumed, &eventstypes.TaskResumed{ContainerID: req.ID})
+	return &emptypb.Empty{}, nil
+}
+
+// Checkpoint implements taskAPI.TaskService
+func (s *service) Checkpoint(ctx context.Context, req *taskAPI.CheckpointTaskRequest) (*emptypb.Empty, error) {
+	return nil, toGRPC(fmt.Errorf("checkpoint: %w", errdefs.ErrNotImplemented))
+}
+
+// Kill implements taskAPI.TaskService
+func (s *service) Kill(ctx context.Context, req *taskAPI.KillRequest) (*emptypb.Empty, error) {
+	c, p, err := s.getProcess(req.ID, req.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	if p.hasExited() {
+		return nil, toGRPC(fmt.Errorf("process %s has exited: %w", p.id, errdefs.ErrNotFound))
+	}
+	sig := unix.Signal(req.Signal)
+
+	if req.ExecID != "" {
+		if p.pid == 0 {
+			return nil, toGRPC(fmt.Errorf("exec %s is not started: %w", p.id, errdefs.ErrFailedPrecondition))
+		}
+		if err := unix.Kill(p.pid, sig); err != nil && err != unix.ESRCH {
+			return nil, toGRPC(err)
+		}
+		return &emptypb.Empty{}, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.rt.Kill(ctx, sig); err != nil {
+		return nil, toGRPC(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// Exec implements taskAPI.TaskService
+func (s *service) Exec(ctx context.Context, req *taskAPI.ExecProcessRequest) (*emptypb.Empty, error) {
+	c, err := s.getContainer(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if req.Spec == nil {
+		return nil, toGRPC(fmt.Errorf("missing process spec: %w", errdefs.ErrInvalidArgument))
+	}
+	proc, err := readSpecProcess(req.Spec.GetValue())
+	if err != nil {
+		return nil, toGRPC(fmt.Errorf("%s: %w", err, errdefs.ErrInvalidArgument))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exist := c.execs[req.ExecID]; exist {
+		return nil, toGRPC(fmt.Errorf("exec %s: %w", req.ExecID, errdefs.ErrAlreadyExists))
+	}
+	p := newProcess(req.ExecID, stdio{stdin: req.Stdin, stdout: req.Stdout, stderr: req.Stderr, terminal: req.Terminal})
+	p.spec = proc
+	c.execs[req.ExecID] = p
+
+	s.events.Publish(topicTaskExecAdded, &eventstypes.TaskExecAdded{ContainerID: req.ID, ExecID: req.ExecID})
+	return &emptypb.Empty{}, nil
+}
+
+// ResizePty implements taskAPI.TaskService
+func (s *service) ResizePty(ctx context.Context, req *taskAPI.ResizePtyRequest) (*emptypb.Empty, error) {
+	return nil, toGRPC(fmt.Errorf("terminal is not supported: %w", errdefs.ErrNotImplemented))
+}
+
+// CloseIO implements taskAPI.TaskService
+// The shim does not keep the stdin of a process open, so there is nothing to close.
+func (s *service) CloseIO(ctx context.Context, req *taskAPI.CloseIORequest) (*emptypb.Empty, error) {
+	if _, _, err := s.getProcess(req.ID, req.ExecID); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// Update implements taskAPI.TaskService
+func (s *service) Update(ctx context.Context, req *taskAPI.UpdateTaskRequest) (*emptypb.Empty, error) {
+	return nil, toGRPC(fmt.Errorf("update: %w", errdefs.ErrNotImplemented))
+}
+
+// Wait implements taskAPI.TaskService
+func (s *service) Wait(ctx context.Context, req *taskAPI.WaitRequest) (*taskAPI.WaitResponse, error) {
+	_, p, err := s.getProcess(req.ID, req.ExecID)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, toGRPC(ctx.Err())
+	case <-p.exited:
+	}
+	return &taskAPI.WaitResponse{
+		ExitStatus: p.exitStatus,
+		ExitedAt:   timestamppb.New(p.exitedAt),
+	}, nil
+}
+
+// Stats implements taskAPI.TaskService
+func (s *service) Stats(ctx context.Context, req *taskAPI.StatsRequest) (*taskAPI.StatsResponse, error) {
+	c, err := s.getContainer(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	// The container info is reloaded by the Runtime calls.
+	c.mu.Lock()
+	cgroupDir := c.rt.CgroupDir
+	c.mu.Unlock()
+	metrics, err := cgroupStats(cgroupDir)
+	if err != nil {
+		return nil, toGRPC(fmt.Errorf("failed to read cgroup stats: %w", err))
+	}
+	a, err := typeurl.MarshalAny(metrics)
+	if err != nil {
+		return nil, toGRPC(err)
+	}
+	return &taskAPI.StatsResponse{Stats: &anypb.Any{TypeUrl: a.GetTypeUrl(), Value: a.GetValue()}}, nil
+}
+
+// Connect implements taskAPI.TaskService
+func (s *service) Connect(ctx context.Context, req *taskAPI.ConnectRequest) (*taskAPI.ConnectResponse, error) {
+	resp := &taskAPI.ConnectResponse{ShimPid: uint32(os.Getpid())}
+	s.mu.Lock()
+	c, exist := s.containers[req.ID]
+	s.mu.Unlock()
+	if exist {
+		resp.TaskPid = uint32(c.init.pid)
+	}
+	return resp, nil
+}
+
+// Shutdown implements taskAPI.TaskService
+// The shim is only stopped if it does not manage any container.
+func (s *service) Shutdown(ctx context.Context, req *taskAPI.ShutdownRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	n := len(s.containers)
+	s.mu.Unlock()
+	if n > 0 && !req.Now {
+		return &emptypb.Empty{}, nil
+	}
+	s.log.Info().Bool("now", req.Now).Msg("shutdown shim")
+	s.shutdown()
+	return &emptypb.Empty{}, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	taskAPI "github.com/containerd/containerd/api/runtime/task/v2"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/ttrpc"
+	"github.com/lxc/crio-lxc/lxcontainer"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// startTestShim serves the task API on a unix socket in a temporary directory.
+// It returns a task API client and a channel that is closed on shim shutdown.
+func startTestShim(t *testing.T) (taskAPI.TaskService, *service, <-chan struct{}) {
+	dir, err := ioutil.TempDir("", "crio-lxc-shim-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	l, err := net.Listen("unix", filepath.Join(dir, "shim.sock"))
+	require.NoError(t, err)
+
+	server, err := ttrpc.NewServer()
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	events := newPublisher("", "testing", zerolog.Nop())
+	svc := newService("testing", filepath.Join(dir, "root"), events, zerolog.Nop(), func() { close(done) })
+	taskAPI.RegisterTaskService(server, svc)
+	go server.Serve(context.Background(), l)
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	require.NoError(t, err)
+	client := ttrpc.NewClient(conn)
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		events.Close()
+	})
+	return taskAPI.NewTaskClient(client), svc, done
+}
+
+// addTestContainer adds a container that was not created by the runtime.
+func addTestContainer(t *testing.T, svc *service, id string) *container {
+	rt, err := lxcontainer.NewRuntime(id, lxcontainer.WithRuntimeRoot(svc.root))
+	require.NoError(t, err)
+	c := &container{
+		rt:    rt,
+		init:  newProcess("", stdio{}),
+		execs: make(map[string]*process),
+	}
+	c.init.pid = os.Getpid()
+	svc.mu.Lock()
+	svc.containers[id] = c
+	svc.mu.Unlock()
+	return c
+}
+
+func TestServiceConnectShutdown(t *testing.T) {
+	client, svc, done := startTestShim(t)
+	ctx := context.Background()
+
+	resp, err := client.Connect(ctx, &taskAPI.ConnectRequest{ID: "c1"})
+	require.NoError(t, err)
+	require.Equal(t, uint32(os.Getpid()), resp.ShimPid)
+	require.Equal(t, uint32(0), resp.TaskPid)
+
+	addTestContainer(t, svc, "c1")
+	resp, err = client.Connect(ctx, &taskAPI.ConnectRequest{ID: "c1"})
+	require.NoError(t, err)
+	require.Equal(t, uint32(os.Getpid()), resp.TaskPid)
+
+	// The shim is not stopped while it manages a container.
+	_, err = client.Shutdown(ctx, &taskAPI.ShutdownRequest{ID: "c1"})
+	require.NoError(t, err)
+	select {
+	case <-done:
+		t.Fatal("shim was stopped")
+	default:
+	}
+
+	svc.mu.Lock()
+	delete(svc.containers, "c1")
+	svc.mu.Unlock()
+	_, err = client.Shutdown(ctx, &taskAPI.ShutdownRequest{ID: "c1"})
+	require.NoError(t, err)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("shim was not stopped")
+	}
+}
+
+func TestServiceNotFound(t *testing.T) {
+	client, _, _ := startTestShim(t)
+	ctx := context.Background()
+
+	_, err := client.State(ctx, &taskAPI.StateRequest{ID: "c1"})
+	require.True(t, errdefs.IsNotFound(errdefs.FromGRPC(err)))
+
+	_, err = client.Kill(ctx, &taskAPI.KillRequest{ID: "c1", Signal: 9})
+	require.True(t, errdefs.IsNotFound(errdefs.FromGRPC(err)))
+
+	_, err = client.Wait(ctx, &taskAPI.WaitRequest{ID: "c1"})
+	require.True(t, errdefs.IsNotFound(errdefs.FromGRPC(err)))
+}
+
+func TestServiceCreate_invalidBundle(t *testing.T) {
+	client, svc, _ := startTestShim(t)
+	_, err := client.Create(context.Background(), &taskAPI.CreateTaskRequest{
+		ID:     "c1",
+		Bundle: filepath.Join(svc.root, "nonexistent"),
+	})
+	require.Error(t, err)
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	require.Empty(t, svc.containers)
+}
+
+func TestServiceCreate_terminal(t *testing.T) {
+	client, svc, _ := startTestShim(t)
+
+	bundle := filepath.Join(svc.root, "bundle")
+	require.NoError(t, os.MkdirAll(bundle, 0700))
+	spec, err := json.Marshal(&specs.Spec{Process: &specs.Process{Terminal: true}})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(bundle, "config.json"), spec, 0600))
+
+	_, err = client.Create(context.Background(), &taskAPI.CreateTaskRequest{ID: "c1", Bundle: bundle, Terminal: true})
+	require.True(t, errdefs.IsNotImplemented(errdefs.FromGRPC(err)))
+}
+
+func TestServiceExitedContainer(t *testing.T) {
+	client, svc, _ := startTestShim(t)
+	ctx := context.Background()
+	c := addTestContainer(t, svc, "c1")
+
+	waited := make(chan *taskAPI.WaitResponse, 1)
+	go func() {
+		resp, err := client.Wait(ctx, &taskAPI.WaitRequest{ID: "c1"})
+		require.NoError(t, err)
+		waited <- resp
+	}()
+
+	c.init.setExited(3)
+	select {
+	case resp := <-waited:
+		require.Equal(t, uint32(3), resp.ExitStatus)
+	case <-time.After(time.Second * 5):
+		t.Fatal("wait did not return")
+	}
+
+	state, err := client.State(ctx, &taskAPI.StateRequest{ID: "c1"})
+	require.NoError(t, err)
+	require.Equal(t, task.Status_STOPPED, state.Status)
+	require.Equal(t, uint32(3), state.ExitStatus)
+
+	_, err = client.Kill(ctx, &taskAPI.KillRequest{ID: "c1", Signal: 9})
+	require.True(t, errdefs.IsNotFound(errdefs.FromGRPC(err)))
+}
+
+func TestServiceExec(t *testing.T) {
+	client, svc, _ := startTestShim(t)
+	ctx := context.Background()
+	addTestContainer(t, svc, "c1")
+
+	proc, err := json.Marshal(&specs.Process{Args: []string{"/bin/true"}, Cwd: "/"})
+	require.NoError(t, err)
+	req := &taskAPI.ExecProcessRequest{
+		ID:     "c1",
+		ExecID: "e1",
+		Stdout: "/dev/null",
+		Spec:   &anypb.Any{TypeUrl: "types.containerd.io/opencontainers/runtime-spec/1/Process", Value: proc},
+	}
+	_, err = client.Exec(ctx, req)
+	require.NoError(t, err)
+
+	_, err = client.Exec(ctx, req)
+	require.True(t, errdefs.IsAlreadyExists(errdefs.FromGRPC(err)))
+
+	state, err := client.State(ctx, &taskAPI.StateRequest{ID: "c1", ExecID: "e1"})
+	require.NoError(t, err)
+	require.Equal(t, task.Status_CREATED, state.Status)
+	require.Equal(t, "e1", state.ExecID)
+	require.Equal(t, "/dev/null", state.Stdout)
+
+	_, err = client.Delete(ctx, &taskAPI.DeleteRequest{ID: "c1", ExecID: "e1"})
+	require.NoError(t, err)
+	_, err = client.State(ctx, &taskAPI.StateRequest{ID: "c1", ExecID: "e1"})
+	require.True(t, errdefs.IsNotFound(errdefs.FromGRPC(err)))
+}
+
+func TestTaskStatus(t *testing.T) {
+	require.Equal(t, task.Status_CREATED, taskStatus(specs.StateCreated, false))
+	require.Equal(t, task.Status_RUNNING, taskStatus(specs.StateRunning, false))
+	require.Equal(t, task.Status_PAUSED, taskStatus(specs.StateRunning, true))
+	require.Equal(t, task.Status_STOPPED, taskStatus(specs.StateStopped, true))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/cgroups/v3/cgroup2/stats"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupStats reads the cgroup2 metrics of the cgroup.
+// Metrics for controllers that are not enabled in the cgroup are omitted.
+func cgroupStats(cgroupDir string) (*stats.Metrics, error) {
+	dir := filepath.Join(cgroupRoot, cgroupDir)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	m := &stats.Metrics{}
+
+	if current, err := readCgroupUint(dir, "pids.current"); err == nil {
+		m.Pids = &stats.PidsStat{Current: current}
+		m.Pids.Limit, _ = readCgroupUint(dir, "pids.max")
+	}
+
+	if kv, err := readCgroupKeyValues(dir, "cpu.stat"); err == nil {
+		m.CPU = &stats.CPUStat{
+			UsageUsec:     kv["usage_usec"],
+			UserUsec:      kv["user_usec"],
+			SystemUsec:    kv["system_usec"],
+			NrPeriods:     kv["nr_periods"],
+			NrThrottled:   kv["nr_throttled"],
+			ThrottledUsec: kv["throttled_usec"],
+		}
+	}
+
+	if usage, err := readCgroupUint(dir, "memory.current"); err == nil {
+		m.Memory = &stats.MemoryStat{Usage: usage}
+		m.Memory.UsageLimit, _ = readCgroupUint(dir, "memory.max")
+		m.Memory.SwapUsage, _ = readCgroupUint(dir, "memory.swap.current")
+		m.Memory.SwapLimit, _ = readCgroupUint(dir, "memory.swap.max")
+		if kv, err := readCgroupKeyValues(dir, "memory.stat"); err == nil {
+			m.Memory.Anon = kv["anon"]
+			m.Memory.File = kv["file"]
+			m.Memory.KernelStack = kv["kernel_stack"]
+			m.Memory.Slab = kv["slab"]
+			m.Memory.Sock = kv["sock"]
+			m.Memory.Shmem = kv["shmem"]
+			m.Memory.FileMapped = kv["file_mapped"]
+			m.Memory.FileDirty = kv["file_dirty"]
+			m.Memory.FileWriteback = kv["file_writeback"]
+			m.Memory.Pgfault = kv["pgfault"]
+			m.Memory.Pgmajfault = kv["pgmajfault"]
+			m.Memory.InactiveAnon = kv["inactive_anon"]
+			m.Memory.ActiveAnon = kv["active_anon"]
+			m.Memory.InactiveFile = kv["inactive_file"]
+			m.Memory.ActiveFile = kv["active_file"]
+			m.Memory.Unevictable = kv["unevictable"]
+		}
+	}
+	return m, nil
+}
+
+// readCgroupUint reads a cgroup file with a single value.
+// The value 'max' is returned as math.MaxUint64.
+func readCgroupUint(dir string, name string) (uint64, error) {
+	// #nosec
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return ^uint64(0), nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// readCgroupKeyValues reads a flat keyed cgroup file (e.g cpu.stat).
+func readCgroupKeyValues(dir string, name string) (map[string]uint64, error) {
+	// #nosec
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	// #nosec
+	defer f.Close()
+
+	kv := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line %q in %s", scanner.Text(), name)
+		}
+		val, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s in %s: %w", fields[0], name, err)
+		}
+		kv[fields[0]] = val
+	}
+	return kv, scanner.Err()
+}
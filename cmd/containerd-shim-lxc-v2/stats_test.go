@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCgroupFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crio-lxc-shim-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "pids.current"), []byte("12\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "pids.max"), []byte("max\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cpu.stat"), []byte("usage_usec 100\nuser_usec 60\nsystem_usec 40\n"), 0600))
+
+	n, err := readCgroupUint(dir, "pids.current")
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), n)
+
+	n, err = readCgroupUint(dir, "pids.max")
+	require.NoError(t, err)
+	require.Equal(t, ^uint64(0), n)
+
+	kv, err := readCgroupKeyValues(dir, "cpu.stat")
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"usage_usec": 100, "user_usec": 60, "system_usec": 40}, kv)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "invalid.stat"), []byte("foo\n"), 0600))
+	_, err = readCgroupKeyValues(dir, "invalid.stat")
+	require.Error(t, err)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/containerd/errdefs"
+	"github.com/lxc/crio-lxc/lxcontainer"
+)
+
+// stdio are the paths of the stdio streams of a task process, as set by containerd.
+type stdio struct {
+	stdin    string
+	stdout   string
+	stderr   string
+	terminal bool
+}
+
+// open opens the stdio streams of a task process.
+// The files must be closed by the caller after the process is started.
+// A stream with an empty path is connected to /dev/null.
+func (s stdio) open() (files lxcontainer.Stdio, err error) {
+	if s.terminal {
+		return files, fmt.Errorf("terminal is not supported: %w", errdefs.ErrNotImplemented)
+	}
+	defer func() {
+		if err != nil {
+			closeStdio(files)
+		}
+	}()
+	files.Stdin, err = openStdin(s.stdin)
+	if err != nil {
+		return files, fmt.Errorf("failed to open stdin: %w", err)
+	}
+	files.Stdout, err = openOutput(s.stdout)
+	if err != nil {
+		return files, fmt.Errorf("failed to open stdout: %w", err)
+	}
+	files.Stderr, err = openOutput(s.stderr)
+	if err != nil {
+		return files, fmt.Errorf("failed to open stderr: %w", err)
+	}
+	return files, nil
+}
+
+func closeStdio(files lxcontainer.Stdio) {
+	for _, f := range []*os.File{files.Stdin, files.Stdout, files.Stderr} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+func openStdin(p string) (*os.File, error) {
+	if p == "" {
+		return os.Open(os.DevNull)
+	}
+	// Opening the fifo for reading must not block if containerd
+	// has not yet opened the fifo for writing.
+	// #nosec
+	f, err := os.OpenFile(p, os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	// The container process expects blocking IO.
+	if err := unix.SetNonblock(int(f.Fd()), false); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openOutput opens a fifo or file for writing.
+// containerd uses fifos for stdio and file:// URIs for log files.
+func openOutput(p string) (*os.File, error) {
+	if p == "" {
+		return os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	}
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "":
+		// containerd opens the fifo for reading before the task is created
+		// #nosec
+		return os.OpenFile(p, os.O_WRONLY, 0)
+	case "file":
+		// #nosec
+		return os.OpenFile(u.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	default:
+		return nil, fmt.Errorf("unsupported stdio scheme %q: %w", u.Scheme, errdefs.ErrNotImplemented)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/containerd/errdefs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStdioOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crio-lxc-shim-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fifo := filepath.Join(dir, "stdout")
+	require.NoError(t, unix.Mkfifo(fifo, 0600))
+	// keep the fifo open for reading like containerd does
+	r, err := os.OpenFile(fifo, os.O_RDONLY|unix.O_NONBLOCK, 0)
+	require.NoError(t, err)
+	defer r.Close()
+
+	logFile := filepath.Join(dir, "stderr.log")
+	files, err := stdio{stdout: fifo, stderr: "file://" + logFile}.open()
+	require.NoError(t, err)
+	defer closeStdio(files)
+
+	require.Equal(t, os.DevNull, files.Stdin.Name())
+	_, err = files.Stdout.WriteString("hello")
+	require.NoError(t, err)
+	_, err = files.Stderr.WriteString("world")
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = r.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	data, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(data))
+}
+
+func TestStdioOpen_unsupported(t *testing.T) {
+	_, err := stdio{terminal: true}.open()
+	require.True(t, errdefs.IsNotImplemented(err))
+
+	_, err = stdio{stdout: "binary:///usr/bin/logger"}.open()
+	require.True(t, errdefs.IsNotImplemented(err))
+}
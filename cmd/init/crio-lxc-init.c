@@ -2,12 +2,17 @@
 #include <dirent.h>
 #include <errno.h>
 #include <fcntl.h>
+#include <grp.h>
+#include <inttypes.h>
 #include <pwd.h>
 #include <signal.h>
 #include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
 #include <sys/prctl.h>
+#include <sys/resource.h>
+#include <sys/stat.h>
+#include <sys/syscall.h>
 #include <sys/types.h>
 #include <unistd.h>
 
@@ -15,6 +20,41 @@ const char *syncfifo_path = "syncfifo";
 const char *cmdline_path = "cmdline";
 const char *environ_path = "environ";
 const char *error_log = "error.log";
+const char *capabilities_path = "capabilities";
+const char *user_path = "user";
+
+#define MAX_GROUPS 256
+
+#ifndef PR_SET_NO_NEW_PRIVS
+#define PR_SET_NO_NEW_PRIVS 38
+#endif
+
+#ifndef PR_CAP_AMBIENT
+#define PR_CAP_AMBIENT 47
+#define PR_CAP_AMBIENT_RAISE 2
+#endif
+
+/* see linux/capability.h (musl does not ship the kernel headers) */
+#define CAP_VERSION_3 0x20080522
+
+struct cap_header {
+	uint32_t version;
+	int pid;
+};
+
+struct cap_data {
+	uint32_t effective;
+	uint32_t permitted;
+	uint32_t inheritable;
+};
+
+struct capabilities {
+	uint64_t bounding;
+	uint64_t effective;
+	uint64_t permitted;
+	uint64_t inheritable;
+	uint64_t ambient;
+};
 
 // A conformance test that will fail if SETENV_OVERWRITE is set to 0
 // is "StatefulSet [k8s.io] Basic StatefulSet functionality [StatefulSetBasic]
@@ -165,6 +205,155 @@ int load_environ(const char *path, char *buf, int buflen)
 	return 0;
 }
 
+/* load_capabilities reads the capability sets of the container process from path.
+ * The file contains the bounding, effective, permitted, inheritable and ambient set
+ * as hex bitmasks separated by spaces.
+ * It returns 0 if the file does not exist, 1 if the capabilities are loaded
+ * and -1 on error.
+ */
+int load_capabilities(const char *path, struct capabilities *caps)
+{
+	FILE *f;
+	int n;
+
+	f = fopen(path, "re");
+	if (f == NULL) {
+		if (errno == ENOENT) {
+			errno = 0;
+			return 0;
+		}
+		return -1;
+	}
+
+	n = fscanf(f, "%" SCNx64 " %" SCNx64 " %" SCNx64 " %" SCNx64 " %" SCNx64,
+		   &caps->bounding, &caps->effective, &caps->permitted,
+		   &caps->inheritable, &caps->ambient);
+	fclose(f);
+	if (n != 5) {
+		errno = EINVAL;
+		return -1;
+	}
+	errno = 0;
+	return 1;
+}
+
+/* set_user switches to the given user.
+ * The permitted capabilities are kept (PR_SET_KEEPCAPS), so they can be raised
+ * to the ambient set by apply_capabilities.
+ */
+int set_user(uid_t uid, gid_t gid, const gid_t *groups, int ngroups)
+{
+	if (setgroups(ngroups, groups) == -1)
+		return -1;
+	if (setgid(gid) == -1)
+		return -1;
+	if (prctl(PR_SET_KEEPCAPS, 1, 0, 0, 0) == -1)
+		return -1;
+	if (setuid(uid) == -1)
+		return -1;
+	return 0;
+}
+
+/* switch_user switches to the container user if the file path exists.
+ * The file contains the uid, the gid and the additional gids separated by spaces.
+ * It returns 0 if the file does not exist, 1 if the user is switched
+ * and -1 on error.
+ */
+int switch_user(const char *path)
+{
+	FILE *f;
+	unsigned int uid, gid, g;
+	gid_t groups[MAX_GROUPS];
+	int ngroups = 0;
+
+	f = fopen(path, "re");
+	if (f == NULL) {
+		if (errno == ENOENT) {
+			errno = 0;
+			return 0;
+		}
+		return -1;
+	}
+
+	if (fscanf(f, "%u %u", &uid, &gid) != 2) {
+		fclose(f);
+		errno = EINVAL;
+		return -1;
+	}
+	while (fscanf(f, "%u", &g) == 1) {
+		if (ngroups == MAX_GROUPS) {
+			fclose(f);
+			errno = E2BIG;
+			return -1;
+		}
+		groups[ngroups++] = g;
+	}
+	fclose(f);
+
+	if (set_user(uid, gid, groups, ngroups) == -1)
+		return -1;
+	errno = 0;
+	return 1;
+}
+
+/* raise_effective raises the permitted capabilities to the effective set.
+ * setuid clears the effective set, even if the permitted set is kept.
+ */
+int raise_effective()
+{
+	struct cap_header hdr = {CAP_VERSION_3, 0};
+	struct cap_data data[2];
+
+	if (syscall(SYS_capget, &hdr, data) == -1)
+		return -1;
+	data[0].effective = data[0].permitted;
+	data[1].effective = data[1].permitted;
+	return syscall(SYS_capset, &hdr, data);
+}
+
+/* apply_capabilities sets the capability sets of the process.
+ * Capabilities that are not in the permitted set of the process
+ * (e.g after liblxc switched to a non-root user) can not be raised and are dropped.
+ * The kernel recalculates the effective and permitted sets on execve,
+ * see 'man 7 capabilities' 'Transformation of capabilities during execve()'.
+ */
+int apply_capabilities(const struct capabilities *caps)
+{
+	struct cap_header hdr = {CAP_VERSION_3, 0};
+	struct cap_data data[2];
+	uint64_t permitted, inheritable, effective;
+	int cap;
+
+	if (syscall(SYS_capget, &hdr, data) == -1)
+		return -1;
+
+	permitted = (uint64_t)data[1].permitted << 32 | data[0].permitted;
+	inheritable = (uint64_t)data[1].inheritable << 32 | data[0].inheritable;
+
+	inheritable = (inheritable | permitted) & caps->inheritable;
+	permitted &= caps->permitted;
+	effective = permitted & caps->effective;
+
+	data[0].effective = (uint32_t)effective;
+	data[1].effective = (uint32_t)(effective >> 32);
+	data[0].permitted = (uint32_t)permitted;
+	data[1].permitted = (uint32_t)(permitted >> 32);
+	data[0].inheritable = (uint32_t)inheritable;
+	data[1].inheritable = (uint32_t)(inheritable >> 32);
+
+	if (syscall(SYS_capset, &hdr, data) == -1)
+		return -1;
+
+	/* ambient capabilities must be permitted and inheritable */
+	for (cap = 0; cap < 64; cap++) {
+		if ((caps->ambient & ((uint64_t)1 << cap)) == 0)
+			continue;
+		if (prctl(PR_CAP_AMBIENT, PR_CAP_AMBIENT_RAISE, cap, 0, 0) == -1)
+			return -1;
+	}
+	return 0;
+}
+
 /* Ensure_HOME_exists sets the HOME environment variable if it is not set.
  * There are containers that don't run without HOME being set e.g 'cilium v1.9.0'
  */
@@ -223,6 +412,272 @@ int close_extra_fds(int errfd)
 	return 0;
 }
 
+/* write_file writes content to the existing file path */
+int write_file(const char *path, const char *content)
+{
+	int fd;
+	ssize_t n;
+	size_t len = strlen(content);
+
+	fd = open(path, O_WRONLY | O_CLOEXEC);
+	if (fd == -1)
+		return -1;
+
+	n = write(fd, content, len);
+	if (n == -1) {
+		close(fd);
+		return -1;
+	}
+	if (close(fd) == -1)
+		return -1;
+	if ((size_t)n != len) {
+		errno = EIO;
+		return -1;
+	}
+	return 0;
+}
+
+/* set_apparmor_exec sets the apparmor profile that is applied on execve */
+int set_apparmor_exec(const char *profile)
+{
+	char buf[4096];
+	int n;
+
+	n = snprintf(buf, sizeof(buf), "exec %s", profile);
+	if (n < 0 || (size_t)n >= sizeof(buf)) {
+		errno = ENAMETOOLONG;
+		return -1;
+	}
+	/* the LSM specific interface is available since linux 5.8 */
+	if (write_file("/proc/self/attr/apparmor/exec", buf) == 0)
+		return 0;
+	if (errno != ENOENT)
+		return -1;
+	return write_file("/proc/self/attr/exec", buf);
+}
+
+/* drop_bounding drops all capabilities from the bounding set
+ * that are not in bounding. Dropping requires CAP_SETPCAP, even if the
+ * capability is already dropped, so dropped capabilities are skipped.
+ */
+int drop_bounding(uint64_t bounding)
+{
+	int cap;
+	int ret;
+
+	for (cap = 0; cap < 64; cap++) {
+		if (bounding & ((uint64_t)1 << cap))
+			continue;
+		ret = prctl(PR_CAPBSET_READ, cap, 0, 0, 0);
+		if (ret == 0)
+			continue;
+		if (ret == 1)
+			ret = prctl(PR_CAPBSET_DROP, cap, 0, 0, 0);
+		if (ret == -1) {
+			/* cap is not supported by the kernel (see /proc/sys/kernel/cap_last_cap) */
+			if (errno == EINVAL) {
+				errno = 0;
+				return 0;
+			}
+			return -1;
+		}
+	}
+	return 0;
+}
+
+/* parse_user parses the user from the format uid:gid[:gid,...] */
+int parse_user(const char *s, uid_t *uid, gid_t *gid, gid_t *groups,
+	       int *ngroups)
+{
+	unsigned int u, g;
+	int n = 0;
+
+	*ngroups = 0;
+	if (sscanf(s, "%u:%u%n", &u, &g, &n) != 2)
+		goto invalid;
+	*uid = u;
+	*gid = g;
+	s += n;
+
+	if (*s == ':') {
+		do {
+			s++;
+			if (*ngroups == MAX_GROUPS) {
+				errno = E2BIG;
+				return -1;
+			}
+			if (sscanf(s, "%u%n", &g, &n) != 1)
+				goto invalid;
+			groups[(*ngroups)++] = g;
+			s += n;
+		} while (*s == ',');
+	}
+	if (*s != '\0')
+		goto invalid;
+	return 0;
+
+invalid:
+	errno = EINVAL;
+	return -1;
+}
+
+/* exec_main applies the settings of an exec process that can not be
+ * applied by liblxc and executes the command. If the user is set,
+ * it is attached to the container as root and switches to the process user itself.
+ * Otherwise it is attached as the process user.
+ *
+ * usage: crio-lxc-init --exec [options] -- command [args...]
+ *
+ * -u uid:gid[:gid,...]   switch to the user
+ * -c bounding:effective:permitted:inheritable:ambient  capability sets (hex)
+ * -r resource:soft:hard  resource limit (repeatable)
+ * -o score               oom_score_adj
+ * -m mask                umask (octal)
+ * -i prio                io priority (see 'man 2 ioprio_set')
+ * -a profile             apparmor profile
+ * -l label               selinux label
+ * -n                     set no_new_privs
+ */
+int exec_main(int argc, char **argv)
+{
+	int errfd = 2;
+	int opt;
+	int i;
+
+	uid_t uid = 0;
+	gid_t gid = 0;
+	gid_t groups[MAX_GROUPS];
+	int ngroups = 0;
+	int has_user = 0;
+
+	struct capabilities caps;
+	int has_caps = 0;
+
+	struct {
+		int resource;
+		struct rlimit limit;
+	} limits[RLIM_NLIMITS];
+	int nlimits = 0;
+
+	const char *oom_score_adj = NULL;
+	const char *apparmor_profile = NULL;
+	const char *selinux_label = NULL;
+	int no_new_privs = 0;
+	int ioprio = -1;
+	long mask = -1;
+
+	while ((opt = getopt(argc, argv, "+u:c:r:o:m:i:a:l:n")) != -1) {
+		uint64_t soft, hard;
+		char *end;
+
+		switch (opt) {
+		case 'u':
+			if (parse_user(optarg, &uid, &gid, groups, &ngroups) == -1)
+				ERROR("invalid user \"%s\": %s\n", optarg,
+				      strerror(errno));
+			has_user = 1;
+			break;
+		case 'c':
+			if (sscanf(optarg,
+				   "%" SCNx64 ":%" SCNx64 ":%" SCNx64
+				   ":%" SCNx64 ":%" SCNx64,
+				   &caps.bounding, &caps.effective, &caps.permitted,
+				   &caps.inheritable, &caps.ambient) != 5)
+				ERROR("invalid capabilities \"%s\"\n", optarg);
+			has_caps = 1;
+			break;
+		case 'r':
+			if (nlimits == RLIM_NLIMITS)
+				ERROR("too many resource limits\n");
+			if (sscanf(optarg, "%d:%" SCNu64 ":%" SCNu64,
+				   &limits[nlimits].resource, &soft,
+				   &hard) != 3)
+				ERROR("invalid resource limit \"%s\"\n", optarg);
+			limits[nlimits].limit.rlim_cur = soft;
+			limits[nlimits].limit.rlim_max = hard;
+			nlimits++;
+			break;
+		case 'o':
+			oom_score_adj = optarg;
+			break;
+		case 'm':
+			errno = 0;
+			mask = strtol(optarg, &end, 8);
+			if (errno != 0 || *end != '\0' || mask < 0 || mask > 0777)
+				ERROR("invalid umask \"%s\"\n", optarg);
+			break;
+		case 'i':
+			if (sscanf(optarg, "%d", &ioprio) != 1)
+				ERROR("invalid io priority \"%s\"\n", optarg);
+			break;
+		case 'a':
+			apparmor_profile = optarg;
+			break;
+		case 'l':
+			selinux_label = optarg;
+			break;
+		case 'n':
+			no_new_privs = 1;
+			break;
+		default:
+			ERROR("usage: %s [options] -- command [args...]\n",
+			      argv[0]);
+		}
+	}
+
+	if (optind >= argc)
+		ERROR("missing command\n");
+
+	for (i = 0; i < nlimits; i++) {
+		if (setrlimit(limits[i].resource, &limits[i].limit) == -1)
+			ERROR("failed to set resource limit %d: %s\n",
+			      limits[i].resource, strerror(errno));
+	}
+
+	if (oom_score_adj != NULL &&
+	    write_file("/proc/self/oom_score_adj", oom_score_adj) == -1)
+		ERROR("failed to set oom_score_adj: %s\n", strerror(errno));
+
+	if (ioprio != -1 &&
+	    syscall(SYS_ioprio_set, 1 /* IOPRIO_WHO_PROCESS */, 0, ioprio) == -1)
+		ERROR("failed to set io priority: %s\n", strerror(errno));
+
+	if (mask != -1)
+		umask(mask);
+
+	if (apparmor_profile != NULL && set_apparmor_exec(apparmor_profile) == -1)
+		ERROR("failed to set apparmor profile \"%s\": %s\n",
+		      apparmor_profile, strerror(errno));
+
+	if (selinux_label != NULL &&
+	    write_file("/proc/self/attr/exec", selinux_label) == -1)
+		ERROR("failed to set selinux label \"%s\": %s\n", selinux_label,
+		      strerror(errno));
+
+	/* requires CAP_SETPCAP which is cleared from the effective set by setuid */
+	if (has_caps && drop_bounding(caps.bounding) == -1)
+		ERROR("failed to drop bounding capabilities: %s\n",
+		      strerror(errno));
+
+	if (has_user && set_user(uid, gid, groups, ngroups) == -1)
+		ERROR("failed to switch user: %s\n", strerror(errno));
+
+	if (ensure_HOME_exists() == -1)
+		ERROR("failed to set HOME environment variable: %s\n",
+		      strerror(errno));
+
+	if (no_new_privs && prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) == -1)
+		ERROR("failed to set no_new_privs: %s\n", strerror(errno));
+
+	if (has_caps && apply_capabilities(&caps) == -1)
+		ERROR("failed to apply capabilities: %s\n", strerror(errno));
+
+	if (execvp(argv[optind], argv + optind) == -1)
+		ERROR("failed to exec \"%s\": %s\n", argv[optind],
+		      strerror(errno));
+	return EXIT_FAILURE;
+}
+
 int main(int argc, char **argv)
 {
 	/* Buffer for reading arguments and environment variables.
@@ -242,10 +697,16 @@ int main(int argc, char **argv)
 
 	const char *container_id;
 
+	struct capabilities caps;
+	int has_caps = 0;
+
 	int ret = 0;
 
 	int errfd;
 
+	if (argc > 1 && strcmp(argv[1], "--exec") == 0)
+		return exec_main(argc - 1, argv + 1);
+
 	/* write errors to error.log if it exists otherwise to stderr */
 	errfd = open(error_log, O_WRONLY | O_CLOEXEC);
 	if (errfd == -1) {
@@ -260,6 +721,24 @@ int main(int argc, char **argv)
 
 	container_id = argv[1];
 
+	/* The capabilities file is only readable by the user init is started with. */
+	has_caps = load_capabilities(capabilities_path, &caps);
+	if (has_caps == -1)
+		ERROR("error reading capabilities file \"%s\": %s\n",
+		      capabilities_path, strerror(errno));
+
+	ret = switch_user(user_path);
+	if (ret == -1)
+		ERROR("failed to switch user: %s\n", strerror(errno));
+
+	/* The capabilities required to switch the user are kept in the bounding set
+	 * by liblxc (lxc.cap.keep) and dropped after the switch.
+	 */
+	if (ret == 1 && has_caps &&
+	    (raise_effective() == -1 || drop_bounding(caps.bounding) == -1))
+		ERROR("failed to drop bounding capabilities: %s\n",
+		      strerror(errno));
+
 	/* clear environment */
 	environ = NULL;
 
@@ -287,6 +766,9 @@ int main(int argc, char **argv)
 	if (close_extra_fds(errfd) == -1)
 		ERROR("failed to close extra fds: %s\n", strerror(errno));
 
+	if (has_caps && apply_capabilities(&caps) == -1)
+		ERROR("failed to apply capabilities: %s\n", strerror(errno));
+
 	if (execvp(args[0], args) == -1)
 		ERROR("failed to exec \"%s\": %s\n", args[0], strerror(errno));
 }
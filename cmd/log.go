@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// configureLogging opens the log file and creates the runtime logger.
+func configureLogging(cmdName string) error {
+	logDir := filepath.Dir(clxc.LogFilePath)
+	err := os.MkdirAll(logDir, 0750)
+	if err != nil {
+		return fmt.Errorf("failed to create log file directory %s: %w", logDir, err)
+	}
+
+	clxc.LogFile, err = os.OpenFile(clxc.LogFilePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	zerolog.LevelFieldName = "l"
+	zerolog.MessageFieldName = "m"
+
+	// match liblxc timestamp format
+	zerolog.TimestampFieldName = "t"
+	zerolog.TimeFieldFormat = clxc.LogTimestamp
+	zerolog.TimestampFunc = func() time.Time {
+		return time.Now().UTC()
+	}
+
+	// TODO only log caller information in debug and trace level
+	zerolog.CallerFieldName = "c"
+	zerolog.CallerMarshalFunc = func(file string, line int) string {
+		return filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+
+	// NOTE Unfortunately it's not possible change the possition of the timestamp.
+	// The ttimestamp is appended to the to the log output because it is dynamically rendered
+	// see https://github.com/rs/zerolog/issues/109
+	log := zerolog.New(clxc.LogFile).With().Timestamp().Caller().
+		Str("cmd", cmdName).Logger()
+
+	level, err := zerolog.ParseLevel(strings.ToLower(clxc.LogLevel))
+	if err != nil {
+		level = zerolog.InfoLevel
+		log.Warn().Err(err).Str("val", clxc.LogLevel).Stringer("default", level).
+			Msg("failed to parse log-level - fallback to default")
+	}
+	clxc.Log = log.Level(level)
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/lxc/crio-lxc/server"
+	"github.com/urfave/cli/v2"
+)
+
+var serveCmd = cli.Command{
+	Name:  "serve",
+	Usage: "serve the runtime commands for all containers over a unix socket",
+	Description: `The runtime daemon caches the container handles across runtime commands.
+Runtime commands are forwarded to the daemon if the global --socket flag is set.`,
+	Before: func(ctx *cli.Context) error {
+		if clxc.Socket == "" {
+			return fmt.Errorf("missing socket")
+		}
+		return configureLogging(ctx.Command.Name)
+	},
+	Action: doServe,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "socket",
+			Usage:       "path to the unix socket the daemon listens on",
+			EnvVars:     []string{"CRIO_LXC_SOCKET"},
+			Destination: &clxc.Socket,
+		},
+	},
+}
+
+func doServe(unused *cli.Context) error {
+	// remove the socket of a previous daemon
+	if err := os.Remove(clxc.Socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove socket: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(clxc.Socket), 0700); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: clxc.Socket, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("failed to listen on socket: %w", err)
+	}
+	if err := os.Chmod(clxc.Socket, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGTERM, unix.SIGINT)
+	go func() {
+		sig := <-sigs
+		clxc.Log.Info().Stringer("signal", sig).Msg("shutting down")
+		cancel()
+	}()
+
+	srv := server.NewServer(newRuntime, clxc.Log)
+	defer srv.Release()
+
+	clxc.Log.Info().Str("socket", clxc.Socket).Msg("serving runtime commands")
+	return srv.Serve(ctx, l)
+}
@@ -49,6 +49,10 @@ func parseSignal(sig string) unix.Signal {
 	}
 	// handle numerical signal value
 	if num, err := strconv.Atoi(sig); err == nil {
+		// valid signal numbers are 1-64 (including realtime signals)
+		if num < 1 || num > 64 {
+			return 0
+		}
 		return unix.Signal(num)
 	}
 
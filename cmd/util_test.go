@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSignal(t *testing.T) {
+	require.Equal(t, unix.SIGTERM, parseSignal(""))
+	require.Equal(t, unix.SIGKILL, parseSignal("9"))
+	require.Equal(t, unix.SIGKILL, parseSignal("kill"))
+	require.Equal(t, unix.SIGKILL, parseSignal("sigkill"))
+	require.Equal(t, unix.SIGKILL, parseSignal("KILL"))
+	require.Equal(t, unix.SIGKILL, parseSignal("SIGKILL"))
+	require.Equal(t, unix.Signal(0), parseSignal("SIGNOTEXIST"))
+	require.Equal(t, unix.Signal(0), parseSignal("66"))
+}
@@ -2,7 +2,7 @@ module github.com/lxc/crio-lxc
 
 require (
 	github.com/creack/pty v1.1.11
-	github.com/opencontainers/runtime-spec v1.0.3-0.20200929063507-e6143ca7d51d
+	github.com/opencontainers/runtime-spec v1.1.0
 	github.com/rs/zerolog v1.20.0
 	github.com/stretchr/testify v1.3.0
 	github.com/urfave/cli/v2 v2.3.0
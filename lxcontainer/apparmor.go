@@ -0,0 +1,187 @@
+package lxcontainer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// DefaultApparmorProfile is the apparmor profile for containers without a profile.
+// It is loaded by the runtime if it is not loaded yet.
+const DefaultApparmorProfile = "crio-lxc-default"
+
+// ApparmorUnconfinedAnnotation must be set to "true" to run a container
+// with the apparmor profile "unconfined".
+const ApparmorUnconfinedAnnotation = "org.linuxcontainers.crio-lxc.apparmor.unconfined"
+
+const apparmorUnconfined = "unconfined"
+
+var (
+	apparmorEnabledPath  = "/sys/module/apparmor/parameters/enabled"
+	apparmorProfilesPath = "/sys/kernel/security/apparmor/profiles"
+	apparmorParser       = "apparmor_parser"
+	apparmorDir          = "/etc/apparmor.d"
+)
+
+// apparmorProfileTemplate is derived from the docker-default profile.
+var apparmorProfileTemplate = template.Must(template.New("apparmor").Parse(`{{range .Imports}}#include <{{.}}>
+{{end}}
+profile {{.Name}} flags=(attach_disconnected,mediate_deleted) {
+{{range .InnerImports}}  #include <{{.}}>
+{{end}}
+  network,
+  capability,
+  file,
+  umount,
+
+  # host (privileged) processes and the container monitor may send signals to container processes
+  signal (receive) peer=unconfined,
+  # container processes may send signals amongst themselves
+  signal (send,receive) peer={{.Name}},
+
+  # deny write for all files directly in /proc (not in a subdir)
+  deny @{PROC}/* w,
+  # deny write to files not in /proc/<number>/** or /proc/sys/**
+  deny @{PROC}/{[^1-9],[^1-9][^0-9],[^1-9s][^0-9y][^0-9s],[^1-9][^0-9][^0-9][^0-9/]*}/** w,
+  # deny /proc/sys except /proc/sys/k* (effectively /proc/sys/kernel)
+  deny @{PROC}/sys/[^k]** w,
+  # deny everything except shm* in /proc/sys/kernel/
+  deny @{PROC}/sys/kernel/{?,??,[^s][^h][^m]**} w,
+  deny @{PROC}/sysrq-trigger rwklx,
+  deny @{PROC}/kcore rwklx,
+
+  deny mount,
+
+  deny /sys/[^f]*/** wklx,
+  deny /sys/f[^s]*/** wklx,
+  deny /sys/fs/[^c]*/** wklx,
+  deny /sys/fs/c[^g]*/** wklx,
+  deny /sys/fs/cg[^r]*/** wklx,
+  deny /sys/firmware/** rwklx,
+  deny /sys/kernel/security/** rwklx,
+
+  # suppress ptrace denials when using 'ps' inside a container
+  ptrace (trace,read,tracedby,readby) peer={{.Name}},
+}
+`))
+
+type apparmorProfileData struct {
+	Name         string
+	Imports      []string
+	InnerImports []string
+}
+
+func apparmorEnabled() bool {
+	data, err := ioutil.ReadFile(apparmorEnabledPath)
+	return err == nil && strings.HasPrefix(string(data), "Y")
+}
+
+// configureApparmor sets the apparmor profile of the container.
+// The default profile is used if the spec defines no profile.
+func configureApparmor(c *Runtime, spec *specs.Spec) error {
+	profile := spec.Process.ApparmorProfile
+	if profile == apparmorUnconfined {
+		if spec.Annotations[ApparmorUnconfinedAnnotation] != "true" {
+			return fmt.Errorf("apparmor profile %q requires the annotation %s=true", profile, ApparmorUnconfinedAnnotation)
+		}
+		return c.setConfigItem("lxc.apparmor.profile", profile)
+	}
+
+	if !apparmorEnabled() {
+		if profile != "" {
+			return fmt.Errorf("apparmor profile %q is set but apparmor is not enabled", profile)
+		}
+		c.Log.Warn().Msg("apparmor is not enabled on the host")
+		return nil
+	}
+
+	if profile == "" {
+		profile = DefaultApparmorProfile
+	}
+	loaded, err := apparmorProfileLoaded(profile)
+	if err != nil {
+		return err
+	}
+	if !loaded && profile == DefaultApparmorProfile {
+		if err := loadApparmorProfile(profile); err != nil {
+			return fmt.Errorf("failed to load apparmor profile %q: %w", profile, err)
+		}
+		c.Log.Info().Str("profile", profile).Msg("loaded apparmor profile")
+		loaded, err = apparmorProfileLoaded(profile)
+		if err != nil {
+			return err
+		}
+	}
+	if !loaded {
+		return fmt.Errorf("apparmor profile %q is not loaded", profile)
+	}
+	return c.setConfigItem("lxc.apparmor.profile", profile)
+}
+
+// apparmorProfileLoaded checks whether the profile is loaded into the kernel.
+// Each line of the profiles file is the profile name followed by the profile mode, e.g `crio-lxc-default (enforce)`.
+func apparmorProfileLoaded(name string) (bool, error) {
+	// #nosec
+	f, err := os.Open(apparmorProfilesPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read loaded apparmor profiles: %w", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.LastIndex(line, " ("); i > 0 {
+			line = line[:i]
+		}
+		if line == name {
+			return true, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return false, fmt.Errorf("failed to read loaded apparmor profiles: %w", err)
+	}
+	return false, nil
+}
+
+// renderApparmorProfile renders the default profile template.
+// The apparmor abstractions are included if they are installed on the host.
+func renderApparmorProfile(name string) ([]byte, error) {
+	data := apparmorProfileData{Name: name}
+	if _, err := os.Stat(filepath.Join(apparmorDir, "tunables/global")); err == nil {
+		data.Imports = append(data.Imports, "tunables/global")
+	}
+	if _, err := os.Stat(filepath.Join(apparmorDir, "abstractions/base")); err == nil {
+		data.InnerImports = append(data.InnerImports, "abstractions/base")
+	}
+	var buf bytes.Buffer
+	if err := apparmorProfileTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadApparmorProfile renders the default profile and loads it with apparmor_parser.
+// The profile is replaced if it is already loaded (e.g by a concurrent create).
+func loadApparmorProfile(name string) error {
+	profile, err := renderApparmorProfile(name)
+	if err != nil {
+		return err
+	}
+	// #nosec
+	cmd := exec.Command(apparmorParser, "-Kr")
+	cmd.Stdin = bytes.NewReader(profile)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", apparmorParser, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package lxcontainer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeApparmor replaces the apparmor kernel interface and apparmor_parser.
+// The fake apparmor_parser adds the default profile to the loaded profiles.
+func fakeApparmor(t *testing.T, dir string, enabled string) func() {
+	enabledPath, profilesPath, parser := apparmorEnabledPath, apparmorProfilesPath, apparmorParser
+
+	apparmorEnabledPath = filepath.Join(dir, "enabled")
+	apparmorProfilesPath = filepath.Join(dir, "profiles")
+	apparmorParser = filepath.Join(dir, "apparmor_parser")
+	require.NoError(t, ioutil.WriteFile(apparmorEnabledPath, []byte(enabled), 0640))
+	require.NoError(t, ioutil.WriteFile(apparmorProfilesPath, []byte("lxc-container-default (enforce)\n"), 0640))
+	script := "#!/bin/sh\ngrep -q '^profile crio-lxc-default ' && echo 'crio-lxc-default (enforce)' >> " + apparmorProfilesPath + "\n"
+	require.NoError(t, ioutil.WriteFile(apparmorParser, []byte(script), 0750))
+
+	return func() {
+		apparmorEnabledPath, apparmorProfilesPath, apparmorParser = enabledPath, profilesPath, parser
+	}
+}
+
+func TestConfigureApparmor(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+	defer fakeApparmor(t, rt.RuntimeRoot, "Y\n")()
+
+	profile := func() string {
+		vals := c.ConfigItem("lxc.apparmor.profile")
+		require.NotEmpty(t, vals)
+		return vals[len(vals)-1]
+	}
+
+	spec := &specs.Spec{Process: &specs.Process{}}
+	loaded, err := apparmorProfileLoaded(DefaultApparmorProfile)
+	require.NoError(t, err)
+	require.False(t, loaded)
+
+	// the default profile is loaded
+	require.NoError(t, configureApparmor(rt, spec))
+	require.Equal(t, DefaultApparmorProfile, profile())
+	loaded, err = apparmorProfileLoaded(DefaultApparmorProfile)
+	require.NoError(t, err)
+	require.True(t, loaded)
+
+	spec.Process.ApparmorProfile = "lxc-container-default"
+	require.NoError(t, configureApparmor(rt, spec))
+	require.Equal(t, "lxc-container-default", profile())
+
+	spec.Process.ApparmorProfile = "foo"
+	require.Error(t, configureApparmor(rt, spec))
+
+	spec.Process.ApparmorProfile = "unconfined"
+	require.Error(t, configureApparmor(rt, spec))
+	spec.Annotations = map[string]string{ApparmorUnconfinedAnnotation: "true"}
+	require.NoError(t, configureApparmor(rt, spec))
+	require.Equal(t, "unconfined", profile())
+}
+
+func TestConfigureApparmor_disabled(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+	defer fakeApparmor(t, rt.RuntimeRoot, "N\n")()
+
+	spec := &specs.Spec{Process: &specs.Process{}}
+	require.NoError(t, configureApparmor(rt, spec))
+	require.Empty(t, c.ConfigItem("lxc.apparmor.profile"))
+
+	spec.Process.ApparmorProfile = "lxc-container-default"
+	require.Error(t, configureApparmor(rt, spec))
+}
+
+func TestRenderApparmorProfile(t *testing.T) {
+	profile, err := renderApparmorProfile("foo")
+	require.NoError(t, err)
+	require.Contains(t, string(profile), "profile foo flags=(attach_disconnected,mediate_deleted) {\n")
+	require.Contains(t, string(profile), "signal (send,receive) peer=foo,\n")
+}
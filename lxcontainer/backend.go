@@ -0,0 +1,82 @@
+package lxcontainer
+
+import (
+	"os"
+	"time"
+
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+// Backend is the container engine used by the Runtime.
+// It creates container handles and reports the engine capabilities.
+type Backend interface {
+	// NewContainer returns a handle for the container with the given name.
+	// The container config is not loaded.
+	NewContainer(name string, lxcpath string) (Container, error)
+	// Version returns the version of the container engine.
+	Version() string
+	// VersionAtLeast returns true if the engine version is >= major.minor.micro
+	VersionAtLeast(major int, minor int, micro int) bool
+	// IsSupportedConfigItem returns true if the engine supports the config item.
+	IsSupportedConfigItem(key string) bool
+}
+
+// Container is the subset of the lxc.Container API used by the Runtime.
+type Container interface {
+	Name() string
+	State() lxc.State
+	InitPid() int
+
+	Stop() error
+	// Shutdown sends the halt signal (lxc.signal.halt) to the init process
+	// and waits for the timeout until the container is stopped.
+	Shutdown(timeout time.Duration) error
+	Destroy() error
+	Release() error
+	Freeze() error
+	Unfreeze() error
+
+	ConfigItem(key string) []string
+	SetConfigItem(key string, value string) error
+	LoadConfigFile(path string) error
+	SaveConfigFile(path string) error
+
+	SetVerbosity(verbosity lxc.Verbosity)
+	SetLogLevel(level lxc.LogLevel) error
+	SetLogFile(path string) error
+
+	RunCommandStatus(args []string, opts lxc.AttachOptions) (int, error)
+	RunCommandNoWait(args []string, opts lxc.AttachOptions) (int, error)
+
+	// SeccompNotifyFdActive returns the seccomp notify fd from the monitor of the running container.
+	SeccompNotifyFdActive() (*os.File, error)
+}
+
+// LibLXC is the Backend implementation that uses liblxc through go-lxc.
+// It is the default Backend.
+type LibLXC struct{}
+
+// NewContainer implements Backend.NewContainer
+func (LibLXC) NewContainer(name string, lxcpath string) (Container, error) {
+	c, err := lxc.NewContainer(name, lxcpath)
+	if err != nil {
+		// don't return a typed nil pointer as interface
+		return nil, err
+	}
+	return c, nil
+}
+
+// Version implements Backend.Version
+func (LibLXC) Version() string {
+	return lxc.Version()
+}
+
+// VersionAtLeast implements Backend.VersionAtLeast
+func (LibLXC) VersionAtLeast(major int, minor int, micro int) bool {
+	return lxc.VersionAtLeast(major, minor, micro)
+}
+
+// IsSupportedConfigItem implements Backend.IsSupportedConfigItem
+func (LibLXC) IsSupportedConfigItem(key string) bool {
+	return lxc.IsSupportedConfigItem(key)
+}
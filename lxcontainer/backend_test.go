@@ -0,0 +1,263 @@
+package lxcontainer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+// fakeBackend is an in-memory Backend.
+// Container handles with the same name share their state,
+// like lxc.Container handles do for a running container.
+type fakeBackend struct {
+	mu         sync.Mutex
+	version    [3]int
+	containers map[string]*fakeContainer
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		version:    [3]int{4, 0, 6},
+		containers: make(map[string]*fakeContainer),
+	}
+}
+
+func (b *fakeBackend) NewContainer(name string, lxcpath string) (Container, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, exist := b.containers[name]
+	if !exist {
+		c = &fakeContainer{name: name, state: lxc.STOPPED, config: make(map[string][]string)}
+		b.containers[name] = c
+	}
+	return c, nil
+}
+
+func (b *fakeBackend) container(name string) *fakeContainer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.containers[name]
+}
+
+func (b *fakeBackend) Version() string {
+	return fmt.Sprintf("%d.%d.%d", b.version[0], b.version[1], b.version[2])
+}
+
+func (b *fakeBackend) VersionAtLeast(major int, minor int, micro int) bool {
+	want := [3]int{major, minor, micro}
+	for i := range want {
+		if b.version[i] != want[i] {
+			return b.version[i] > want[i]
+		}
+	}
+	return true
+}
+
+func (b *fakeBackend) IsSupportedConfigItem(key string) bool {
+	return strings.HasPrefix(key, "lxc.")
+}
+
+type fakeContainer struct {
+	mu      sync.Mutex
+	name    string
+	state   lxc.State
+	initPid int
+	config  map[string][]string
+
+	destroyed bool
+	released  int
+
+	execArgs   [][]string
+	execOpts   []lxc.AttachOptions
+	execStatus int
+
+	seccompNotifyFd *os.File
+}
+
+func (c *fakeContainer) Name() string {
+	return c.name
+}
+
+func (c *fakeContainer) State() lxc.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *fakeContainer) InitPid() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.initPid
+}
+
+// setInit sets the container state and the init process PID.
+func (c *fakeContainer) setInit(state lxc.State, pid int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+	c.initPid = pid
+}
+
+func (c *fakeContainer) Stop() error {
+	c.setInit(lxc.STOPPED, -1)
+	return nil
+}
+
+// Shutdown sends the halt signal to the init process.
+// The container is stopped immediately, the timeout is ignored.
+func (c *fakeContainer) Shutdown(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != lxc.RUNNING {
+		return fmt.Errorf("container %s is %s", c.name, c.state)
+	}
+	// liblxc uses SIGPWR if lxc.signal.halt is not set
+	signum := unix.SIGPWR
+	if vals := c.config["lxc.signal.halt"]; len(vals) > 0 {
+		n, err := strconv.Atoi(vals[len(vals)-1])
+		if err != nil {
+			return err
+		}
+		signum = unix.Signal(n)
+	}
+	if err := unix.Kill(c.initPid, signum); err != nil {
+		return err
+	}
+	c.state = lxc.STOPPED
+	c.initPid = -1
+	return nil
+}
+
+func (c *fakeContainer) Destroy() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != lxc.STOPPED {
+		return fmt.Errorf("container %s is %s", c.name, c.state)
+	}
+	c.destroyed = true
+	return nil
+}
+
+func (c *fakeContainer) Release() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.released++
+	return nil
+}
+
+func (c *fakeContainer) Freeze() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != lxc.RUNNING {
+		return fmt.Errorf("container %s is %s", c.name, c.state)
+	}
+	c.state = lxc.FROZEN
+	return nil
+}
+
+func (c *fakeContainer) Unfreeze() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != lxc.FROZEN {
+		return fmt.Errorf("container %s is %s", c.name, c.state)
+	}
+	c.state = lxc.RUNNING
+	return nil
+}
+
+func (c *fakeContainer) ConfigItem(key string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config[key]
+}
+
+func (c *fakeContainer) SetConfigItem(key string, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !strings.HasPrefix(key, "lxc.") {
+		return fmt.Errorf("invalid config key %q", key)
+	}
+	c.config[key] = append(c.config[key], value)
+	return nil
+}
+
+func (c *fakeContainer) LoadConfigFile(path string) error {
+	// #nosec
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	// #nosec
+	defer f.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), " = ", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid config line %q", scanner.Text())
+		}
+		c.config[kv[0]] = append(c.config[kv[0]], kv[1])
+	}
+	return scanner.Err()
+}
+
+func (c *fakeContainer) SaveConfigFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	for key, vals := range c.config {
+		for _, val := range vals {
+			fmt.Fprintf(f, "%s = %s\n", key, val)
+		}
+	}
+	c.mu.Unlock()
+	return f.Close()
+}
+
+func (c *fakeContainer) SetVerbosity(verbosity lxc.Verbosity) {}
+
+func (c *fakeContainer) SetLogLevel(level lxc.LogLevel) error {
+	return nil
+}
+
+func (c *fakeContainer) SetLogFile(path string) error {
+	return nil
+}
+
+func (c *fakeContainer) RunCommandStatus(args []string, opts lxc.AttachOptions) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != lxc.RUNNING {
+		return -1, fmt.Errorf("container %s is %s", c.name, c.state)
+	}
+	c.execArgs = append(c.execArgs, args)
+	c.execOpts = append(c.execOpts, opts)
+	return c.execStatus, nil
+}
+
+func (c *fakeContainer) RunCommandNoWait(args []string, opts lxc.AttachOptions) (int, error) {
+	if _, err := c.RunCommandStatus(args, opts); err != nil {
+		return -1, err
+	}
+	return os.Getpid(), nil
+}
+
+func (c *fakeContainer) SeccompNotifyFdActive() (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != lxc.RUNNING || c.seccompNotifyFd == nil {
+		return nil, fmt.Errorf("no seccomp notify fd for container %s", c.name)
+	}
+	return c.seccompNotifyFd, nil
+}
@@ -0,0 +1,193 @@
+package lxcontainer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+var capabilities = map[string]int{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// capSet is a set of capabilities as bitmask (see `man 7 capabilities`).
+type capSet uint64
+
+func parseCapSet(names []string) (capSet, error) {
+	var set capSet
+	for _, name := range names {
+		bit, ok := capabilities[strings.ToUpper(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown capability %q", name)
+		}
+		set |= 1 << uint(bit)
+	}
+	return set, nil
+}
+
+// names returns the sorted capability names of set.
+func (set capSet) names() []string {
+	var names []string
+	for name, bit := range capabilities {
+		if set&(1<<uint(bit)) != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// missing returns the capabilities in set that are not in other.
+func (set capSet) missing(other capSet) []string {
+	return (set &^ other).names()
+}
+
+// switchUserCaps are the capabilities crio-lxc-init requires to switch to the container user
+// and to drop them from the bounding set afterwards.
+const switchUserCaps = capSet(1<<unix.CAP_SETUID | 1<<unix.CAP_SETGID | 1<<unix.CAP_SETPCAP)
+
+// processCaps are the capability sets of the container process.
+type processCaps struct {
+	Bounding    capSet
+	Effective   capSet
+	Permitted   capSet
+	Inheritable capSet
+	Ambient     capSet
+}
+
+func parseProcessCaps(caps *specs.LinuxCapabilities) (*processCaps, error) {
+	var p processCaps
+	var err error
+	sets := []struct {
+		name  string
+		set   *capSet
+		names []string
+	}{
+		{"bounding", &p.Bounding, caps.Bounding},
+		{"effective", &p.Effective, caps.Effective},
+		{"permitted", &p.Permitted, caps.Permitted},
+		{"inheritable", &p.Inheritable, caps.Inheritable},
+		{"ambient", &p.Ambient, caps.Ambient},
+	}
+	for _, s := range sets {
+		*s.set, err = parseCapSet(s.names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s capabilities: %w", s.name, err)
+		}
+	}
+	return &p, nil
+}
+
+// validate checks the constraints that are enforced by the kernel.
+// The process would silently lose the capabilities that violate them.
+func (p *processCaps) validate() error {
+	if missing := p.Permitted.missing(p.Bounding); len(missing) > 0 {
+		return fmt.Errorf("permitted capabilities %s are not in the bounding set", missing)
+	}
+	if missing := p.Effective.missing(p.Permitted); len(missing) > 0 {
+		return fmt.Errorf("effective capabilities %s are not in the permitted set", missing)
+	}
+	if missing := p.Ambient.missing(p.Permitted & p.Inheritable); len(missing) > 0 {
+		return fmt.Errorf("ambient capabilities %s are not in the permitted and inheritable set", missing)
+	}
+	return nil
+}
+
+// configureCapabilities sets the bounding set with lxc.cap.keep.
+// The other capability sets are applied by crio-lxc-init before it executes the container process.
+// If crio-lxc-init switches the user, the bounding set must contain switchUserCaps.
+// They are dropped from the bounding set by crio-lxc-init after the switch.
+func configureCapabilities(c *Runtime, spec *specs.Spec) error {
+	if spec.Process.Capabilities == nil {
+		return c.setConfigItem("lxc.cap.keep", "none")
+	}
+	caps, err := parseProcessCaps(spec.Process.Capabilities)
+	if err != nil {
+		return err
+	}
+	if err := caps.validate(); err != nil {
+		return err
+	}
+
+	keep := caps.Bounding
+	if initSwitchesUser(c, spec) {
+		keep |= switchUserCaps
+	}
+	keepCaps := "none"
+	if keep != 0 {
+		var names []string
+		for _, name := range keep.names() {
+			names = append(names, strings.TrimPrefix(strings.ToLower(name), "cap_"))
+		}
+		keepCaps = strings.Join(names, " ")
+	}
+	if err := c.setConfigItem("lxc.cap.keep", keepCaps); err != nil {
+		return err
+	}
+
+	// The file is read by crio-lxc-init before it switches to the container user.
+	uid, gid := initUser(c, spec)
+	uid, gid = hostUser(spec, uint32(uid), uint32(gid))
+	data := fmt.Sprintf("%x %x %x %x %x\n", caps.Bounding, caps.Effective, caps.Permitted, caps.Inheritable, caps.Ambient)
+	return createInitFile(c.RuntimePath(initDir, "capabilities"), data, uid, gid, 0400)
+}
+
+// initSwitchesUser returns true if crio-lxc-init must switch to the container user.
+// liblxc clears the ambient capabilities when it switches to a non-root user,
+// so crio-lxc-init must switch the user itself (with PR_SET_KEEPCAPS) to raise them.
+func initSwitchesUser(c *Runtime, spec *specs.Spec) bool {
+	caps := spec.Process.Capabilities
+	return c.Capabilities && spec.Process.User.UID != 0 && caps != nil && len(caps.Ambient) > 0
+}
+
+// initUser returns the user liblxc executes crio-lxc-init as.
+func initUser(c *Runtime, spec *specs.Spec) (uid int, gid int) {
+	if initSwitchesUser(c, spec) {
+		return 0, 0
+	}
+	return int(spec.Process.User.UID), int(spec.Process.User.GID)
+}
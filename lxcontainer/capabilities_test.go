@@ -0,0 +1,116 @@
+package lxcontainer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcessCaps(t *testing.T) {
+	caps, err := parseProcessCaps(&specs.LinuxCapabilities{
+		Bounding:    []string{"CAP_CHOWN", "CAP_NET_BIND_SERVICE", "CAP_SYS_ADMIN"},
+		Effective:   []string{"CAP_CHOWN"},
+		Permitted:   []string{"CAP_CHOWN", "CAP_NET_BIND_SERVICE"},
+		Inheritable: []string{"cap_net_bind_service"},
+		Ambient:     []string{"CAP_NET_BIND_SERVICE"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, capSet(1<<0|1<<10|1<<21), caps.Bounding)
+	require.Equal(t, capSet(1<<0), caps.Effective)
+	require.Equal(t, capSet(1<<0|1<<10), caps.Permitted)
+	require.Equal(t, capSet(1<<10), caps.Inheritable)
+	require.Equal(t, capSet(1<<10), caps.Ambient)
+	require.NoError(t, caps.validate())
+
+	_, err = parseProcessCaps(&specs.LinuxCapabilities{Bounding: []string{"CAP_FOO"}})
+	require.Error(t, err)
+}
+
+func TestProcessCapsValidate(t *testing.T) {
+	caps := &processCaps{Bounding: 1, Permitted: 3}
+	require.EqualError(t, caps.validate(), "permitted capabilities [CAP_DAC_OVERRIDE] are not in the bounding set")
+
+	caps = &processCaps{Bounding: 3, Permitted: 1, Effective: 2}
+	require.EqualError(t, caps.validate(), "effective capabilities [CAP_DAC_OVERRIDE] are not in the permitted set")
+
+	caps = &processCaps{Bounding: 3, Permitted: 3, Inheritable: 1, Ambient: 3}
+	require.EqualError(t, caps.validate(), "ambient capabilities [CAP_DAC_OVERRIDE] are not in the permitted and inheritable set")
+}
+
+func TestConfigureCapabilities(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+
+	spec := &specs.Spec{Process: &specs.Process{
+		User: specs.User{UID: uint32(os.Getuid()), GID: uint32(os.Getgid())},
+		Capabilities: &specs.LinuxCapabilities{
+			Bounding:  []string{"CAP_CHOWN", "CAP_NET_BIND_SERVICE"},
+			Effective: []string{"CAP_CHOWN"},
+			Permitted: []string{"CAP_CHOWN", "CAP_NET_BIND_SERVICE"},
+		},
+	}}
+	require.NoError(t, configureCapabilities(rt, spec))
+	require.Equal(t, []string{"chown net_bind_service"}, c.ConfigItem("lxc.cap.keep"))
+	data, err := ioutil.ReadFile(rt.RuntimePath(initDir, "capabilities"))
+	require.NoError(t, err)
+	require.Equal(t, "401 1 401 0 0\n", string(data))
+
+	spec.Process.Capabilities.Effective = []string{"CAP_SYS_ADMIN"}
+	require.Error(t, configureCapabilities(rt, spec))
+}
+
+func TestConfigureCapabilities_ambientNonRoot(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+
+	// drop ALL and add NET_BIND_SERVICE as ambient capability for a non-root user
+	bind := []string{"CAP_NET_BIND_SERVICE"}
+	spec := &specs.Spec{Process: &specs.Process{
+		User: specs.User{UID: 1000, GID: 1000},
+		Capabilities: &specs.LinuxCapabilities{
+			Bounding: bind, Effective: bind, Permitted: bind, Inheritable: bind, Ambient: bind,
+		},
+	}}
+	require.True(t, initSwitchesUser(rt, spec))
+	require.NoError(t, configureCapabilities(rt, spec))
+	// crio-lxc-init switches the user and drops setuid, setgid and setpcap afterwards
+	require.Equal(t, []string{"net_bind_service setgid setpcap setuid"}, c.ConfigItem("lxc.cap.keep"))
+	data, err := ioutil.ReadFile(rt.RuntimePath(initDir, "capabilities"))
+	require.NoError(t, err)
+	require.Equal(t, "400 400 400 400 400\n", string(data))
+}
+
+func TestInitSwitchesUser(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+
+	spec := &specs.Spec{Process: &specs.Process{
+		User:         specs.User{UID: 1000, GID: 1000},
+		Capabilities: &specs.LinuxCapabilities{},
+	}}
+	require.False(t, initSwitchesUser(rt, spec))
+	uid, gid := initUser(rt, spec)
+	require.Equal(t, 1000, uid)
+	require.Equal(t, 1000, gid)
+
+	// liblxc clears the ambient capabilities of a non-root user
+	spec.Process.Capabilities.Ambient = []string{"CAP_NET_BIND_SERVICE"}
+	require.True(t, initSwitchesUser(rt, spec))
+	uid, gid = initUser(rt, spec)
+	require.Equal(t, 0, uid)
+	require.Equal(t, 0, gid)
+
+	rt.Capabilities = false
+	require.False(t, initSwitchesUser(rt, spec))
+
+	rt.Capabilities = true
+	spec.Process.User.UID = 0
+	require.False(t, initSwitchesUser(rt, spec))
+}
@@ -258,6 +258,30 @@ func killCgroupProcs(cgroupName string, sig unix.Signal) error {
 	return nil
 }
 
+// cgroupProcs returns the PIDs of all processes in the cgroup and its child cgroups.
+func cgroupProcs(cgroupName string) ([]int, error) {
+	cg, err := loadCgroup(cgroupName)
+	if err != nil {
+		return nil, err
+	}
+	procs := cg.Procs
+	dirName := filepath.Join(cgroupRoot, cgroupName)
+	entries, err := ioutil.ReadDir(dirName)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range entries {
+		if i.IsDir() {
+			pids, err := cgroupProcs(filepath.Join(cgroupName, i.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("failed to load cgroup %s: %w", i.Name(), err)
+			}
+			procs = append(procs, pids...)
+		}
+	}
+	return procs, nil
+}
+
 // TODO maybe use polling instead
 // fds := []unix.PollFd{{Fd: int32(f.Fd()), Events: unix.POLLIN}}
 // n, err := unix.Poll(fds, timeout)
@@ -329,14 +353,16 @@ func deleteCgroup(cgroupName string) error {
 	return unix.Rmdir(dirName)
 }
 
-func createCgroup(cg string, controllers string) error {
+// createCgroup creates the cgroup cg below the cgroup parent and enables the controllers
+// in each cgroup from parent (exclusive) down to cg.
+func createCgroup(parent string, cg string, controllers string) error {
+	base := filepath.Join(cgroupRoot, parent)
 	// #nosec
-	cgPath := filepath.Join(cgroupRoot, cg)
+	cgPath := filepath.Join(base, cg)
 	if err := os.MkdirAll(cgPath, 755); err != nil {
 		return err
 	}
 
-	base := cgroupRoot
 	for _, elem := range strings.Split(cg, "/") {
 		base = filepath.Join(base, elem)
 		c := filepath.Join(base, "cgroup.subtree_control")
@@ -350,7 +376,7 @@ func createCgroup(cg string, controllers string) error {
 
 func getControllers(cg string) (string, error) {
 	// enable all available controllers in the scope
-	data, err := ioutil.ReadFile(filepath.Join(cgroupRoot, cg, "group.controllers"))
+	data, err := ioutil.ReadFile(filepath.Join(cgroupRoot, cg, "cgroup.controllers"))
 	if err != nil {
 		return "", fmt.Errorf("failed to read cgroup.controllers: %w", err)
 	}
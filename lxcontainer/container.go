@@ -1,6 +1,9 @@
 package lxcontainer
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -11,34 +14,52 @@ import (
 	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
+// ContainerInfoVersion is the schema version of the serialized ContainerInfo.
+// It must be incremented and a migration must be added to containerInfoMigrations
+// if the schema changes. New optional (omitempty) fields do not change the schema.
+const ContainerInfoVersion = 2
+
+// ErrUnsupportedVersion is returned by ContainerInfo.Load if the schema version
+// of the serialized ContainerInfo is newer than ContainerInfoVersion.
+var ErrUnsupportedVersion = errors.New("unsupported container info version")
+
 // ContainerInfo holds the information about a single container.
 // It is created at 'create' within the container runtime dir and not changed afterwards.
 // It is removed when the container is deleted.
 type ContainerInfo struct {
-	ContainerID string
-	CreatedAt   time.Time
-	RuntimeRoot string
+	// Version is the schema version of the serialized ContainerInfo.
+	Version int `json:"version"`
 
-	BundlePath    string
-	ConsoleSocket string `json;",omitempty"`
+	ContainerID string    `json:"containerID"`
+	CreatedAt   time.Time `json:"createdAt"`
+	RuntimeRoot string    `json:"runtimeRoot"`
+
+	BundlePath    string `json:"bundlePath"`
+	ConsoleSocket string `json:"consoleSocket,omitempty"`
 	// PidFile is the absolute path to the PID file of the container monitor process (crio-lxc-start)
-	PidFile          string
-	MonitorCgroupDir string
+	PidFile          string `json:"pidFile"`
+	MonitorCgroupDir string `json:"monitorCgroupDir"`
 
 	// values derived from spec
-	CgroupDir string
+	CgroupDir string `json:"cgroupDir"`
+	// RootfsOverlay is the tmpfs mountpoint of the rootfs overlay (see RootfsOverlayAnnotation).
+	RootfsOverlay string `json:"rootfsOverlay,omitempty"`
+	// Sandbox is set for a pod sandbox without a container process.
+	// The namespaces of the pod sandbox are pinned within the runtime directory.
+	Sandbox bool `json:"sandbox,omitempty"`
 
 	// feature gates
-	Seccomp       bool
-	Capabilities  bool
-	Apparmor      bool
-	CgroupDevices bool
+	Seccomp       bool `json:"seccomp"`
+	Capabilities  bool `json:"capabilities"`
+	Apparmor      bool `json:"apparmor"`
+	CgroupDevices bool `json:"cgroupDevices"`
+	Selinux       bool `json:"selinux"`
 
 	// values duplicated from bundle.json
 	// annotations are required for 'state'
-	Annotations map[string]string `json:",omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
 	// namespaces are required for 'exec'
-	Namespaces []specs.LinuxNamespace `json:",omitempty"`
+	Namespaces []specs.LinuxNamespace `json:"namespaces,omitempty"`
 }
 
 // RuntimePath returns the absolute path witin the container root
@@ -71,23 +92,118 @@ func (c ContainerInfo) CreatePidFile(pid int) error {
 	return CreatePidFile(c.PidFile, pid)
 }
 
+// Load loads the ContainerInfo from the container runtime directory.
+// ContainerInfo serialized with an older schema version is migrated
+// to the current schema version. The file itself is not modified.
 // RuntimeRoot and ContainerID must be set
 func (c *ContainerInfo) Load() error {
-	return decodeFileJSON(c, c.RuntimePath("container.json"))
+	p := c.RuntimePath("container.json")
+	// #nosec
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	data, err = migrateContainerInfo(data)
+	if err != nil {
+		return fmt.Errorf("failed to migrate %s: %w", p, err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("failed to decode JSON from %s: %w", p, err)
+	}
+	return nil
 }
 
+// Create writes the ContainerInfo to the container runtime directory.
 func (c *ContainerInfo) Create() error {
 	p := c.RuntimePath("container.json")
+	c.Version = ContainerInfoVersion
 	c.CreatedAt = time.Now()
 	return encodeFileJSON(p, c, os.O_EXCL|os.O_CREATE|os.O_RDWR, 0640)
 }
 
+// containerInfoMigrations[n] migrates serialized ContainerInfo
+// from schema version n to schema version n+1
+var containerInfoMigrations = []func(map[string]json.RawMessage) error{
+	migrateContainerInfoV0,
+	migrateContainerInfoV1,
+}
+
+// migrateContainerInfo migrates the serialized ContainerInfo in data
+// to the current schema version.
+func migrateContainerInfo(data []byte) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+
+	// ContainerInfo version 0 has no version field.
+	version := 0
+	if v, exist := obj["version"]; exist {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return nil, fmt.Errorf("invalid version: %w", err)
+		}
+	}
+
+	if version == ContainerInfoVersion {
+		return data, nil
+	}
+	if version < 0 || version > ContainerInfoVersion {
+		return nil, fmt.Errorf("%w %d (supported versions <= %d)", ErrUnsupportedVersion, version, ContainerInfoVersion)
+	}
+
+	for ; version < ContainerInfoVersion; version++ {
+		if err := containerInfoMigrations[version](obj); err != nil {
+			return nil, fmt.Errorf("migration from version %d failed: %w", version, err)
+		}
+		obj["version"] = json.RawMessage(strconv.Itoa(version + 1))
+	}
+	return json.Marshal(obj)
+}
+
+// migrateContainerInfoV0 renames the keys of version 0.
+// Version 0 has no JSON struct tags and uses the struct field names as keys.
+func migrateContainerInfoV0(obj map[string]json.RawMessage) error {
+	renamed := make(map[string]json.RawMessage, len(obj))
+	for key, val := range obj {
+		if key == "" {
+			return fmt.Errorf("empty key")
+		}
+		newKey := strings.ToLower(key[:1]) + key[1:]
+		if _, exist := renamed[newKey]; exist {
+			return fmt.Errorf("duplicate key %q", newKey)
+		}
+		renamed[newKey] = val
+	}
+	for key := range obj {
+		delete(obj, key)
+	}
+	for key, val := range renamed {
+		obj[key] = val
+	}
+	return nil
+}
+
+// migrateContainerInfoV1 adds the selinux feature gate.
+// The selinux labels of containers created by version 1 are not set,
+// so the label must not be applied to exec processes either.
+func migrateContainerInfoV1(obj map[string]json.RawMessage) error {
+	obj["selinux"] = json.RawMessage("false")
+	return nil
+}
+
 func (c ContainerInfo) SpecPath() string {
 	return filepath.Join(c.BundlePath, "config.json")
 }
 
+// ReadSpec reads the container spec from the bundle.
+// A relative root path is resolved relative to the bundle directory (e.g containerd uses "rootfs").
 func (c *ContainerInfo) ReadSpec() (*specs.Spec, error) {
 	spec := new(specs.Spec)
-	err := decodeFileJSON(spec, c.SpecPath())
-	return spec, err
+	if err := decodeFileJSON(spec, c.SpecPath()); err != nil {
+		return spec, err
+	}
+	if spec.Root != nil && !filepath.IsAbs(spec.Root.Path) {
+		spec.Root.Path = filepath.Join(c.BundlePath, spec.Root.Path)
+	}
+	return spec, nil
 }
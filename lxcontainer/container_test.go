@@ -0,0 +1,110 @@
+package lxcontainer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestContainerInfo(t *testing.T) ContainerInfo {
+	root, err := ioutil.TempDir("", "crio-lxc-test")
+	require.NoError(t, err)
+	c := ContainerInfo{ContainerID: "testcontainer", RuntimeRoot: root}
+	require.NoError(t, os.MkdirAll(c.RuntimePath(), 0700))
+	return c
+}
+
+func TestContainerInfoCreateLoad(t *testing.T) {
+	c := newTestContainerInfo(t)
+	defer os.RemoveAll(c.RuntimeRoot)
+
+	c.BundlePath = "/bundle"
+	c.CgroupDir = "kubepods.slice/crio-1.scope"
+	c.Seccomp = true
+	c.Annotations = map[string]string{"foo": "bar"}
+	c.Namespaces = []specs.LinuxNamespace{{Type: specs.PIDNamespace}}
+	require.NoError(t, c.Create())
+	require.Equal(t, ContainerInfoVersion, c.Version)
+
+	loaded := ContainerInfo{ContainerID: c.ContainerID, RuntimeRoot: c.RuntimeRoot}
+	require.NoError(t, loaded.Load())
+	require.True(t, c.CreatedAt.Equal(loaded.CreatedAt))
+	loaded.CreatedAt = c.CreatedAt
+	require.Equal(t, c, loaded)
+}
+
+func TestContainerInfoLoad_v0(t *testing.T) {
+	c := newTestContainerInfo(t)
+	defer os.RemoveAll(c.RuntimeRoot)
+
+	// container.json written by a crio-lxc version without schema version
+	v0 := `{"ContainerID":"testcontainer","CreatedAt":"2020-11-20T10:00:00Z","RuntimeRoot":"` + c.RuntimeRoot + `",` +
+		`"BundlePath":"/bundle","ConsoleSocket":"","PidFile":"/run/test.pid","MonitorCgroupDir":"crio-lxc-monitor.slice/testcontainer.scope",` +
+		`"CgroupDir":"kubepods.slice/crio-1.scope","Seccomp":true,"Capabilities":true,"Apparmor":false,"CgroupDevices":true,` +
+		`"Annotations":{"foo":"bar"},"Namespaces":[{"type":"pid"},{"type":"network","path":"/proc/1/ns/net"}]}`
+	require.NoError(t, ioutil.WriteFile(c.RuntimePath("container.json"), []byte(v0), 0640))
+
+	require.NoError(t, c.Load())
+	require.Equal(t, ContainerInfoVersion, c.Version)
+	require.Equal(t, "/bundle", c.BundlePath)
+	require.Equal(t, "/run/test.pid", c.PidFile)
+	require.Equal(t, "crio-lxc-monitor.slice/testcontainer.scope", c.MonitorCgroupDir)
+	require.Equal(t, "kubepods.slice/crio-1.scope", c.CgroupDir)
+	require.True(t, c.Seccomp)
+	require.True(t, c.Capabilities)
+	require.False(t, c.Apparmor)
+	require.True(t, c.CgroupDevices)
+	require.Equal(t, map[string]string{"foo": "bar"}, c.Annotations)
+	require.Equal(t, []specs.LinuxNamespace{{Type: specs.PIDNamespace}, {Type: specs.NetworkNamespace, Path: "/proc/1/ns/net"}}, c.Namespaces)
+	require.Equal(t, 2020, c.CreatedAt.Year())
+}
+
+func TestContainerInfoLoad_v1(t *testing.T) {
+	c := newTestContainerInfo(t)
+	defer os.RemoveAll(c.RuntimeRoot)
+	c.Selinux = true
+
+	v1 := `{"version":1,"containerID":"testcontainer","runtimeRoot":"` + c.RuntimeRoot + `","apparmor":true}`
+	require.NoError(t, ioutil.WriteFile(c.RuntimePath("container.json"), []byte(v1), 0640))
+
+	require.NoError(t, c.Load())
+	require.Equal(t, ContainerInfoVersion, c.Version)
+	require.True(t, c.Apparmor)
+	require.False(t, c.Selinux)
+}
+
+func TestContainerInfoLoad_v2(t *testing.T) {
+	c := newTestContainerInfo(t)
+	defer os.RemoveAll(c.RuntimeRoot)
+
+	v2 := `{"version":2,"containerID":"testcontainer","runtimeRoot":"` + c.RuntimeRoot + `","selinux":true}`
+	require.NoError(t, ioutil.WriteFile(c.RuntimePath("container.json"), []byte(v2), 0640))
+
+	require.NoError(t, c.Load())
+	require.Equal(t, ContainerInfoVersion, c.Version)
+	require.True(t, c.Selinux)
+	// optional fields
+	require.Empty(t, c.RootfsOverlay)
+	require.False(t, c.Sandbox)
+}
+
+func TestContainerInfoLoad_unsupportedVersion(t *testing.T) {
+	c := newTestContainerInfo(t)
+	defer os.RemoveAll(c.RuntimeRoot)
+
+	future := `{"version":999,"containerID":"testcontainer"}`
+	require.NoError(t, ioutil.WriteFile(c.RuntimePath("container.json"), []byte(future), 0640))
+
+	err := c.Load()
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrUnsupportedVersion))
+}
+
+func TestMigrateContainerInfoV0_duplicateKey(t *testing.T) {
+	_, err := migrateContainerInfo([]byte(`{"PidFile":"/a","pidFile":"/b"}`))
+	require.Error(t, err)
+}
@@ -13,14 +13,62 @@ import (
 
 	"github.com/creack/pty"
 	"github.com/opencontainers/runtime-spec/specs-go"
-	"gopkg.in/lxc/go-lxc.v2"
 )
 
-func (c *Runtime) Create(ctx context.Context) error {
+// CreateOptions are the per container options for Runtime.Create
+type CreateOptions struct {
+	// BundlePath is the path to the OCI bundle directory.
+	BundlePath string
+	// ConsoleSocket is the path to a unix socket.
+	// If set the master fd of the container pty is sent to it.
+	ConsoleSocket string
+	// PidFile is the path to the file the container process PID is written to.
+	PidFile string
+	// Stdio is the stdio of the container process.
+	// It is ignored if ConsoleSocket is set or the container process has a terminal.
+	Stdio Stdio
+}
+
+// Stdio are the standard streams of a container process.
+// The stream of the calling process is inherited for each unset stream.
+type Stdio struct {
+	Stdin  *os.File
+	Stdout *os.File
+	Stderr *os.File
+}
+
+func (s Stdio) stdin() *os.File {
+	if s.Stdin == nil {
+		return os.Stdin
+	}
+	return s.Stdin
+}
+
+func (s Stdio) stdout() *os.File {
+	if s.Stdout == nil {
+		return os.Stdout
+	}
+	return s.Stdout
+}
+
+func (s Stdio) stderr() *os.File {
+	if s.Stderr == nil {
+		return os.Stderr
+	}
+	return s.Stderr
+}
+
+// Create creates a container from the OCI bundle in opts.BundlePath.
+// It returns when the container init process is waiting for Start.
+func (c *Runtime) Create(ctx context.Context, opts CreateOptions) error {
 	if c.runtimePathExists() {
 		return ErrExist
 	}
 
+	c.BundlePath = opts.BundlePath
+	c.ConsoleSocket = opts.ConsoleSocket
+	c.PidFile = opts.PidFile
+
 	err := canExecute(c.StartCommand, c.ContainerHook, c.InitCommand)
 	if err != nil {
 		return errorf("access check failed: %w", err)
@@ -33,12 +81,12 @@ func (c *Runtime) Create(ctx context.Context) error {
 		return errorf("ccgroup2 not mounted on %s: %w", cgroupRoot, err)
 	}
 
-	if !lxc.VersionAtLeast(3, 1, 0) {
-		return errorf("liblxc runtime version is %s, but >= 3.1.0 is required", lxc.Version())
+	if !c.backend().VersionAtLeast(3, 1, 0) {
+		return errorf("liblxc runtime version is %s, but >= 3.1.0 is required", c.backend().Version())
 	}
 
-	if !lxc.VersionAtLeast(4, 0, 5) {
-		c.Log.Warn().Msgf("liblxc runtime version >= 4.0.5 is recommended (was %s)", lxc.Version())
+	if !c.backend().VersionAtLeast(4, 0, 5) {
+		c.Log.Warn().Msgf("liblxc runtime version >= 4.0.5 is recommended (was %s)", c.backend().Version())
 	}
 
 	spec, err := c.ReadSpec()
@@ -46,6 +94,27 @@ func (c *Runtime) Create(ctx context.Context) error {
 		return errorf("failed to load container spec from bundle: %w", err)
 	}
 
+	if err := validateSpec(spec); err != nil {
+		return errorf("invalid container spec: %w", err)
+	}
+
+	if isPodSandbox(spec) {
+		if err := c.canPinNamespaces(spec); err != nil {
+			c.Log.Info().Err(err).Msg("pod sandbox requires a container process")
+		} else {
+			c.Log.Info().Msg("create pod sandbox without container process")
+			if err := c.createSandbox(spec); err != nil {
+				return errorf("failed to create pod sandbox: %w", err)
+			}
+			return nil
+		}
+	}
+
+	// The cgroup namespace added for a system container must be stored by createContainer.
+	if err := configureSystemContainer(c, spec); err != nil {
+		return errorf("failed to configure system container: %w", err)
+	}
+
 	err = c.createContainer(spec)
 	if err != nil {
 		return errorf("failed to create container: %w", err)
@@ -55,27 +124,27 @@ func (c *Runtime) Create(ctx context.Context) error {
 		return errorf("failed to configure container: %w", err)
 	}
 
-	if err := c.runStartCmd(ctx, spec); err != nil {
+	if err := c.runStartCmd(ctx, spec, opts.Stdio); err != nil {
 		return errorf("failed to run container process: %w", err)
 	}
 	return nil
 }
 
-func (c *Runtime) runStartCmd(ctx context.Context, spec *specs.Spec) (err error) {
+func (c *Runtime) runStartCmd(ctx context.Context, spec *specs.Spec, stdio Stdio) (err error) {
 	// #nosec
 	cmd := exec.Command(c.StartCommand, c.Container.Name(), c.RuntimeRoot, c.ConfigFilePath())
 	cmd.Env = []string{}
 	cmd.Dir = c.RuntimePath()
 
 	if c.ConsoleSocket == "" && !spec.Process.Terminal {
-		// Inherit stdio from calling process (conmon).
+		// Inherit stdio from calling process (conmon) if not set.
 		// lxc.console.path must be set to 'none' or stdio of init process is replaced with a PTY by lxc
 		if err := c.setConfigItem("lxc.console.path", "none"); err != nil {
 			return err
 		}
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		cmd.Stdin = stdio.stdin()
+		cmd.Stdout = stdio.stdout()
+		cmd.Stderr = stdio.stderr()
 	}
 
 	if err := c.saveConfig(); err != nil {
@@ -96,6 +165,7 @@ func (c *Runtime) runStartCmd(ctx context.Context, spec *specs.Spec) (err error)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	c.monitorExited = make(chan struct{})
 	go func() {
 		// NOTE this goroutine may leak until crio-lxc is terminated
 		ps, err := cmd.Process.Wait()
@@ -104,9 +174,20 @@ func (c *Runtime) runStartCmd(ctx context.Context, spec *specs.Spec) (err error)
 		} else {
 			c.Log.Warn().Int("pid", cmd.Process.Pid).Stringer("status", ps).Msg("start process terminated")
 		}
+		c.monitorState = ps
+		close(c.monitorExited)
 		cancel()
 	}()
 
+	// The notify fd must be passed before waiting for init,
+	// because the syscalls of init may already be intercepted.
+	if listenerPath := c.seccompListenerPath(spec); listenerPath != "" {
+		c.Log.Debug().Str("file", listenerPath).Msg("sending seccomp notify fd")
+		if err := c.sendSeccompNotifyFd(ctx, listenerPath, spec.Linux.Seccomp.ListenerMetadata); err != nil {
+			return fmt.Errorf("failed to send seccomp notify fd: %w", err)
+		}
+	}
+
 	c.Log.Debug().Msg("waiting for init")
 	if err := c.waitCreated(ctx); err != nil {
 		return err
@@ -150,6 +231,14 @@ func configureContainer(c *Runtime, spec *specs.Spec) error {
 		return fmt.Errorf("failed to configure namespaces: %w", err)
 	}
 
+	if err := configureTimeOffsets(c, spec); err != nil {
+		return fmt.Errorf("failed to configure time offsets: %w", err)
+	}
+
+	if err := configureHaltSignal(c, spec); err != nil {
+		return err
+	}
+
 	if spec.Process.OOMScoreAdj != nil {
 		if err := c.setConfigItem("lxc.proc.oom_score_adj", fmt.Sprintf("%d", *spec.Process.OOMScoreAdj)); err != nil {
 			return err
@@ -170,16 +259,27 @@ func configureContainer(c *Runtime, spec *specs.Spec) error {
 		c.Log.Warn().Msg("apparmor is disabled (unconfined)")
 	}
 
+	if c.Selinux {
+		if err := configureSelinux(c, spec); err != nil {
+			return fmt.Errorf("failed to configure selinux: %w", err)
+		}
+	} else {
+		c.Log.Warn().Msg("selinux is disabled")
+	}
+
 	if c.Seccomp {
 		if spec.Linux.Seccomp == nil || len(spec.Linux.Seccomp.Syscalls) == 0 {
 		} else {
 			profilePath := c.RuntimePath("seccomp.conf")
-			if err := writeSeccompProfile(profilePath, spec.Linux.Seccomp); err != nil {
+			if err := c.createSeccompProfile(profilePath, spec.Linux.Seccomp); err != nil {
 				return err
 			}
 			if err := c.setConfigItem("lxc.seccomp.profile", profilePath); err != nil {
 				return err
 			}
+			if err := configureSeccompNotify(c, spec.Linux.Seccomp); err != nil {
+				return err
+			}
 		}
 	} else {
 		c.Log.Warn().Msg("seccomp is disabled")
@@ -278,39 +378,16 @@ func configureReadonlyPaths(c *Runtime, spec *specs.Spec) error {
 		return fmt.Errorf("lxc.rootfs.mount unavailable")
 	}
 	for _, p := range spec.Linux.ReadonlyPaths {
-		mnt := fmt.Sprintf("%s %s %s %s", filepath.Join(rootmnt, p), strings.TrimPrefix(p, "/"), "bind", "bind,ro,optional")
+		mnt := fmt.Sprintf("%s %s %s %s", filepath.Join(rootmnt, p), strings.TrimPrefix(p, "/"), "bind", "rbind,ro,optional")
 		if err := c.setConfigItem("lxc.mount.entry", mnt); err != nil {
 			return fmt.Errorf("failed to make path readonly: %w", err)
 		}
-	}
-	return nil
-}
-
-func configureApparmor(c *Runtime, spec *specs.Spec) error {
-	// The value *apparmor_profile*  from crio.conf is used if no profile is defined by the container.
-	aaprofile := spec.Process.ApparmorProfile
-	if aaprofile == "" {
-		aaprofile = "unconfined"
-	}
-	return c.setConfigItem("lxc.apparmor.profile", aaprofile)
-}
-
-// configureCapabilities configures the linux capabilities / privileges granted to the container processes.
-// See `man lxc.container.conf` lxc.cap.drop and lxc.cap.keep for details.
-// https://blog.container-solutions.com/linux-capabilities-in-practice
-// https://blog.container-solutions.com/linux-capabilities-why-they-exist-and-how-they-work
-func configureCapabilities(c *Runtime, spec *specs.Spec) error {
-	keepCaps := "none"
-	if spec.Process.Capabilities != nil {
-		var caps []string
-		for _, c := range spec.Process.Capabilities.Permitted {
-			lcCapName := strings.TrimPrefix(strings.ToLower(c), "cap_")
-			caps = append(caps, lcCapName)
+		// liblxc only remounts the top mount readonly.
+		if err := appendMountAttr(c.RuntimePath(mountAttrsFile), p, mountAttr{Set: mountAttrRdonly}, true); err != nil {
+			return fmt.Errorf("failed to make path readonly: %w", err)
 		}
-		keepCaps = strings.Join(caps, " ")
 	}
-
-	return c.setConfigItem("lxc.cap.keep", keepCaps)
+	return nil
 }
 
 func isDeviceEnabled(spec *specs.Spec, dev specs.LinuxDevice) bool {
@@ -0,0 +1,22 @@
+// Package lxcontainer implements the OCI runtime commands on top of liblxc.
+//
+// A Runtime manages a single container and is created with NewRuntime.
+// Runtime settings are set with options, all other settings have a default value:
+//
+//	rt, err := lxcontainer.NewRuntime(containerID,
+//		lxcontainer.WithRuntimeRoot("/run/crio-lxc"),
+//		lxcontainer.WithLogger(log),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	defer rt.Release()
+//	err = rt.Create(ctx, lxcontainer.CreateOptions{BundlePath: bundle, PidFile: pidFile})
+//
+// The package does not modify any global state (e.g the zerolog global settings).
+// All runtime log output is written to the logger set with WithLogger.
+//
+// The container state returned by Runtime.State is the versioned OCI state (specs.State).
+// The ContainerInfo of a container is written to the runtime directory of the container
+// at create and read by all other runtime commands.
+package lxcontainer
@@ -0,0 +1,221 @@
+package lxcontainer
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// execHelper is the path to crio-lxc-init within the container.
+// The exec process settings that can not be set with lxc.AttachOptions
+// are applied by crio-lxc-init (--exec) before it executes the command.
+const execHelper = initDir + "/init"
+
+var rlimits = map[string]int{
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+}
+
+// see `man 2 ioprio_set`
+var ioprioClasses = map[specs.IOPriorityClass]int{
+	specs.IOPRIO_CLASS_RT:   1,
+	specs.IOPRIO_CLASS_BE:   2,
+	specs.IOPRIO_CLASS_IDLE: 3,
+}
+
+const ioprioClassShift = 13
+
+// execCommand returns the command that runs args with the settings from proc.
+// The command is args itself if all settings are applied by liblxc.
+// Otherwise args are executed by the exec helper. If switchUser is true,
+// the helper switches to the user from proc, so the command must be attached as root.
+// Otherwise liblxc attaches the helper as the user from proc.
+func (c *Runtime) execCommand(args []string, proc *specs.Process) (cmd []string, helper bool, switchUser bool, err error) {
+	if proc == nil {
+		return args, false, false, nil
+	}
+	opts, switchUser, err := c.execHelperOptions(proc)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if len(opts) == 0 {
+		return args, false, false, nil
+	}
+
+	cmd = []string{execHelper, "--exec"}
+	if switchUser {
+		u := proc.User
+		user := fmt.Sprintf("%d:%d", u.UID, u.GID)
+		if len(u.AdditionalGids) > 0 {
+			gids := make([]string, len(u.AdditionalGids))
+			for i, gid := range u.AdditionalGids {
+				gids[i] = fmt.Sprintf("%d", gid)
+			}
+			user += ":" + strings.Join(gids, ",")
+		}
+		cmd = append(cmd, "-u", user)
+	}
+	cmd = append(cmd, opts...)
+	cmd = append(cmd, "--")
+	return append(cmd, args...), true, switchUser, nil
+}
+
+// execHelperOptions returns the exec helper options for the process settings
+// that are not applied by liblxc (see `crio-lxc-init --exec`),
+// and whether the helper must switch to the process user.
+// An error is returned for settings that can not be applied.
+func (c *Runtime) execHelperOptions(proc *specs.Process) (opts []string, switchUser bool, err error) {
+	if proc.CommandLine != "" {
+		return nil, false, fmt.Errorf("commandLine is not supported")
+	}
+	if proc.Scheduler != nil {
+		return nil, false, fmt.Errorf("scheduler is not supported")
+	}
+
+	if c.Capabilities {
+		var capsOpt string
+		capsOpt, switchUser, err = c.execCapabilities(proc)
+		if err != nil {
+			return nil, false, err
+		}
+		if capsOpt != "" {
+			opts = append(opts, "-c", capsOpt)
+		}
+	}
+
+	seen := make(map[int]bool, len(proc.Rlimits))
+	for _, limit := range proc.Rlimits {
+		resource, ok := rlimits[strings.ToUpper(limit.Type)]
+		if !ok {
+			return nil, false, fmt.Errorf("unknown resource limit %q", limit.Type)
+		}
+		if seen[resource] {
+			return nil, false, fmt.Errorf("duplicate resource limit %q", limit.Type)
+		}
+		seen[resource] = true
+		opts = append(opts, "-r", fmt.Sprintf("%d:%d:%d", resource, limit.Soft, limit.Hard))
+	}
+
+	if proc.OOMScoreAdj != nil {
+		opts = append(opts, "-o", fmt.Sprintf("%d", *proc.OOMScoreAdj))
+	}
+
+	if proc.User.Umask != nil {
+		opts = append(opts, "-m", fmt.Sprintf("%o", *proc.User.Umask))
+	}
+
+	if prio := proc.IOPriority; prio != nil {
+		class, ok := ioprioClasses[prio.Class]
+		if !ok {
+			return nil, false, fmt.Errorf("invalid io priority class %q", prio.Class)
+		}
+		if prio.Priority < 0 || prio.Priority > 7 {
+			return nil, false, fmt.Errorf("invalid io priority %d", prio.Priority)
+		}
+		opts = append(opts, "-i", fmt.Sprintf("%d", class<<ioprioClassShift|prio.Priority))
+	}
+
+	if proc.ApparmorProfile != "" && c.Apparmor {
+		// The container profile is applied by liblxc.
+		if proc.ApparmorProfile != c.getConfigItem("lxc.apparmor.profile") {
+			if !apparmorEnabled() {
+				return nil, false, fmt.Errorf("apparmor profile %q is set but apparmor is not enabled", proc.ApparmorProfile)
+			}
+			opts = append(opts, "-a", proc.ApparmorProfile)
+		}
+	}
+
+	if proc.SelinuxLabel != "" && c.Selinux {
+		// The container label is applied by liblxc.
+		if proc.SelinuxLabel != c.getConfigItem("lxc.selinux.context") {
+			if !selinuxEnabled() {
+				return nil, false, fmt.Errorf("selinux label %q is set but selinux is not enabled", proc.SelinuxLabel)
+			}
+			opts = append(opts, "-l", proc.SelinuxLabel)
+		}
+	}
+
+	if proc.NoNewPrivileges {
+		opts = append(opts, "-n")
+	}
+	return opts, switchUser, nil
+}
+
+// execCapabilities returns the exec helper option for the capability sets of proc,
+// or an empty string if liblxc attaches the process with the same capability sets.
+// A process attached by liblxc has the bounding set of the container (lxc.cap.keep).
+// Like with any process executed by root, the permitted and effective set of root
+// is the bounding set. A non-root process has no capabilities.
+//
+// The helper requires CAP_SETPCAP to drop capabilities from the bounding set,
+// and CAP_SETUID and CAP_SETGID to switch to a non-root user with capabilities.
+func (c *Runtime) execCapabilities(proc *specs.Process) (opt string, switchUser bool, err error) {
+	caps := &processCaps{}
+	if proc.Capabilities != nil {
+		caps, err = parseProcessCaps(proc.Capabilities)
+		if err != nil {
+			return "", false, err
+		}
+		if err := caps.validate(); err != nil {
+			return "", false, err
+		}
+	}
+	bounding, err := c.containerBounding()
+	if err != nil {
+		return "", false, err
+	}
+	if missing := caps.Bounding.missing(bounding); len(missing) > 0 {
+		return "", false, fmt.Errorf("bounding capabilities %s are not in the container bounding set", missing)
+	}
+
+	attached := processCaps{Bounding: bounding}
+	root := proc.User.UID == 0
+	if root {
+		attached.Effective = bounding
+		attached.Permitted = bounding
+	}
+	if *caps == attached {
+		return "", false, nil
+	}
+
+	var required capSet
+	if caps.Bounding != bounding {
+		required |= 1 << unix.CAP_SETPCAP
+	}
+	if !root {
+		switchUser = true
+		required |= 1<<unix.CAP_SETUID | 1<<unix.CAP_SETGID
+	}
+	if missing := required.missing(bounding); len(missing) > 0 {
+		return "", false, fmt.Errorf("capabilities %s required to apply the exec capabilities are not in the container bounding set", missing)
+	}
+	return fmt.Sprintf("%x:%x:%x:%x:%x", caps.Bounding, caps.Effective, caps.Permitted, caps.Inheritable, caps.Ambient), switchUser, nil
+}
+
+// containerBounding returns the bounding set of the container (lxc.cap.keep).
+func (c *Runtime) containerBounding() (capSet, error) {
+	var names []string
+	for _, name := range strings.Fields(c.getConfigItem("lxc.cap.keep")) {
+		if name != "none" {
+			names = append(names, "cap_"+name)
+		}
+	}
+	return parseCapSet(names)
+}
@@ -0,0 +1,135 @@
+package lxcontainer
+
+import (
+	"os"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecCommand(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+
+	args := []string{"/bin/sh"}
+	cmd, helper, _, err := rt.execCommand(args, nil)
+	require.NoError(t, err)
+	require.False(t, helper)
+	require.Equal(t, args, cmd)
+
+	require.NoError(t, c.SetConfigItem("lxc.cap.keep", "chown net_bind_service setgid setpcap setuid"))
+
+	oomScoreAdj := -100
+	umask := uint32(0022)
+	proc := &specs.Process{
+		User: specs.User{UID: 1000, GID: 1001, Umask: &umask},
+		Capabilities: &specs.LinuxCapabilities{
+			Bounding:    []string{"CAP_CHOWN", "CAP_NET_BIND_SERVICE"},
+			Effective:   []string{"CAP_NET_BIND_SERVICE"},
+			Permitted:   []string{"CAP_NET_BIND_SERVICE"},
+			Inheritable: []string{"CAP_NET_BIND_SERVICE"},
+			Ambient:     []string{"CAP_NET_BIND_SERVICE"},
+		},
+		Rlimits: []specs.POSIXRlimit{
+			{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 4096},
+		},
+		OOMScoreAdj: &oomScoreAdj,
+		IOPriority:  &specs.LinuxIOPriority{Class: specs.IOPRIO_CLASS_BE, Priority: 4},
+	}
+	cmd, helper, switchUser, err := rt.execCommand(args, proc)
+	require.NoError(t, err)
+	require.True(t, helper)
+	require.True(t, switchUser)
+	require.Equal(t, []string{"/.crio-lxc/init", "--exec",
+		"-u", "1000:1001",
+		"-c", "401:400:400:400:400",
+		"-r", "7:1024:4096",
+		"-o", "-100",
+		"-m", "22",
+		"-i", "16388",
+		"--", "/bin/sh"}, cmd)
+
+	// the user is set by liblxc if the process has the capabilities of a process attached by liblxc
+	bounding := &specs.LinuxCapabilities{Bounding: []string{"CAP_CHOWN", "CAP_NET_BIND_SERVICE", "CAP_SETGID", "CAP_SETPCAP", "CAP_SETUID"}}
+	cmd, helper, switchUser, err = rt.execCommand(args, &specs.Process{User: proc.User, Capabilities: bounding, OOMScoreAdj: &oomScoreAdj})
+	require.NoError(t, err)
+	require.True(t, helper)
+	require.False(t, switchUser)
+	require.Equal(t, []string{"/.crio-lxc/init", "--exec", "-o", "-100", "-m", "22", "--", "/bin/sh"}, cmd)
+
+	// all settings are applied by liblxc
+	rt.Capabilities = false
+	cmd, helper, _, err = rt.execCommand(args, &specs.Process{User: specs.User{UID: 1000}})
+	require.NoError(t, err)
+	require.False(t, helper)
+	require.Equal(t, args, cmd)
+
+	// the container profile is applied by liblxc
+	require.NoError(t, c.SetConfigItem("lxc.apparmor.profile", "crio-default"))
+	_, helper, _, err = rt.execCommand(args, &specs.Process{ApparmorProfile: "crio-default"})
+	require.NoError(t, err)
+	require.False(t, helper)
+}
+
+func TestExecCommand_dropAll(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+
+	// capabilities drop: [ALL]
+	c.config["lxc.cap.keep"] = []string{"none"}
+	args := []string{"/bin/sh"}
+	for _, uid := range []uint32{0, 1000} {
+		for _, caps := range []*specs.LinuxCapabilities{nil, {}} {
+			proc := &specs.Process{User: specs.User{UID: uid, GID: uid}, Capabilities: caps}
+			cmd, helper, _, err := rt.execCommand(args, proc)
+			require.NoError(t, err)
+			require.False(t, helper)
+			require.Equal(t, args, cmd)
+		}
+	}
+
+	// the helper can not switch the user without CAP_SETUID and CAP_SETGID
+	c.config["lxc.cap.keep"] = []string{"net_bind_service"}
+	bind := []string{"CAP_NET_BIND_SERVICE"}
+	proc := &specs.Process{
+		User:         specs.User{UID: 1000, GID: 1000},
+		Capabilities: &specs.LinuxCapabilities{Bounding: bind, Permitted: bind, Inheritable: bind, Ambient: bind},
+	}
+	_, _, _, err := rt.execCommand(args, proc)
+	require.EqualError(t, err, "capabilities [CAP_SETGID CAP_SETUID] required to apply the exec capabilities are not in the container bounding set")
+
+	// the helper can not drop capabilities from the bounding set without CAP_SETPCAP
+	proc = &specs.Process{Capabilities: &specs.LinuxCapabilities{}}
+	_, _, _, err = rt.execCommand(args, proc)
+	require.EqualError(t, err, "capabilities [CAP_SETPCAP] required to apply the exec capabilities are not in the container bounding set")
+
+	// capabilities can not be added to the bounding set
+	proc = &specs.Process{Capabilities: &specs.LinuxCapabilities{Bounding: []string{"CAP_SYS_ADMIN"}}}
+	_, _, _, err = rt.execCommand(args, proc)
+	require.EqualError(t, err, "bounding capabilities [CAP_SYS_ADMIN] are not in the container bounding set")
+}
+
+func TestExecHelperOptions_invalid(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	rt.Container = createTestContainer(t, rt, backend)
+
+	procs := []*specs.Process{
+		{CommandLine: "cmd.exe"},
+		{Scheduler: &specs.Scheduler{Policy: specs.SchedOther}},
+		{Capabilities: &specs.LinuxCapabilities{Effective: []string{"CAP_CHOWN"}}},
+		{Rlimits: []specs.POSIXRlimit{{Type: "RLIMIT_FOO"}}},
+		{Rlimits: []specs.POSIXRlimit{{Type: "RLIMIT_NOFILE"}, {Type: "rlimit_nofile"}}},
+		{IOPriority: &specs.LinuxIOPriority{Class: "IOPRIO_CLASS_FOO"}},
+		{IOPriority: &specs.LinuxIOPriority{Class: specs.IOPRIO_CLASS_RT, Priority: 8}},
+	}
+	for _, proc := range procs {
+		_, _, err := rt.execHelperOptions(proc)
+		require.Error(t, err, "%#v", proc)
+	}
+}
@@ -0,0 +1,17 @@
+package lxcontainer
+
+import (
+	"fmt"
+)
+
+// GC removes the cached seccomp profiles and the ID mapping allocations
+// that are not used by any container. Both are also removed on Runtime.Delete.
+func GC(runtimeRoot string) error {
+	if err := pruneSeccompCache(runtimeRoot); err != nil {
+		return fmt.Errorf("failed to prune seccomp profile cache: %w", err)
+	}
+	if err := pruneUsernsAllocations(runtimeRoot); err != nil {
+		return fmt.Errorf("failed to release ID mappings: %w", err)
+	}
+	return nil
+}
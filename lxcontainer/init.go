@@ -20,17 +20,18 @@ func createFifo(dst string, uid int, gid int, mode uint32) error {
 	if err := unix.Mkfifo(dst, mode); err != nil {
 		return err
 	}
-	return unix.Chown(dst, uid, gid)
+	return chown(dst, uid, gid)
 }
 
 func configureInit(clxc *Runtime, spec *specs.Spec) error {
 	runtimeInitDir := clxc.RuntimePath(initDir)
 	rootfsInitDir := filepath.Join(spec.Root.Path, initDir)
 
-	err := os.MkdirAll(rootfsInitDir, 0)
+	fd, err := mkdirAllInRoot(spec.Root.Path, rootfsInitDir, 0, os.Geteuid(), os.Getegid())
 	if err != nil {
 		return fmt.Errorf("failed to create init dir in rootfs %q: %w", rootfsInitDir, err)
 	}
+	unix.Close(fd)
 	// #nosec
 	err = os.MkdirAll(runtimeInitDir, 0755)
 	if err != nil {
@@ -48,8 +49,7 @@ func configureInit(clxc *Runtime, spec *specs.Spec) error {
 		return err
 	}
 
-	uid := int(spec.Process.User.UID)
-	gid := int(spec.Process.User.GID)
+	uid, gid := hostUser(spec, spec.Process.User.UID, spec.Process.User.GID)
 
 	// create files required for crio-lxc-init
 	if err := createFifo(clxc.syncFifoPath(), uid, gid, 0600); err != nil {
@@ -126,14 +126,44 @@ func createList(dst string, entries []string, uid int, gid int, mode uint32) err
 	if err := f.Close(); err != nil {
 		return err
 	}
-	if err := unix.Chown(dst, uid, gid); err != nil {
+	if err := unix.Chmod(dst, mode); err != nil {
 		return err
 	}
-	return unix.Chmod(dst, mode)
+	return chown(dst, uid, gid)
+}
+
+// hostUser returns the host IDs of the container user for the ownership of the init files.
+func hostUser(spec *specs.Spec, uid uint32, gid uint32) (int, int) {
+	if spec.Linux == nil {
+		return int(uid), int(gid)
+	}
+	hostUID, _ := hostID(spec.Linux.UIDMappings, uid)
+	hostGID, _ := hostID(spec.Linux.GIDMappings, gid)
+	return int(hostUID), int(hostGID)
+}
+
+// createInitFile creates a file with the given content that is read by crio-lxc-init.
+func createInitFile(dst string, content string, uid int, gid int, mode uint32) error {
+	// #nosec
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := unix.Chmod(dst, mode); err != nil {
+		return err
+	}
+	return chown(dst, uid, gid)
 }
 
 func configureInitUser(clxc *Runtime, spec *specs.Spec) error {
-	// TODO ensure that the user namespace is enabled
+	// The ID mappings are validated by configureUserns.
 	// See `man lxc.container.conf` lxc.idmap.
 	for _, m := range spec.Linux.UIDMappings {
 		if err := clxc.setConfigItem("lxc.idmap", fmt.Sprintf("u %d %d %d", m.ContainerID, m.HostID, m.Size)); err != nil {
@@ -147,13 +177,26 @@ func configureInitUser(clxc *Runtime, spec *specs.Spec) error {
 		}
 	}
 
-	if err := clxc.setConfigItem("lxc.init.uid", fmt.Sprintf("%d", spec.Process.User.UID)); err != nil {
+	uid, gid := initUser(clxc, spec)
+	if err := clxc.setConfigItem("lxc.init.uid", fmt.Sprintf("%d", uid)); err != nil {
 		return err
 	}
-	if err := clxc.setConfigItem("lxc.init.gid", fmt.Sprintf("%d", spec.Process.User.GID)); err != nil {
+	if err := clxc.setConfigItem("lxc.init.gid", fmt.Sprintf("%d", gid)); err != nil {
 		return err
 	}
 
+	if initSwitchesUser(clxc, spec) {
+		// uid gid [additional gids ...]
+		var b strings.Builder
+		fmt.Fprintf(&b, "%d %d", spec.Process.User.UID, spec.Process.User.GID)
+		for _, g := range spec.Process.User.AdditionalGids {
+			fmt.Fprintf(&b, " %d", g)
+		}
+		b.WriteByte('\n')
+		fileUID, fileGID := hostUser(spec, uint32(uid), uint32(gid))
+		return createInitFile(clxc.RuntimePath(initDir, "user"), b.String(), fileUID, fileGID, 0400)
+	}
+
 	if len(spec.Process.User.AdditionalGids) > 0 && clxc.supportsConfigItem("lxc.init.groups") {
 		var b strings.Builder
 		for i, gid := range spec.Process.User.AdditionalGids {
@@ -1,11 +1,15 @@
 package lxcontainer
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
@@ -15,6 +19,20 @@ func configureMounts(clxc *Runtime, spec *specs.Spec) error {
 		return err
 	}
 
+	mountLabel, err := selinuxMountLabel(clxc, spec)
+	if err != nil {
+		return err
+	}
+
+	// Mount parent directories before the mounts below them.
+	// The order of mounts with the same depth is preserved.
+	sort.SliceStable(spec.Mounts, func(i, j int) bool {
+		return mountDepth(spec.Mounts[i].Destination) < mountDepth(spec.Mounts[j].Destination)
+	})
+
+	// resolved destinations of the previous mounts
+	var targets []string
+
 	for i := range spec.Mounts {
 		ms := spec.Mounts[i]
 		if ms.Type == "cgroup" {
@@ -27,24 +45,47 @@ func configureMounts(clxc *Runtime, spec *specs.Spec) error {
 			// since the container can mount the filesystems itself, and automounting can confuse the container.
 		}
 
-		// TODO replace with symlink.FollowSymlinkInScope(filepath.Join(rootfs, "/etc/passwd"), rootfs) ?
-		// "github.com/docker/docker/pkg/symlink"
 		mountDest, err := resolveMountDestination(spec.Root.Path, ms.Destination)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to resolve mount target %s: %w", ms.Destination, err)
+		}
 		// Intermediate path resolution failed. This is not an error, since
 		// the remaining directories / files are automatically created (create=dir|file)
 		clxc.Log.Trace().Err(err).Str("file", ms.Destination).Str("target", mountDest).Msg("resolve mount destination")
 
-		// Check whether the resolved destination of the target link escapes the rootfs.
-		if !filepath.HasPrefix(mountDest, spec.Root.Path) {
-			// refuses mount destinations that escape from rootfs
+		// The resolved path is always within the rootfs. Check it anyways, since mounting
+		// outside of the rootfs would modify the host.
+		if !isSubPath(spec.Root.Path, mountDest) {
 			return fmt.Errorf("resolved mount target path %s escapes from container root %s", mountDest, spec.Root.Path)
 		}
 		ms.Destination = mountDest
 
-		err = createMountDestination(spec, &ms)
+		if err := configureMountIdmap(clxc, spec, &ms); err != nil {
+			return fmt.Errorf("failed to configure idmapped mount %s: %w", ms.Destination, err)
+		}
+
+		var attr mountAttr
+		attr, ms.Options = parseRecursiveMountOptions(ms.Options)
+
+		err = createMountDestination(spec, &ms, isBelowMount(targets, ms.Destination))
 		if err != nil {
 			return fmt.Errorf("failed to create mount target %s: %w", ms.Destination, err)
 		}
+		targets = append(targets, ms.Destination)
+
+		if !attr.empty() {
+			rel, err := filepath.Rel(spec.Root.Path, ms.Destination)
+			if err != nil {
+				return err
+			}
+			if err := appendMountAttr(clxc.RuntimePath(mountAttrsFile), "/"+rel, attr, false); err != nil {
+				return fmt.Errorf("failed to write mount attributes for %s: %w", ms.Destination, err)
+			}
+		}
+
+		if mountLabel != "" && (ms.Type == "tmpfs" || ms.Type == "mqueue") {
+			ms.Options = append(ms.Options, selinuxContextOption(mountLabel))
+		}
 
 		mnt := fmt.Sprintf("%s %s %s %s", ms.Source, ms.Destination, ms.Type, strings.Join(ms.Options, ","))
 
@@ -55,110 +96,420 @@ func configureMounts(clxc *Runtime, spec *specs.Spec) error {
 	return nil
 }
 
+// mountAttrsFile is the runtime file with the mount attributes that are applied recursively
+// by the container hook with mount_setattr (linux >= 5.12), since liblxc can not set them.
+// Each line is `<attr_set> <attr_clr> <optional> <path>` (attributes in hex).
+// Errors for optional paths that do not exist, or if mount_setattr is not supported, are ignored.
+const mountAttrsFile = "mountattrs.txt"
+
+// see `man 2 mount_setattr`
+const (
+	mountAttrRdonly      = 0x00000001
+	mountAttrNosuid      = 0x00000002
+	mountAttrNodev       = 0x00000004
+	mountAttrNoexec      = 0x00000008
+	mountAttrAtime       = 0x00000070 // MOUNT_ATTR__ATIME
+	mountAttrRelatime    = 0x00000000
+	mountAttrNoatime     = 0x00000010
+	mountAttrStrictatime = 0x00000020
+	mountAttrNodiratime  = 0x00000080
+	mountAttrNosymfollow = 0x00200000
+)
+
+// recursiveMountOptions are the recursive mount options from the runtime-spec (>= 1.1).
+// The attribute is cleared if clear is set, otherwise it is set.
+var recursiveMountOptions = map[string]struct {
+	clear bool
+	attr  uint64
+}{
+	"rro":            {false, mountAttrRdonly},
+	"rrw":            {true, mountAttrRdonly},
+	"rnosuid":        {false, mountAttrNosuid},
+	"rsuid":          {true, mountAttrNosuid},
+	"rnodev":         {false, mountAttrNodev},
+	"rdev":           {true, mountAttrNodev},
+	"rnoexec":        {false, mountAttrNoexec},
+	"rexec":          {true, mountAttrNoexec},
+	"rnodiratime":    {false, mountAttrNodiratime},
+	"rdiratime":      {true, mountAttrNodiratime},
+	"rrelatime":      {false, mountAttrRelatime},
+	"rnorelatime":    {true, mountAttrRelatime},
+	"rnoatime":       {false, mountAttrNoatime},
+	"ratime":         {true, mountAttrNoatime},
+	"rstrictatime":   {false, mountAttrStrictatime},
+	"rnostrictatime": {true, mountAttrStrictatime},
+	"rnosymfollow":   {false, mountAttrNosymfollow},
+	"rsymfollow":     {true, mountAttrNosymfollow},
+}
+
+// mountAttr are the attributes that are set and cleared with mount_setattr.
+type mountAttr struct {
+	Set   uint64
+	Clear uint64
+}
+
+func (a mountAttr) empty() bool {
+	return a.Set == 0 && a.Clear == 0
+}
+
+// parseRecursiveMountOptions returns the mount attributes for the recursive mount options
+// and the remaining options. Later options override earlier ones.
+func parseRecursiveMountOptions(options []string) (mountAttr, []string) {
+	var attr mountAttr
+	rest := make([]string, 0, len(options))
+	for _, opt := range options {
+		o, ok := recursiveMountOptions[opt]
+		if !ok {
+			rest = append(rest, opt)
+			continue
+		}
+		if o.attr == mountAttrRelatime || o.attr&mountAttrAtime != 0 {
+			// The access time attributes are an enum, clearing one of them restores the default (relatime).
+			attr.Clear |= mountAttrAtime
+			attr.Set &^= mountAttrAtime
+			if !o.clear {
+				attr.Set |= o.attr
+			}
+			continue
+		}
+		if o.clear {
+			attr.Set &^= o.attr
+			attr.Clear |= o.attr
+		} else {
+			attr.Clear &^= o.attr
+			attr.Set |= o.attr
+		}
+	}
+	return attr, rest
+}
+
+// appendMountAttr appends the mount attributes for path (absolute within the rootfs) to the file dst.
+func appendMountAttr(dst string, path string, attr mountAttr, optional bool) error {
+	// #nosec
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	opt := 0
+	if optional {
+		opt = 1
+	}
+	if _, err := fmt.Fprintf(f, "%x %x %d %s\n", attr.Set, attr.Clear, opt, path); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// configureMountIdmap idmaps a bind mount with the container ID mappings,
+// so that files owned by container IDs on the host show up with their container IDs.
+// An idmapped mount is requested with the runtime-spec mount uidMappings / gidMappings
+// or with the mount option `idmap` / `ridmap` (see runc).
+// liblxc can only idmap mounts with the ID mappings of the container (`idmap=container`),
+// so mount ID mappings that differ from the container ID mappings are rejected.
+func configureMountIdmap(c *Runtime, spec *specs.Spec, ms *specs.Mount) error {
+	idmap := len(ms.UIDMappings) > 0 || len(ms.GIDMappings) > 0
+	options := make([]string, 0, len(ms.Options))
+	for _, opt := range ms.Options {
+		if opt == "idmap" || opt == "ridmap" {
+			idmap = true
+			continue
+		}
+		options = append(options, opt)
+	}
+	if !idmap {
+		return nil
+	}
+	ms.Options = options
+
+	if !isBindMount(ms) {
+		return fmt.Errorf("only bind mounts can be idmapped")
+	}
+	if spec.Linux == nil || len(spec.Linux.UIDMappings) == 0 || len(spec.Linux.GIDMappings) == 0 {
+		return fmt.Errorf("idmapped mounts require a user namespace with ID mappings")
+	}
+	if len(ms.UIDMappings) > 0 || len(ms.GIDMappings) > 0 {
+		if !equalIDMappings(ms.UIDMappings, spec.Linux.UIDMappings) || !equalIDMappings(ms.GIDMappings, spec.Linux.GIDMappings) {
+			return fmt.Errorf("mount ID mappings must match the container ID mappings")
+		}
+	}
+	if !c.backend().VersionAtLeast(5, 0, 0) {
+		return fmt.Errorf("idmapped mounts require liblxc >= 5.0.0")
+	}
+	ms.Options = append(ms.Options, "idmap=container")
+	return nil
+}
+
+func isBindMount(ms *specs.Mount) bool {
+	if ms.Type == "bind" {
+		return true
+	}
+	for _, opt := range ms.Options {
+		if opt == "bind" || opt == "rbind" {
+			return true
+		}
+	}
+	return false
+}
+
+// mountDepth returns the number of path elements of the mount destination.
+func mountDepth(dst string) int {
+	p := filepath.Clean("/" + dst)
+	if p == "/" {
+		return 0
+	}
+	return strings.Count(p, "/")
+}
+
+// isBelowMount returns true if dst is a previous mount target or below it.
+func isBelowMount(targets []string, dst string) bool {
+	for _, t := range targets {
+		if isSubPath(t, dst) {
+			return true
+		}
+	}
+	return false
+}
+
 // createMountDestination creates non-existent mount destination paths.
 // This is required if rootfs is mounted readonly.
 // When the source is a file that should be bind mounted a destination file is created.
 // In any other case a target directory is created.
+// The destination is created relative to the rootfs file descriptor (see mkdirAllInRoot),
+// so a symlink that is created concurrently within the rootfs can not redirect it.
 // We add 'create=dir' or 'create=file' to mount options because the mount destination
-// may be shadowed by a previous mount. In this case lxc will create the mount destination.
+// may be shadowed by a previous mount. Destinations below a previous mount are not created
+// on the rootfs, since they would be shadowed by that mount. liblxc creates them when the
+// container is started.
 // TODO check whether this is  desired behaviour in lxc ?
 // Shouldn't the rootfs should be mounted readonly after all mounts destination directories have been created ?
 // https://github.com/lxc/lxc/issues/1702
-func createMountDestination(spec *specs.Spec, ms *specs.Mount) error {
+func createMountDestination(spec *specs.Spec, ms *specs.Mount, belowMount bool) error {
 	info, err := os.Stat(ms.Source)
 	if err != nil && ms.Type == "bind" {
 		// check if mountpoint is optional ?
 		return fmt.Errorf("failed to access source for bind mount: %w", err)
 	}
-	uid := int(spec.Process.User.UID)
-	gid := int(spec.Process.User.GID)
+	uid, gid := hostUser(spec, spec.Process.User.UID, spec.Process.User.GID)
 
 	if err == nil && !info.IsDir() {
 		ms.Options = append(ms.Options, "create=file")
+		if belowMount {
+			return nil
+		}
 		// source exists and is not a directory
 		// create a target file that can be used as target for a bind mount
-		if err := mkdirAll(filepath.Dir(ms.Destination), 0750, uid, gid); err != nil {
+		dirfd, err := mkdirAllInRoot(spec.Root.Path, filepath.Dir(ms.Destination), 0750, uid, gid)
+		if err != nil {
 			return fmt.Errorf("failed to create mount destination dir: %w", err)
 		}
-		f, err := os.OpenFile(ms.Destination, os.O_CREATE, 0)
+		defer unix.Close(dirfd)
+		fd, err := unix.Openat(dirfd, filepath.Base(ms.Destination), unix.O_CREAT|unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
 		if err != nil {
 			return fmt.Errorf("failed to create file mountpoint: %w", err)
 		}
-		return f.Close()
+		return unix.Close(fd)
 	}
 	ms.Options = append(ms.Options, "create=dir")
-	// FIXME exclude all directories that are below other mounts
-	// only directories / files on the readonly rootfs must be created
-	if err = mkdirAll(ms.Destination, 0750, uid, gid); err != nil {
+	if belowMount {
+		return nil
+	}
+	dirfd, err := mkdirAllInRoot(spec.Root.Path, ms.Destination, 0750, uid, gid)
+	if err != nil {
 		return fmt.Errorf("failed to create mount target dir: %w", err)
 	}
-	return nil
+	return unix.Close(dirfd)
 }
 
-func resolvePathRelative(rootfs string, currentPath string, subPath string) (string, error) {
-	p := filepath.Join(currentPath, subPath)
+// resolveMountDestination resolves mount destination paths for LXC.
+//
+// Symlinks in mount mount destination paths are not allowed in LXC.
+// See CVE-2015-1335: Protect container mounts against symlinks
+// and https://github.com/lxc/lxc/commit/592fd47a6245508b79fe6ac819fe6d3b2c1289be
+// Mount targets that contain symlinks should be resolved relative to the container rootfs.
+// e.g k8s service account tokens are mounted to /var/run/secrets/kubernetes.io/serviceaccount
+// but /var/run is (mostly) a symlink to /run, so LXC denies to mount the serviceaccount token.
+//
+// The destination is resolved as if rootfs were the root directory: absolute symlinks
+// and ".." are resolved relative to rootfs and can not escape from it.
+// The path is resolved by the kernel with openat2(RESOLVE_IN_ROOT) if available (linux >= 5.6),
+// otherwise symlinks are resolved in userspace (see secureJoin).
+//
+// The returned path is the absolute path to the destination within rootfs.
+// An error that wraps os.ErrNotExist is returned, if the destination does not exist.
+// The non-existent part of the path is appended to the resolved path.
+// The mount option `create=dir` should be set in this case, and the non-existent directories
+// are then automatically created by LXC.
+
+// source /var/run/containers/storage/overlay-containers/51230afad17aa3b42901f6d9efcba406511821b7e18b2223a6b4c43f9327ce97/userdata/resolv.conf
+// destination /etc/resolv.conf
+func resolveMountDestination(rootfs string, dst string) (string, error) {
+	p, err := resolveInRoot(rootfs, dst)
+	if err == unix.ENOSYS {
+		return secureJoin(rootfs, dst)
+	}
+	return p, err
+}
 
-	stat, err := os.Lstat(p)
+// resolveInRoot resolves dst within rootfs with openat2(RESOLVE_IN_ROOT).
+// The kernel resolves the longest existing prefix of dst. If the next path component
+// is a dangling symlink, its target is resolved (like secureJoin does).
+func resolveInRoot(rootfs string, dst string) (string, error) {
+	root, err := unix.Open(rootfs, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
 	if err != nil {
-		// target does not exist, resolution ends here
-		return p, err
+		return "", fmt.Errorf("failed to open rootfs: %w", err)
 	}
+	defer unix.Close(root)
+	// rootfs itself may contain symlinks
+	realRoot, err := fdPath(root)
+	if err != nil {
+		return "", err
+	}
+
+	for links := 0; ; links++ {
+		if links > maxSymlinks {
+			return "", fmt.Errorf("%s: %w", dst, unix.ELOOP)
+		}
+		entries := strings.Split(strings.TrimPrefix(filepath.Clean("/"+dst), "/"), "/")
+		fd, i, err := lookupInRoot(root, entries)
+		if err != nil {
+			return "", err
+		}
+		p, err := fdPath(fd)
+		if err != nil {
+			unix.Close(fd)
+			return "", err
+		}
+		var target string
+		if i < len(entries) {
+			target, err = readlinkat(fd, entries[i])
+		}
+		unix.Close(fd)
+		if err != nil {
+			return "", err
+		}
 
-	if stat.Mode()&os.ModeSymlink == 0 {
-		return p, nil
+		if !isSubPath(realRoot, p) {
+			return "", fmt.Errorf("resolved path %s escapes from %s", p, realRoot)
+		}
+		rel, err := filepath.Rel(realRoot, p)
+		if err != nil {
+			return "", err
+		}
+		if i == len(entries) {
+			return filepath.Join(rootfs, rel), nil
+		}
+		if target == "" {
+			resolved := filepath.Join(append([]string{rootfs, rel}, entries[i:]...)...)
+			return resolved, fmt.Errorf("%s: %w", filepath.Join(rootfs, rel, entries[i]), os.ErrNotExist)
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(rel, target)
+		}
+		dst = filepath.Join(append([]string{"/", target}, entries[i+1:]...)...)
+	}
+}
+
+// lookupInRoot returns an O_PATH file descriptor for the longest existing prefix
+// of the path entries within root, and the number of path entries in the prefix.
+func lookupInRoot(root int, entries []string) (int, int, error) {
+	how := &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
 	}
-	// resolve symlink
+	for i := len(entries); i >= 0; i-- {
+		fd, err := openat2Retry(root, filepath.Join(append([]string{"."}, entries[:i]...)...), how)
+		if err == unix.ENOENT || err == unix.ENOTDIR {
+			continue
+		}
+		return fd, i, err
+	}
+	// unreachable, since root itself always exists
+	return -1, 0, unix.ENOENT
+}
 
-	linkDst, err := os.Readlink(p)
+// readlinkat returns the target of the symlink name in dirfd,
+// or an empty string if name is not a symlink.
+func readlinkat(dirfd int, name string) (string, error) {
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(dirfd, name, buf)
+	if err == unix.EINVAL || err == unix.ENOENT {
+		return "", nil
+	}
 	if err != nil {
-		return p, err
+		return "", fmt.Errorf("failed to read link %s: %w", name, err)
 	}
+	return string(buf[:n]), nil
+}
 
-	// The destination of an absolute link must be prefixed with the rootfs
-	if filepath.IsAbs(linkDst) {
-		if filepath.HasPrefix(linkDst, rootfs) {
-			return p, nil
+// openat2Retry calls openat2 and retries if the kernel detected a concurrent rename (EAGAIN).
+func openat2Retry(dirfd int, path string, how *unix.OpenHow) (int, error) {
+	for i := 0; ; i++ {
+		fd, err := unix.Openat2(dirfd, path, how)
+		if (err == unix.EAGAIN || err == unix.EINTR) && i < 32 {
+			continue
 		}
-		return filepath.Join(rootfs, linkDst), nil
+		return fd, err
 	}
+}
 
-	// The link target is relative to currentPath.
-	return filepath.Clean(filepath.Join(currentPath, linkDst)), nil
+// fdPath returns the path of the file descriptor fd.
+func fdPath(fd int) (string, error) {
+	return os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
 }
 
-// resolveMountDestination resolves mount destination paths for LXC.
-//
-// Symlinks in mount mount destination paths are not allowed in LXC.
-// See CVE-2015-1335: Protect container mounts against symlinks
-// and https://github.com/lxc/lxc/commit/592fd47a6245508b79fe6ac819fe6d3b2c1289be
-// Mount targets that contain symlinks should be resolved relative to the container rootfs.
-// e.g k8s service account tokens are mounted to /var/run/secrets/kubernetes.io/serviceaccount
-// but /var/run is (mostly) a symlink to /run, so LXC denies to mount the serviceaccount token.
-//
-// The mount destination must be either relative to the container root or absolute to
-// the directory on the host containing the rootfs.
-// LXC simply ignores relative mounts paths to an absolute rootfs.
-// See man lxc.container.conf #MOUNT POINTS
-//
-// The mount option `create=dir` should be set when the error os.ErrNotExist is returned.
-// The non-existent directories are then automatically created by LXC.
+// maxSymlinks is the maximum number of symlinks followed by secureJoin (like MAXSYMLINKS in linux).
+const maxSymlinks = 40
 
-// source /var/run/containers/storage/overlay-containers/51230afad17aa3b42901f6d9efcba406511821b7e18b2223a6b4c43f9327ce97/userdata/resolv.conf
-// destination /etc/resolv.conf
-func resolveMountDestination(rootfs string, dst string) (dstPath string, err error) {
-	// get path entries
-	entries := strings.Split(strings.TrimPrefix(dst, "/"), "/")
-
-	currentPath := rootfs
-	// start path resolution at rootfs
-	for i, entry := range entries {
-		currentPath, err = resolvePathRelative(rootfs, currentPath, entry)
+// secureJoin resolves dst within rootfs in userspace, like github.com/cyphar/filepath-securejoin.
+// Each path component is resolved relative to the already resolved path,
+// absolute symlinks are resolved relative to rootfs and ".." never leaves rootfs.
+// Unlike openat2(RESOLVE_IN_ROOT) it is not safe against concurrent modification of the rootfs.
+func secureJoin(rootfs string, dst string) (string, error) {
+	resolved := "/"
+	unresolved := dst
+	links := 0
+	var notExist error
+	for unresolved != "" {
+		var name string
+		if i := strings.IndexByte(unresolved, '/'); i >= 0 {
+			name, unresolved = unresolved[:i], unresolved[i+1:]
+		} else {
+			name, unresolved = unresolved, ""
+		}
+		next := filepath.Join(resolved, name)
+		if notExist != nil || next == resolved {
+			resolved = next
+			continue
+		}
+
+		p := filepath.Join(rootfs, next)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			notExist = fmt.Errorf("%s: %w", p, os.ErrNotExist)
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("%s: %w", dst, unix.ELOOP)
+		}
+		target, err := os.Readlink(p)
 		if err != nil {
-			// The already resolved path is concatenated with the remaining path,
-			// if resolution of path fails at some point.
-			currentPath = filepath.Join(currentPath, filepath.Join(entries[i+1:]...))
-			break
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
 		}
+		unresolved = target + "/" + unresolved
 	}
-	return currentPath, err
+	return filepath.Join(rootfs, resolved), notExist
 }
@@ -1,12 +1,15 @@
 package lxcontainer
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestResolveMountDestination_absolute(t *testing.T) {
@@ -71,3 +74,182 @@ func TestResolveMountDestination_relative(t *testing.T) {
 	require.Equal(t, filepath.Join(tmpdir, "/folder3/hello.txt"), p)
 	require.Error(t, err, os.ErrExist)
 }
+
+func TestConfigureMountIdmap(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	backend.version = [3]int{5, 0, 0}
+
+	mappings := []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	spec := &specs.Spec{Linux: &specs.Linux{UIDMappings: mappings, GIDMappings: mappings}}
+
+	ms := specs.Mount{Type: "bind", Options: []string{"rbind", "ro"}}
+	require.NoError(t, configureMountIdmap(rt, spec, &ms))
+	require.Equal(t, []string{"rbind", "ro"}, ms.Options)
+
+	ms = specs.Mount{Type: "bind", Options: []string{"rbind", "idmap", "ro"}}
+	require.NoError(t, configureMountIdmap(rt, spec, &ms))
+	require.Equal(t, []string{"rbind", "ro", "idmap=container"}, ms.Options)
+
+	ms = specs.Mount{Options: []string{"rbind"}, UIDMappings: mappings, GIDMappings: mappings}
+	require.NoError(t, configureMountIdmap(rt, spec, &ms))
+	require.Equal(t, []string{"rbind", "idmap=container"}, ms.Options)
+
+	other := []specs.LinuxIDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}}
+	ms = specs.Mount{Type: "bind", UIDMappings: other, GIDMappings: mappings}
+	require.Error(t, configureMountIdmap(rt, spec, &ms))
+
+	ms = specs.Mount{Type: "tmpfs", Options: []string{"idmap"}}
+	require.Error(t, configureMountIdmap(rt, spec, &ms))
+
+	ms = specs.Mount{Type: "bind", Options: []string{"idmap"}}
+	require.Error(t, configureMountIdmap(rt, &specs.Spec{Linux: &specs.Linux{}}, &ms))
+
+	backend.version = [3]int{4, 0, 6}
+	ms = specs.Mount{Type: "bind", Options: []string{"ridmap"}}
+	require.Error(t, configureMountIdmap(rt, spec, &ms))
+}
+
+func TestResolveMountDestination_escape(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "golang.test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	rootfs := filepath.Join(tmpdir, "rootfs")
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0750))
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpdir, "rootfs-evil"), 0750))
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpdir, "etc"), 0750))
+	require.NoError(t, os.Symlink("/../../../etc", filepath.Join(rootfs, "abs")))
+	require.NoError(t, os.Symlink("../../../etc", filepath.Join(rootfs, "etc", "rel")))
+	require.NoError(t, os.Symlink("../rootfs-evil", filepath.Join(rootfs, "evil")))
+	require.NoError(t, os.Symlink("loop2", filepath.Join(rootfs, "loop1")))
+	require.NoError(t, os.Symlink("loop1", filepath.Join(rootfs, "loop2")))
+
+	for name, resolve := range map[string]func(string, string) (string, error){
+		"openat2":    resolveMountDestination,
+		"securejoin": secureJoin,
+	} {
+		p, err := resolve(rootfs, "/abs/passwd")
+		require.Equal(t, filepath.Join(rootfs, "etc/passwd"), p, name)
+		require.True(t, errors.Is(err, os.ErrNotExist), name)
+
+		p, err = resolve(rootfs, "/etc/rel")
+		require.Equal(t, filepath.Join(rootfs, "etc"), p, name)
+		require.NoError(t, err, name)
+
+		p, err = resolve(rootfs, "/../../etc")
+		require.Equal(t, filepath.Join(rootfs, "etc"), p, name)
+		require.NoError(t, err, name)
+
+		// /rootfs-evil must not match the /rootfs prefix
+		p, err = resolve(rootfs, "/evil/file")
+		require.Equal(t, filepath.Join(rootfs, "rootfs-evil/file"), p, name)
+		require.True(t, errors.Is(err, os.ErrNotExist), name)
+
+		_, err = resolve(rootfs, "/loop1/file")
+		require.Error(t, err, name)
+	}
+}
+
+func TestMkdirAllInRoot(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "golang.test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	rootfs := filepath.Join(tmpdir, "rootfs")
+	require.NoError(t, os.MkdirAll(rootfs, 0750))
+	require.NoError(t, os.Symlink(tmpdir, filepath.Join(rootfs, "link")))
+
+	fd, err := mkdirAllInRoot(rootfs, filepath.Join(rootfs, "a/b/c"), 0750, os.Getuid(), os.Getgid())
+	require.NoError(t, err)
+	require.NoError(t, unix.Close(fd))
+	require.DirExists(t, filepath.Join(rootfs, "a/b/c"))
+
+	// symlinks are not followed
+	_, err = mkdirAllInRoot(rootfs, filepath.Join(rootfs, "link/x"), 0750, os.Getuid(), os.Getgid())
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(tmpdir, "x"))
+	require.True(t, os.IsNotExist(err))
+
+	_, err = mkdirAllInRoot(rootfs, filepath.Join(tmpdir, "rootfs-evil"), 0750, os.Getuid(), os.Getgid())
+	require.Error(t, err)
+}
+
+func TestParseRecursiveMountOptions(t *testing.T) {
+	attr, rest := parseRecursiveMountOptions([]string{"rbind", "rro", "nodev", "rnosuid", "rnoexec"})
+	require.Equal(t, []string{"rbind", "nodev"}, rest)
+	require.Equal(t, mountAttr{Set: mountAttrRdonly | mountAttrNosuid | mountAttrNoexec}, attr)
+
+	attr, _ = parseRecursiveMountOptions([]string{"rro", "rrw", "rsuid"})
+	require.Equal(t, mountAttr{Clear: mountAttrRdonly | mountAttrNosuid}, attr)
+
+	// access time attributes replace each other
+	attr, _ = parseRecursiveMountOptions([]string{"rnoatime", "rstrictatime"})
+	require.Equal(t, mountAttr{Set: mountAttrStrictatime, Clear: mountAttrAtime}, attr)
+	attr, _ = parseRecursiveMountOptions([]string{"rnoatime", "ratime"})
+	require.Equal(t, mountAttr{Clear: mountAttrAtime}, attr)
+	attr, _ = parseRecursiveMountOptions([]string{"rrelatime"})
+	require.False(t, attr.empty())
+
+	attr, rest = parseRecursiveMountOptions([]string{"bind", "ro"})
+	require.True(t, attr.empty())
+	require.Equal(t, []string{"bind", "ro"}, rest)
+}
+
+func TestAppendMountAttr(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "golang.test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	dst := filepath.Join(tmpdir, mountAttrsFile)
+	require.NoError(t, appendMountAttr(dst, "/data", mountAttr{Set: mountAttrRdonly, Clear: mountAttrAtime}, false))
+	require.NoError(t, appendMountAttr(dst, "/proc/sys", mountAttr{Set: mountAttrRdonly}, true))
+	data, err := ioutil.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, "1 70 0 /data\n1 0 1 /proc/sys\n", string(data))
+}
+
+func TestConfigureMounts_belowMount(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+
+	rootfs := filepath.Join(rt.RuntimeRoot, "rootfs")
+	require.NoError(t, os.MkdirAll(rootfs, 0750))
+	src := filepath.Join(rt.RuntimeRoot, "src")
+	require.NoError(t, os.MkdirAll(src, 0750))
+	srcFile := filepath.Join(rt.RuntimeRoot, "src.txt")
+	require.NoError(t, ioutil.WriteFile(srcFile, nil, 0640))
+
+	spec := &specs.Spec{
+		Root:    &specs.Root{Path: rootfs},
+		Process: &specs.Process{},
+		Mounts: []specs.Mount{
+			{Source: src, Destination: "/data/sub", Type: "bind", Options: []string{"bind"}},
+			{Source: srcFile, Destination: "/data/file.txt", Type: "bind", Options: []string{"bind"}},
+			{Source: "tmpfs", Destination: "/data", Type: "tmpfs"},
+			{Source: srcFile, Destination: "/etc/file.txt", Type: "bind", Options: []string{"bind"}},
+		},
+	}
+	require.NoError(t, configureMounts(rt, spec))
+
+	// parent mounts are mounted first
+	require.Equal(t, "/data", spec.Mounts[0].Destination)
+	require.Equal(t, "/data/sub", spec.Mounts[1].Destination)
+	require.Equal(t, "/data/file.txt", spec.Mounts[2].Destination)
+
+	entries := c.ConfigItem("lxc.mount.entry")
+	require.Len(t, entries, 4)
+	require.Equal(t, "tmpfs "+filepath.Join(rootfs, "data")+" tmpfs create=dir", entries[0])
+	require.Equal(t, src+" "+filepath.Join(rootfs, "data/sub")+" bind bind,create=dir", entries[1])
+	require.Equal(t, srcFile+" "+filepath.Join(rootfs, "data/file.txt")+" bind bind,create=file", entries[2])
+
+	// only the destinations on the rootfs are created
+	require.DirExists(t, filepath.Join(rootfs, "data"))
+	require.FileExists(t, filepath.Join(rootfs, "etc/file.txt"))
+	_, err := os.Stat(filepath.Join(rootfs, "data/sub"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(rootfs, "data/file.txt"))
+	require.True(t, os.IsNotExist(err))
+}
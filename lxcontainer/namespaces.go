@@ -2,6 +2,7 @@ package lxcontainer
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"runtime"
 	"strings"
@@ -25,6 +26,16 @@ var namespaceMap = map[specs.LinuxNamespaceType]namespace{
 	specs.PIDNamespace:     namespace{"pid", unix.CLONE_NEWPID},
 	specs.UserNamespace:    namespace{"user", unix.CLONE_NEWUSER},
 	specs.UTSNamespace:     namespace{"uts", unix.CLONE_NEWUTS},
+	specs.TimeNamespace:    namespace{"time", unix.CLONE_NEWTIME},
+}
+
+// timeNamespacePath exists if the kernel supports time namespaces (linux >= 5.6).
+var timeNamespacePath = "/proc/self/ns/time"
+
+// timeOffsetClocks maps the clocks in linux.timeOffsets to the lxc.time.offset suffixes.
+var timeOffsetClocks = map[string]string{
+	"monotonic": "monotonic",
+	"boottime":  "boot",
 }
 
 func cloneFlags(namespaces []specs.LinuxNamespace) (int, error) {
@@ -41,11 +52,21 @@ func cloneFlags(namespaces []specs.LinuxNamespace) (int, error) {
 
 func configureNamespaces(clxc *Runtime, namespaces []specs.LinuxNamespace) error {
 	seenNamespaceTypes := map[specs.LinuxNamespaceType]bool{}
+	// liblxc only knows the time namespace if it supports the time offsets.
+	timeSupported := clxc.supportsConfigItem("lxc.time.offset.boot")
 	for _, ns := range namespaces {
 		if _, ok := seenNamespaceTypes[ns.Type]; ok {
 			return fmt.Errorf("duplicate namespace type %s", ns.Type)
 		}
 		seenNamespaceTypes[ns.Type] = true
+		if ns.Type == specs.TimeNamespace {
+			if !timeSupported {
+				return fmt.Errorf("time namespace is not supported by liblxc %s", clxc.backend().Version())
+			}
+			if _, err := os.Stat(timeNamespacePath); err != nil {
+				return fmt.Errorf("time namespace is not supported by the kernel: %w", err)
+			}
+		}
 		if ns.Path == "" {
 			continue
 		}
@@ -60,13 +81,11 @@ func configureNamespaces(clxc *Runtime, namespaces []specs.LinuxNamespace) error
 		}
 	}
 
-	// from `man lxc.container.conf` - user and network namespace must be inherited together
-	if !seenNamespaceTypes[specs.NetworkNamespace] && seenNamespaceTypes[specs.UserNamespace] {
-		return fmt.Errorf("to inherit the network namespace the user namespace must be inherited as well")
-	}
-
 	nsToKeep := make([]string, 0, len(namespaceMap))
 	for key, n := range namespaceMap {
+		if key == specs.TimeNamespace && !timeSupported {
+			continue
+		}
 		if !seenNamespaceTypes[key] {
 			nsToKeep = append(nsToKeep, n.Name)
 		}
@@ -74,6 +93,47 @@ func configureNamespaces(clxc *Runtime, namespaces []specs.LinuxNamespace) error
 	return clxc.setConfigItem("lxc.namespace.keep", strings.Join(nsToKeep, " "))
 }
 
+// configureTimeOffsets sets the clock offsets of a new time namespace.
+func configureTimeOffsets(clxc *Runtime, spec *specs.Spec) error {
+	if len(spec.Linux.TimeOffsets) == 0 {
+		return nil
+	}
+	ns := getNamespace(specs.TimeNamespace, spec.Linux.Namespaces)
+	if ns == nil {
+		return fmt.Errorf("time offsets require a time namespace")
+	}
+	if ns.Path != "" {
+		return fmt.Errorf("time offsets can not be set for the shared time namespace %s", ns.Path)
+	}
+	for clock, offset := range spec.Linux.TimeOffsets {
+		name, ok := timeOffsetClocks[clock]
+		if !ok {
+			return fmt.Errorf("invalid time offset clock %q", clock)
+		}
+		if offset.Nanosecs >= 1e9 {
+			return fmt.Errorf("invalid time offset for clock %s: nanosecs %d exceeds 1s", clock, offset.Nanosecs)
+		}
+		if err := clxc.setConfigItem("lxc.time.offset."+name, timeOffsetValue(offset)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeOffsetValue formats the offset for lxc.time.offset.* (see `man lxc.container.conf`).
+// liblxc accepts a single value with a unit suffix, so the value is in nanoseconds
+// if nanosecs are set and the offset does not overflow.
+func timeOffsetValue(offset specs.LinuxTimeOffset) string {
+	if offset.Nanosecs == 0 {
+		return fmt.Sprintf("%ds", offset.Secs)
+	}
+	const maxSecs = math.MaxInt64/1000000000 - 1
+	if offset.Secs > maxSecs || offset.Secs < -maxSecs {
+		return fmt.Sprintf("%ds", offset.Secs)
+	}
+	return fmt.Sprintf("%dns", offset.Secs*1e9+int64(offset.Nanosecs))
+}
+
 func isNamespaceEnabled(spec *specs.Spec, nsType specs.LinuxNamespaceType) bool {
 	for _, ns := range spec.Linux.Namespaces {
 		if ns.Type == nsType {
@@ -100,7 +160,7 @@ func setHostname(nsPath string, hostname string) error {
 
 	f, err := os.Open(nsPath)
 	if err != nil {
-		return fmt.Errorf("failed to open container uts namespace: %w", nsPath, err)
+		return fmt.Errorf("failed to open container uts namespace %s: %w", nsPath, err)
 	}
 	// #nosec
 	defer f.Close()
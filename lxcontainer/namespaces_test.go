@@ -0,0 +1,77 @@
+package lxcontainer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCloneFlags(t *testing.T) {
+	flags, err := cloneFlags([]specs.LinuxNamespace{{Type: specs.PIDNamespace}, {Type: specs.TimeNamespace}})
+	require.NoError(t, err)
+	require.Equal(t, unix.CLONE_NEWPID|unix.CLONE_NEWTIME, flags)
+
+	_, err = cloneFlags([]specs.LinuxNamespace{{Type: "foo"}})
+	require.Error(t, err)
+}
+
+func TestConfigureNamespaces_time(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+
+	nsPath := timeNamespacePath
+	defer func() { timeNamespacePath = nsPath }()
+	timeNamespacePath = filepath.Join(rt.RuntimeRoot, "time")
+	require.NoError(t, ioutil.WriteFile(timeNamespacePath, nil, 0640))
+
+	require.NoError(t, configureNamespaces(rt, []specs.LinuxNamespace{{Type: specs.TimeNamespace}}))
+	keep := c.ConfigItem("lxc.namespace.keep")
+	require.NotContains(t, strings.Split(keep[len(keep)-1], " "), "time")
+
+	require.NoError(t, configureNamespaces(rt, nil))
+	keep = c.ConfigItem("lxc.namespace.keep")
+	require.Contains(t, strings.Split(keep[len(keep)-1], " "), "time")
+
+	// time namespaces are not supported by the kernel
+	require.NoError(t, os.Remove(timeNamespacePath))
+	require.Error(t, configureNamespaces(rt, []specs.LinuxNamespace{{Type: specs.TimeNamespace}}))
+}
+
+func TestConfigureTimeOffsets(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+
+	spec := &specs.Spec{Linux: &specs.Linux{
+		Namespaces: []specs.LinuxNamespace{{Type: specs.TimeNamespace}},
+		TimeOffsets: map[string]specs.LinuxTimeOffset{
+			"monotonic": {Secs: 86400},
+			"boottime":  {Secs: -1, Nanosecs: 500},
+		},
+	}}
+	require.NoError(t, configureTimeOffsets(rt, spec))
+	require.Equal(t, []string{"86400s"}, c.ConfigItem("lxc.time.offset.monotonic"))
+	require.Equal(t, []string{"-999999500ns"}, c.ConfigItem("lxc.time.offset.boot"))
+
+	spec.Linux.TimeOffsets = map[string]specs.LinuxTimeOffset{"realtime": {Secs: 1}}
+	require.Error(t, configureTimeOffsets(rt, spec))
+
+	spec.Linux.TimeOffsets = map[string]specs.LinuxTimeOffset{"boottime": {Nanosecs: 1e9}}
+	require.Error(t, configureTimeOffsets(rt, spec))
+
+	spec.Linux.TimeOffsets = map[string]specs.LinuxTimeOffset{"boottime": {Secs: 1}}
+	spec.Linux.Namespaces = []specs.LinuxNamespace{{Type: specs.TimeNamespace, Path: "/proc/1/ns/time"}}
+	require.Error(t, configureTimeOffsets(rt, spec))
+
+	spec.Linux.Namespaces = nil
+	require.Error(t, configureTimeOffsets(rt, spec))
+}
@@ -0,0 +1,218 @@
+package lxcontainer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+)
+
+// Default values for the Runtime settings.
+const (
+	DefaultRuntimeRoot       = "/run/crio-lxc"
+	DefaultContainerLogFile  = "/var/log/crio-lxc/crio-lxc.log"
+	DefaultContainerLogLevel = "warn"
+	DefaultMonitorCgroup     = "crio-lxc-monitor.slice"
+	DefaultInitCommand       = "/usr/local/bin/crio-lxc-init"
+	DefaultStartCommand      = "/usr/local/bin/crio-lxc-start"
+	DefaultContainerHook     = "/usr/local/bin/crio-lxc-container-hook"
+)
+
+// Option sets a Runtime setting.
+type Option func(*Runtime) error
+
+// NewRuntime returns a new Runtime for the container with the given ID.
+// All settings not set by an option are set to their default value.
+// All runtime security features are enabled by default.
+// Rootless mode is enabled if the effective user is not root.
+func NewRuntime(containerID string, opts ...Option) (*Runtime, error) {
+	if containerID == "" {
+		return nil, fmt.Errorf("missing container ID")
+	}
+	c := &Runtime{
+		Backend:           LibLXC{},
+		ContainerLogFile:  DefaultContainerLogFile,
+		ContainerLogLevel: DefaultContainerLogLevel,
+		MonitorCgroup:     DefaultMonitorCgroup,
+		StartCommand:      DefaultStartCommand,
+		InitCommand:       DefaultInitCommand,
+		ContainerHook:     DefaultContainerHook,
+		Log:               zerolog.Nop(),
+	}
+	c.ContainerID = containerID
+	c.RuntimeRoot = DefaultRuntimeRoot
+	c.Rootless = os.Geteuid() != 0
+	if c.Rootless {
+		if root, err := RootlessRuntimeRoot(); err == nil {
+			c.RuntimeRoot = root
+		}
+	}
+	c.Seccomp = true
+	c.Capabilities = true
+	c.Apparmor = true
+	c.CgroupDevices = true
+	c.Selinux = true
+	c.UsernsUser = DefaultUsernsUser
+	c.UsernsSize = DefaultUsernsSize
+
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	c.Log = c.Log.With().Str("cid", containerID).Logger()
+	return c, nil
+}
+
+func absPath(name string, p string) error {
+	if !filepath.IsAbs(p) {
+		return fmt.Errorf("%s must be an absolute path (was %q)", name, p)
+	}
+	return nil
+}
+
+// WithLogger sets the logger for runtime log output.
+// Log output is discarded by default.
+func WithLogger(log zerolog.Logger) Option {
+	return func(c *Runtime) error {
+		c.Log = log
+		return nil
+	}
+}
+
+// WithBackend sets the container engine.
+func WithBackend(backend Backend) Option {
+	return func(c *Runtime) error {
+		if backend == nil {
+			return fmt.Errorf("backend is nil")
+		}
+		c.Backend = backend
+		return nil
+	}
+}
+
+// WithRuntimeRoot sets the directory where the runtime directories of all containers are created.
+func WithRuntimeRoot(dir string) Option {
+	return func(c *Runtime) error {
+		if err := absPath("runtime root", dir); err != nil {
+			return err
+		}
+		c.RuntimeRoot = dir
+		return nil
+	}
+}
+
+// WithContainerLog sets the log file and the log level for the container process (liblxc).
+// See Runtime.parseContainerLogLevel for valid log levels.
+func WithContainerLog(file string, level string) Option {
+	return func(c *Runtime) error {
+		if err := absPath("container log file", file); err != nil {
+			return err
+		}
+		c.ContainerLogFile = file
+		c.ContainerLogLevel = level
+		return nil
+	}
+}
+
+// WithSystemdCgroup enables parsing of cgroup paths in systemd format (slice:prefix:name).
+func WithSystemdCgroup(enabled bool) Option {
+	return func(c *Runtime) error {
+		c.SystemdCgroup = enabled
+		return nil
+	}
+}
+
+// WithMonitorCgroup sets the cgroup for the container monitor process.
+func WithMonitorCgroup(cgroup string) Option {
+	return func(c *Runtime) error {
+		c.MonitorCgroup = cgroup
+		return nil
+	}
+}
+
+// WithCommands sets the paths to the container start, init and hook executables.
+func WithCommands(start string, init string, hook string) Option {
+	return func(c *Runtime) error {
+		for name, p := range map[string]string{"start command": start, "init command": init, "container hook": hook} {
+			if err := absPath(name, p); err != nil {
+				return err
+			}
+		}
+		c.StartCommand = start
+		c.InitCommand = init
+		c.ContainerHook = hook
+		return nil
+	}
+}
+
+// WithApparmor enables or disables the apparmor profile defined in the container spec.
+func WithApparmor(enabled bool) Option {
+	return func(c *Runtime) error {
+		c.Apparmor = enabled
+		return nil
+	}
+}
+
+// WithSelinux enables or disables the selinux process and mount labels defined in the container spec.
+func WithSelinux(enabled bool) Option {
+	return func(c *Runtime) error {
+		c.Selinux = enabled
+		return nil
+	}
+}
+
+// WithUserns enables the allocation of ID mappings for all containers.
+// The ID mappings of a pod are allocated from the subordinate IDs of user (see `man 5 subuid`).
+func WithUserns(enabled bool, user string, size uint32) Option {
+	return func(c *Runtime) error {
+		if user == "" {
+			return fmt.Errorf("userns user is empty")
+		}
+		if size == 0 {
+			return fmt.Errorf("userns size must be greater than 0")
+		}
+		c.UsernsAuto = enabled
+		c.UsernsUser = user
+		c.UsernsSize = size
+		return nil
+	}
+}
+
+// WithCapabilities enables or disables the capabilities defined in the container spec.
+func WithCapabilities(enabled bool) Option {
+	return func(c *Runtime) error {
+		c.Capabilities = enabled
+		return nil
+	}
+}
+
+// WithCgroupDevices enables or disables the device access restrictions defined in the container spec.
+func WithCgroupDevices(enabled bool) Option {
+	return func(c *Runtime) error {
+		c.CgroupDevices = enabled
+		return nil
+	}
+}
+
+// WithSeccompNotifyProxy sets the unix socket path of the seccomp notify proxy (see Runtime.SeccompNotifyProxy).
+func WithSeccompNotifyProxy(socketPath string) Option {
+	return func(c *Runtime) error {
+		if socketPath != "" {
+			if err := absPath("seccomp notify proxy", socketPath); err != nil {
+				return err
+			}
+		}
+		c.SeccompNotifyProxy = socketPath
+		return nil
+	}
+}
+
+// WithSeccomp enables or disables the seccomp profile defined in the container spec.
+func WithSeccomp(enabled bool) Option {
+	return func(c *Runtime) error {
+		c.Seccomp = enabled
+		return nil
+	}
+}
@@ -0,0 +1,39 @@
+package lxcontainer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRuntime(t *testing.T) {
+	_, err := NewRuntime("")
+	require.Error(t, err)
+
+	rt, err := NewRuntime("c1")
+	require.NoError(t, err)
+	require.Equal(t, "c1", rt.ContainerID)
+	require.Equal(t, DefaultRuntimeRoot, rt.RuntimeRoot)
+	require.Equal(t, DefaultInitCommand, rt.InitCommand)
+	require.Equal(t, LibLXC{}, rt.Backend)
+	require.True(t, rt.Seccomp && rt.Apparmor && rt.Capabilities && rt.CgroupDevices && rt.Selinux)
+
+	rt, err = NewRuntime("c1", WithRuntimeRoot("/tmp/root"), WithSeccomp(false),
+		WithCommands("/bin/start", "/bin/init", "/bin/hook"))
+	require.NoError(t, err)
+	require.Equal(t, "/tmp/root", rt.RuntimeRoot)
+	require.Equal(t, "/tmp/root/c1", rt.RuntimePath())
+	require.False(t, rt.Seccomp)
+	require.Equal(t, "/bin/start", rt.StartCommand)
+	require.Equal(t, "/bin/init", rt.InitCommand)
+	require.Equal(t, "/bin/hook", rt.ContainerHook)
+
+	_, err = NewRuntime("c1", WithRuntimeRoot("relative/root"))
+	require.Error(t, err)
+
+	_, err = NewRuntime("c1", WithCommands("/bin/start", "init", "/bin/hook"))
+	require.Error(t, err)
+
+	_, err = NewRuntime("c1", WithBackend(nil))
+	require.Error(t, err)
+}
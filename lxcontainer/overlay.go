@@ -0,0 +1,120 @@
+package lxcontainer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// RootfsOverlayAnnotation enables a writable overlay for a read-only rootfs.
+// The value is the size of the tmpfs that holds the changes to the rootfs (tmpfs option `size`, e.g "64m").
+// The changes are discarded when the container is deleted.
+const RootfsOverlayAnnotation = "org.linuxcontainers.crio-lxc.rootfs.overlay"
+
+// rootfsOverlayDir is the tmpfs mountpoint within the container runtime directory.
+const rootfsOverlayDir = "overlay"
+
+// see `man 5 tmpfs` option size
+var tmpfsSizeRegexp = regexp.MustCompile(`^[0-9]+[kKmMgG%]?$`)
+
+// mountRootfsOverlay mounts an overlayfs with a tmpfs upper dir over the read-only rootfs
+// and replaces the rootfs path in spec with the overlay mount.
+// The overlay is mounted by the runtime (in the runtime mount namespace) and
+// unmounted by unmountRootfsOverlay when the container is deleted.
+func (c *Runtime) mountRootfsOverlay(spec *specs.Spec) error {
+	size, exist := spec.Annotations[RootfsOverlayAnnotation]
+	if !exist {
+		return nil
+	}
+	if !spec.Root.Readonly {
+		c.Log.Warn().Str("annotation", RootfsOverlayAnnotation).Msg("rootfs overlay is only used for a read-only rootfs (ignored)")
+		return nil
+	}
+	if c.Rootless {
+		return fmt.Errorf("rootfs overlay is not supported in rootless mode")
+	}
+	if !tmpfsSizeRegexp.MatchString(size) {
+		return fmt.Errorf("invalid rootfs overlay size %q", size)
+	}
+	// The overlayfs mount options are separated by ',' and lower dirs by ':'.
+	if strings.ContainsAny(spec.Root.Path, ",:") {
+		return fmt.Errorf("rootfs path %q contains invalid characters for overlayfs", spec.Root.Path)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(spec.Root.Path, &st); err != nil {
+		return fmt.Errorf("failed to stat rootfs: %w", err)
+	}
+
+	dir := c.RuntimePath(rootfsOverlayDir)
+	if err := os.Mkdir(dir, 0711); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", dir, "tmpfs", unix.MS_NODEV|unix.MS_NOSUID, "mode=0711,size="+size); err != nil {
+		return fmt.Errorf("failed to mount tmpfs: %w", err)
+	}
+	c.RootfsOverlay = dir
+
+	merged, err := c.createRootfsOverlay(spec.Root.Path, &st)
+	if err != nil {
+		if err := c.unmountRootfsOverlay(); err != nil {
+			c.Log.Warn().Err(err).Msg("failed to unmount rootfs overlay")
+		}
+		c.RootfsOverlay = ""
+		return err
+	}
+	c.Log.Info().Str("file", merged).Str("size", size).Msg("mounted rootfs overlay")
+	spec.Root.Path = merged
+	spec.Root.Readonly = false
+	return nil
+}
+
+// createRootfsOverlay mounts the overlayfs for the lower dir rootfs.
+// The upper dir root has the owner and permissions of the rootfs.
+func (c *Runtime) createRootfsOverlay(rootfs string, st *unix.Stat_t) (string, error) {
+	upper := filepath.Join(c.RootfsOverlay, "upper")
+	work := filepath.Join(c.RootfsOverlay, "work")
+	merged := filepath.Join(c.RootfsOverlay, "rootfs")
+
+	if err := os.Mkdir(upper, 0700); err != nil {
+		return "", err
+	}
+	if err := unix.Chown(upper, int(st.Uid), int(st.Gid)); err != nil {
+		return "", err
+	}
+	if err := unix.Chmod(upper, st.Mode&07777); err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(work, 0700); err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(merged, 0700); err != nil {
+		return "", err
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", rootfs, upper, work)
+	if err := unix.Mount("overlay", merged, "overlay", 0, opts); err != nil {
+		return "", fmt.Errorf("failed to mount overlay: %w", err)
+	}
+	return merged, nil
+}
+
+// unmountRootfsOverlay unmounts the rootfs overlay and the tmpfs, if a rootfs overlay was mounted.
+func (c ContainerInfo) unmountRootfsOverlay() error {
+	if c.RootfsOverlay == "" {
+		return nil
+	}
+	for _, p := range []string{filepath.Join(c.RootfsOverlay, "rootfs"), c.RootfsOverlay} {
+		err := unix.Unmount(p, unix.MNT_DETACH)
+		// EINVAL: not a mountpoint
+		if err != nil && err != unix.EINVAL && err != unix.ENOENT {
+			return fmt.Errorf("failed to unmount %s: %w", p, err)
+		}
+	}
+	return nil
+}
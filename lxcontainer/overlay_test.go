@@ -0,0 +1,81 @@
+package lxcontainer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestMountRootfsOverlay_disabled(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+
+	spec := &specs.Spec{Root: &specs.Root{Path: "/rootfs", Readonly: true}}
+	require.NoError(t, rt.mountRootfsOverlay(spec))
+	require.Equal(t, "/rootfs", spec.Root.Path)
+	require.Empty(t, rt.RootfsOverlay)
+
+	// ignored for a writable rootfs
+	spec = &specs.Spec{Root: &specs.Root{Path: "/rootfs"}, Annotations: map[string]string{RootfsOverlayAnnotation: "64m"}}
+	require.NoError(t, rt.mountRootfsOverlay(spec))
+	require.Equal(t, "/rootfs", spec.Root.Path)
+	require.Empty(t, rt.RootfsOverlay)
+
+	require.NoError(t, rt.unmountRootfsOverlay())
+}
+
+func TestMountRootfsOverlay_invalid(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+
+	for _, size := range []string{"", "64x", "-1", "64m,mode=0777"} {
+		spec := &specs.Spec{Root: &specs.Root{Path: "/rootfs", Readonly: true}, Annotations: map[string]string{RootfsOverlayAnnotation: size}}
+		require.Error(t, rt.mountRootfsOverlay(spec), size)
+	}
+
+	spec := &specs.Spec{Root: &specs.Root{Path: "/root,fs", Readonly: true}, Annotations: map[string]string{RootfsOverlayAnnotation: "64m"}}
+	require.Error(t, rt.mountRootfsOverlay(spec))
+	require.Empty(t, rt.RootfsOverlay)
+}
+
+func TestMountRootfsOverlay(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	require.NoError(t, os.MkdirAll(rt.RuntimePath(), 0700))
+
+	rootfs := filepath.Join(rt.RuntimeRoot, "rootfs")
+	require.NoError(t, os.MkdirAll(rootfs, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(rootfs, "image.txt"), []byte("image"), 0640))
+
+	spec := &specs.Spec{Root: &specs.Root{Path: rootfs, Readonly: true}, Annotations: map[string]string{RootfsOverlayAnnotation: "1m"}}
+	err := rt.mountRootfsOverlay(spec)
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("mount not permitted: %s", err)
+	}
+	require.NoError(t, err)
+	defer rt.unmountRootfsOverlay()
+
+	require.Equal(t, rt.RuntimePath(rootfsOverlayDir, "rootfs"), spec.Root.Path)
+	require.False(t, spec.Root.Readonly)
+
+	// the tmpfs is traversed by the mapped container root
+	info, err := os.Stat(rt.RuntimePath(rootfsOverlayDir))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0711), info.Mode().Perm())
+
+	// writes go to the overlay and the image is not changed
+	require.FileExists(t, filepath.Join(spec.Root.Path, "image.txt"))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(spec.Root.Path, "tmp.txt"), nil, 0640))
+	_, err = os.Stat(filepath.Join(rootfs, "tmp.txt"))
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, rt.unmountRootfsOverlay())
+	_, err = os.Stat(filepath.Join(spec.Root.Path, "image.txt"))
+	require.True(t, os.IsNotExist(err))
+}
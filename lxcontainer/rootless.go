@@ -0,0 +1,62 @@
+package lxcontainer
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// RootlessRuntimeRoot returns the default runtime root for an unprivileged runtime.
+func RootlessRuntimeRoot() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		return "", fmt.Errorf("XDG_RUNTIME_DIR is not set")
+	}
+	return filepath.Join(dir, "crio-lxc"), nil
+}
+
+// configureRootless adapts the runtime settings for an unprivileged runtime.
+// The ID mappings are allocated from the subordinate IDs of the calling user
+// and the features that require root are disabled.
+func (c *Runtime) configureRootless() error {
+	u, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("failed to lookup current user: %w", err)
+	}
+	c.UsernsUser = u.Username
+
+	if c.Apparmor {
+		c.Log.Warn().Msg("apparmor is not supported in rootless mode (disabled)")
+		c.Apparmor = false
+	}
+	if c.Selinux {
+		c.Log.Warn().Msg("selinux is not supported in rootless mode (disabled)")
+		c.Selinux = false
+	}
+	if c.CgroupDevices {
+		c.Log.Warn().Msg("cgroup device controller is not supported in rootless mode (access to all devices is granted)")
+		c.CgroupDevices = false
+	}
+	return nil
+}
+
+// rootlessCgroup returns the cgroup that is delegated to the user uid
+// by the systemd user instance and the controllers that are available in it.
+func rootlessCgroup(uid int) (cg string, controllers string, err error) {
+	cg = fmt.Sprintf("user.slice/user-%d.slice/user@%d.service", uid, uid)
+	var st unix.Stat_t
+	if err := unix.Stat(filepath.Join(cgroupRoot, cg, "cgroup.subtree_control"), &st); err != nil {
+		return "", "", fmt.Errorf("no cgroup delegated to user %d (systemd user session required): %w", uid, err)
+	}
+	if int(st.Uid) != uid {
+		return "", "", fmt.Errorf("cgroup %s is not delegated to user %d", cg, uid)
+	}
+	controllers, err = getControllers(cg)
+	if err != nil {
+		return "", "", err
+	}
+	return cg, controllers, nil
+}
@@ -0,0 +1,80 @@
+package lxcontainer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootlessRuntimeRoot(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	root, err := RootlessRuntimeRoot()
+	require.NoError(t, err)
+	require.Equal(t, "/run/user/1000/crio-lxc", root)
+
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	_, err = RootlessRuntimeRoot()
+	require.Error(t, err)
+}
+
+func TestConfigureRootless(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+
+	require.NoError(t, rt.configureRootless())
+	require.False(t, rt.Apparmor)
+	require.False(t, rt.Selinux)
+	require.False(t, rt.CgroupDevices)
+	require.True(t, rt.Seccomp)
+	require.True(t, rt.Capabilities)
+	require.NotEqual(t, DefaultUsernsUser, rt.UsernsUser)
+}
+
+func TestRootlessUserns(t *testing.T) {
+	root, err := ioutil.TempDir("", "crio-lxc-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	uidPath, gidPath := subuidPath, subgidPath
+	defer func() { subuidPath, subgidPath = uidPath, gidPath }()
+	subuidPath = filepath.Join(root, "subuid")
+	subgidPath = filepath.Join(root, "subgid")
+	require.NoError(t, ioutil.WriteFile(subuidPath, []byte("crio-lxc:100000:65536\n"), 0640))
+	require.NoError(t, ioutil.WriteFile(subgidPath, []byte("crio-lxc:200000:65536\n"), 0640))
+
+	rt, err := NewRuntime("c1", WithRuntimeRoot(root), WithUserns(false, "crio-lxc", 65536))
+	require.NoError(t, err)
+	rt.Rootless = true
+	require.NoError(t, os.MkdirAll(rt.RuntimePath(), 0700))
+
+	// ID mappings are allocated without --userns-auto
+	spec := &specs.Spec{Process: &specs.Process{}, Linux: &specs.Linux{}}
+	require.NoError(t, configureUserns(rt, spec))
+	require.Equal(t, []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: uint32(os.Geteuid()), Size: 1},
+		{ContainerID: 1, HostID: 100000, Size: 65536},
+	}, spec.Linux.UIDMappings)
+	require.Equal(t, []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: uint32(os.Getegid()), Size: 1},
+		{ContainerID: 1, HostID: 200000, Size: 65536},
+	}, spec.Linux.GIDMappings)
+	require.Equal(t, []specs.LinuxNamespace{{Type: specs.UserNamespace}}, spec.Linux.Namespaces)
+
+	// ID mappings from the spec are used
+	mappings := []specs.LinuxIDMapping{{ContainerID: 0, HostID: 300000, Size: 1000}}
+	spec = &specs.Spec{Process: &specs.Process{}, Linux: &specs.Linux{
+		UIDMappings: mappings,
+		GIDMappings: mappings,
+		Namespaces:  []specs.LinuxNamespace{{Type: specs.UserNamespace}},
+	}}
+	require.NoError(t, configureUserns(rt, spec))
+	require.Equal(t, mappings, spec.Linux.UIDMappings)
+
+	// a user namespace is required
+	spec.Linux.Namespaces = nil
+	require.Error(t, configureUserns(rt, spec))
+}
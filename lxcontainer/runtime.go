@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -20,15 +21,17 @@ import (
 var ErrNotExist = fmt.Errorf("container does not exist")
 var ErrExist = fmt.Errorf("container already exists")
 
+// Runtime manages a single container.
+// A Runtime must be created with NewRuntime.
 type Runtime struct {
-	Container *lxc.Container
+	// Backend is the container engine. LibLXC is used if Backend is nil.
+	Backend   Backend
+	Container Container
 	ContainerInfo
 
 	// [ global settings ]
-	LogFile           *os.File
-	LogFilePath       string
-	LogLevel          string
-	LogTimestamp      string
+	// ContainerLogFile is the path to the log file for the container process (liblxc).
+	ContainerLogFile  string
 	ContainerLogLevel string
 	SystemdCgroup     bool
 	MonitorCgroup     string
@@ -37,7 +40,29 @@ type Runtime struct {
 	InitCommand   string
 	ContainerHook string
 
+	// SeccompNotifyProxy is the path to the unix socket of a seccomp notify proxy (lxc.seccomp.notify.proxy).
+	// If set, the seccomp notifications are forwarded by the container monitor in the liblxc
+	// proxy message format, and the listenerPath from the container spec is ignored.
+	SeccompNotifyProxy string
+
+	// UsernsAuto enables the allocation of ID mappings from the subordinate IDs of UsernsUser for all containers.
+	// The allocation can be enabled per container with the annotation UsernsAnnotation.
+	UsernsAuto bool
+	// UsernsUser is the user in /etc/subuid and /etc/subgid whose subordinate IDs are allocated.
+	UsernsUser string
+	// UsernsSize is the number of user and group IDs allocated per pod.
+	UsernsSize uint32
+
+	// Rootless is set if the runtime is executed by an unprivileged user.
+	// In rootless mode a user namespace is mandatory and the cgroups are created
+	// within the cgroup delegated to the user by the systemd user instance.
+	Rootless bool
+
 	Log zerolog.Logger
+
+	// monitorExited is closed when the monitor process started by Create exits.
+	monitorExited chan struct{}
+	monitorState  *os.ProcessState
 }
 
 // createContainer creates a new container.
@@ -71,20 +96,45 @@ func (c *Runtime) createContainer(spec *specs.Spec) error {
 		c.CgroupDir = spec.Linux.CgroupsPath
 	}
 
-	c.MonitorCgroupDir = filepath.Join(c.MonitorCgroup, c.ContainerID+".scope")
+	cgroupParent := ""
+	controllers := allControllers
+	if c.Rootless {
+		if err := c.configureRootless(); err != nil {
+			return err
+		}
+		cgroupParent, controllers, err = rootlessCgroup(os.Geteuid())
+		if err != nil {
+			return err
+		}
+		c.MonitorCgroup = filepath.Join(cgroupParent, c.MonitorCgroup)
+	}
 
-	if err := createCgroup(filepath.Dir(c.CgroupDir), allControllers); err != nil {
+	if err := createCgroup(cgroupParent, filepath.Dir(c.CgroupDir), controllers); err != nil {
 		return err
 	}
+	c.CgroupDir = filepath.Join(cgroupParent, c.CgroupDir)
+	c.MonitorCgroupDir = filepath.Join(c.MonitorCgroup, c.ContainerID+".scope")
+
+	// The user namespace may be added to the spec.
+	if err := configureUserns(c, spec); err != nil {
+		return fmt.Errorf("failed to configure user namespace: %w", err)
+	}
+
+	if err := c.mountRootfsOverlay(spec); err != nil {
+		return fmt.Errorf("failed to mount rootfs overlay: %w", err)
+	}
 
 	c.Annotations = spec.Annotations
 	c.Namespaces = spec.Linux.Namespaces
 
 	if err := c.ContainerInfo.Create(); err != nil {
+		if err := c.unmountRootfsOverlay(); err != nil {
+			c.Log.Warn().Err(err).Msg("failed to unmount rootfs overlay")
+		}
 		return err
 	}
 
-	container, err := lxc.NewContainer(c.ContainerID, c.RuntimeRoot)
+	container, err := c.backend().NewContainer(c.ContainerID, c.RuntimeRoot)
 	if err != nil {
 		return err
 	}
@@ -92,8 +142,16 @@ func (c *Runtime) createContainer(spec *specs.Spec) error {
 	return c.setContainerLogLevel()
 }
 
+func (c *Runtime) backend() Backend {
+	if c.Backend == nil {
+		c.Backend = LibLXC{}
+	}
+	return c.Backend
+}
+
 // loadContainer checks for the existence of the lxc config file.
 // It returns an error if the config file does not exist.
+// A pod sandbox has no lxc config file and no container handle.
 func (c *Runtime) loadContainer() error {
 	if !c.runtimePathExists() {
 		return ErrNotExist
@@ -102,11 +160,18 @@ func (c *Runtime) loadContainer() error {
 	if err := c.ContainerInfo.Load(); err != nil {
 		return fmt.Errorf("failed to load container config: %w", err)
 	}
+	if c.Sandbox {
+		return nil
+	}
 
 	if _, err := os.Stat(c.ConfigFilePath()); err != nil {
 		return fmt.Errorf("failed to load lxc config file: %w", err)
 	}
-	container, err := lxc.NewContainer(c.ContainerID, c.RuntimeRoot)
+	// Reuse the container handle of a long-lived Runtime (e.g in the shim or the runtime daemon).
+	if c.Container != nil {
+		return c.setContainerLogLevel()
+	}
+	container, err := c.backend().NewContainer(c.ContainerID, c.RuntimeRoot)
 	if err != nil {
 		return fmt.Errorf("failed to create new lxc container: %w", err)
 	}
@@ -158,61 +223,15 @@ func (c *Runtime) configureCgroupPath() error {
 	return nil
 }
 
-// Release releases/closes allocated resources (lxc.Container, LogFile)
-func (c Runtime) Release() error {
-	if c.Container != nil {
-		if err := c.Container.Release(); err != nil {
-			c.Log.Error().Err(err).Msg("failed to release container")
-		}
-	}
-	if c.LogFile != nil {
-		return c.LogFile.Close()
-	}
-	return nil
-}
-
-func (c *Runtime) ConfigureLogging(cmdName string) error {
-	logDir := filepath.Dir(c.LogFilePath)
-	err := os.MkdirAll(logDir, 0750)
-	if err != nil {
-		return fmt.Errorf("failed to create log file directory %s: %w", logDir, err)
-	}
-
-	c.LogFile, err = os.OpenFile(c.LogFilePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
-	if err != nil {
-		return err
-	}
-
-	zerolog.LevelFieldName = "l"
-	zerolog.MessageFieldName = "m"
-
-	// match liblxc timestamp format
-	zerolog.TimestampFieldName = "t"
-	zerolog.TimeFieldFormat = c.LogTimestamp
-	zerolog.TimestampFunc = func() time.Time {
-		return time.Now().UTC()
-	}
-
-	// TODO only log caller information in debug and trace level
-	zerolog.CallerFieldName = "c"
-	zerolog.CallerMarshalFunc = func(file string, line int) string {
-		return filepath.Base(file) + ":" + strconv.Itoa(line)
-	}
-
-	// NOTE Unfortunately it's not possible change the possition of the timestamp.
-	// The ttimestamp is appended to the to the log output because it is dynamically rendered
-	// see https://github.com/rs/zerolog/issues/109
-	c.Log = zerolog.New(c.LogFile).With().Timestamp().Caller().
-		Str("cmd", cmdName).Str("cid", c.ContainerID).Logger()
-
-	level, err := zerolog.ParseLevel(strings.ToLower(c.LogLevel))
-	if err != nil {
-		level = zerolog.InfoLevel
-		c.Log.Warn().Err(err).Str("val", c.LogLevel).Stringer("default", level).
-			Msg("failed to parse log-level - fallback to default")
+// Release releases the container handle.
+// The Runtime can be used again after calling Release.
+func (c *Runtime) Release() error {
+	if c.Container == nil {
+		return nil
 	}
-	zerolog.SetGlobalLevel(level)
-	return nil
+	err := c.Container.Release()
+	c.Container = nil
+	return err
 }
 
 func (c *Runtime) setContainerLogLevel() error {
@@ -224,7 +243,7 @@ func (c *Runtime) setContainerLogLevel() error {
 	if err != nil {
 		return fmt.Errorf("failed to set container loglevel: %w", err)
 	}
-	if err := c.Container.SetLogFile(c.LogFilePath); err != nil {
+	if err := c.Container.SetLogFile(c.ContainerLogFile); err != nil {
 		return fmt.Errorf("failed to set container log file: %w", err)
 	}
 	return nil
@@ -358,11 +377,19 @@ func (c *Runtime) getContainerInitState() (specs.ContainerState, error) {
 func (c *Runtime) killContainer(ctx context.Context, signum unix.Signal) error {
 	c.Log.Info().Int("signum", int(signum)).Msg("killing container process")
 	if signum == unix.SIGKILL || signum == unix.SIGTERM {
-		if err := c.setConfigItem("lxc.signal.stop", strconv.Itoa(int(signum))); err != nil {
-			return err
-		}
-		if err := c.Container.Stop(); err != nil {
-			return err
+		if signum == unix.SIGTERM && isSystemContainer(c.Annotations) {
+			// The init system is halted with lxc.signal.halt (see configureHaltSignal).
+			// The timeout 0 returns immediately after the signal is sent.
+			if err := c.Container.Shutdown(0); err != nil {
+				return err
+			}
+		} else {
+			if err := c.setConfigItem("lxc.signal.stop", strconv.Itoa(int(signum))); err != nil {
+				return err
+			}
+			if err := c.Container.Stop(); err != nil {
+				return err
+			}
 		}
 
 		if !c.wait(ctx, lxc.STOPPED) {
@@ -373,12 +400,16 @@ func (c *Runtime) killContainer(ctx context.Context, signum unix.Signal) error {
 		// 'kill' e.g a bash for loop that spawns a new child immediately.
 		start := time.Now()
 		err := drainCgroup(ctx, c.CgroupDir, signum)
-		if err != nil && !os.IsNotExist(err) {
+		if os.IsNotExist(err) {
+			// the cgroup was already removed by liblxc
+			return nil
+		}
+		if err != nil {
 			c.Log.Warn().Err(err).Str("file", c.CgroupDir).Msg("failed to drain cgroup")
-		} else {
-			c.Log.Info().Dur("duration", time.Since(start)).Str("file", c.CgroupDir).Msg("cgroup drained")
+			return err
 		}
-		return err
+		c.Log.Info().Dur("duration", time.Since(start)).Str("file", c.CgroupDir).Msg("cgroup drained")
+		return nil
 	}
 
 	//  send non-terminating signals to monitor process
@@ -390,7 +421,7 @@ func (c *Runtime) killContainer(ctx context.Context, signum unix.Signal) error {
 		c.Log.Info().Int("pid", pid).Int("signal", int(signum)).Msg("sending signal")
 		if err := unix.Kill(pid, 0); err == nil {
 			err := unix.Kill(pid, signum)
-			if err != unix.ESRCH {
+			if err != nil && err != unix.ESRCH {
 				return fmt.Errorf("failed to send signal %d to container process %d: %w", signum, pid, err)
 			}
 		}
@@ -416,6 +447,14 @@ func (c *Runtime) destroy() error {
 		}
 	}
 
+	if err := c.unmountRootfsOverlay(); err != nil {
+		return err
+	}
+
+	if err := c.releaseSandboxNamespaces(); err != nil {
+		return err
+	}
+
 	return os.RemoveAll(c.RuntimePath())
 }
 
@@ -444,6 +483,8 @@ func (c *Runtime) saveConfig() error {
 	return nil
 }
 
+// Start starts the container process of a created container.
+// It returns when the container process is running or ctx is done.
 func (c *Runtime) Start(ctx context.Context) error {
 	c.Log.Info().Msg("notify init to start container process")
 
@@ -451,6 +492,10 @@ func (c *Runtime) Start(ctx context.Context) error {
 	if err != nil {
 		return errorf("failed to load container: %w", err)
 	}
+	if c.Sandbox {
+		// There is no container process to start.
+		return nil
+	}
 
 	state, err := c.getContainerState()
 	if err != nil {
@@ -502,6 +547,9 @@ func (c *Runtime) readFifo() error {
 	return nil
 }
 
+// Delete deletes the container and all resources created by the runtime.
+// A container that is not stopped is killed if force is true.
+// Deleting a non-existent container is not an error.
 func (c *Runtime) Delete(ctx context.Context, force bool) error {
 	err := c.loadContainer()
 	if err == ErrNotExist {
@@ -509,7 +557,11 @@ func (c *Runtime) Delete(ctx context.Context, force bool) error {
 		return nil
 	}
 	c.Log.Info().Bool("force", force).Msg("delete container")
-	if err == nil && !c.isContainerStopped() {
+	if err == nil && c.Sandbox {
+		if !force && c.sandboxState() != specs.StateStopped {
+			return errorf("pod sandbox is not stopped")
+		}
+	} else if err == nil && !c.isContainerStopped() {
 		if !force {
 			return errorf("container is not not stopped (current state %s)", c.Container.State())
 		}
@@ -520,14 +572,36 @@ func (c *Runtime) Delete(ctx context.Context, force bool) error {
 	if err := c.destroy(); err != nil {
 		return errorf("failed to destroy container: %w", err)
 	}
-	return nil
+	if err := pruneSeccompCache(c.RuntimeRoot); err != nil {
+		c.Log.Warn().Err(err).Msg("failed to prune seccomp profile cache")
+	}
+	if err := pruneUsernsAllocations(c.RuntimeRoot); err != nil {
+		c.Log.Warn().Err(err).Msg("failed to release ID mappings")
+	}
+	return c.Release()
 }
 
-func (c *Runtime) State() (*specs.State, error) {
+// State returns the OCI runtime state of the container.
+func (c *Runtime) State(ctx context.Context) (*specs.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	err := c.loadContainer()
 	if err != nil {
 		return nil, errorf("failed to load container: %w", err)
 	}
+	if c.Sandbox {
+		// A pod sandbox has no process, the pod containers join the pinned namespaces.
+		state := &specs.State{
+			Version:     specs.Version,
+			ID:          c.ContainerID,
+			Bundle:      c.BundlePath,
+			Status:      c.sandboxState(),
+			Annotations: c.Annotations,
+		}
+		c.Log.Info().Str("status", string(state.Status)).Msg("pod sandbox state")
+		return state, nil
+	}
 
 	pid, err := c.Pid()
 	if err != nil {
@@ -551,11 +625,25 @@ func (c *Runtime) State() (*specs.State, error) {
 	return state, nil
 }
 
+// Kill sends the signal signum to the container.
+// SIGKILL and SIGTERM stop the container and kill all processes in the container cgroup.
+// SIGTERM is replaced by SIGRTMIN+3 for a system container (see SystemContainerAnnotation).
+// Any other signal is sent to the container monitor process.
 func (c *Runtime) Kill(ctx context.Context, signum unix.Signal) error {
 	err := c.loadContainer()
 	if err != nil {
 		return errorf("failed to load container: %w", err)
 	}
+	if c.Sandbox {
+		// SIGKILL and SIGTERM stop the pod sandbox, other signals are ignored.
+		if signum != unix.SIGKILL && signum != unix.SIGTERM {
+			return nil
+		}
+		if err := c.releaseSandboxNamespaces(); err != nil {
+			return errorf("failed to release pod sandbox namespaces: %w", err)
+		}
+		return nil
+	}
 	state := c.Container.State()
 	if state != lxc.RUNNING {
 		return errorf("can only kill container in state lxc.RUNNING but was %q", state)
@@ -566,38 +654,136 @@ func (c *Runtime) Kill(ctx context.Context, signum unix.Signal) error {
 	return nil
 }
 
-func (c *Runtime) ExecDetached(args []string, proc *specs.Process) (pid int, err error) {
+// Pause freezes all processes in the container.
+func (c *Runtime) Pause(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := c.loadContainer()
+	if err != nil {
+		return errorf("failed to load container: %w", err)
+	}
+	if c.Sandbox {
+		return errorf("pod sandbox has no container process")
+	}
+	c.Log.Info().Msg("pause container")
+	if err := c.Container.Freeze(); err != nil {
+		return errorf("failed to freeze container: %w", err)
+	}
+	return nil
+}
+
+// Resume thaws all processes in a container paused by Pause.
+func (c *Runtime) Resume(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := c.loadContainer()
+	if err != nil {
+		return errorf("failed to load container: %w", err)
+	}
+	if c.Sandbox {
+		return errorf("pod sandbox has no container process")
+	}
+	c.Log.Info().Msg("resume container")
+	if err := c.Container.Unfreeze(); err != nil {
+		return errorf("failed to unfreeze container: %w", err)
+	}
+	return nil
+}
+
+// Pids returns the PIDs of all processes in the container cgroup.
+func (c *Runtime) Pids(ctx context.Context) ([]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.ContainerInfo.Load(); err != nil {
+		return nil, errorf("failed to load container info: %w", err)
+	}
+	pids, err := cgroupProcs(c.CgroupDir)
+	if err != nil {
+		return nil, errorf("failed to load cgroup procs: %w", err)
+	}
+	return pids, nil
+}
+
+// Wait waits for the container monitor process to exit and returns the exit status
+// of the container process. The exit status of a process terminated by a signal
+// is 128 + signal number.
+// Wait can only be called on the Runtime that created the container.
+func (c *Runtime) Wait(ctx context.Context) (exitStatus int, err error) {
+	if c.monitorExited == nil {
+		return -1, errorf("monitor process was not started by this runtime")
+	}
+	select {
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	case <-c.monitorExited:
+	}
+	ps := c.monitorState
+	if ps == nil {
+		return -1, errorf("failed to wait for monitor process")
+	}
+	if status, ok := ps.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), nil
+	}
+	return ps.ExitCode(), nil
+}
+
+// ExecDetached runs the command args with the process settings from proc in the container.
+// It returns the PID of the command without waiting for the command to complete.
+func (c *Runtime) ExecDetached(ctx context.Context, args []string, proc *specs.Process) (pid int, err error) {
+	return c.ExecDetachedStdio(ctx, args, proc, Stdio{})
+}
+
+// ExecDetachedStdio is like ExecDetached but the command uses the given stdio.
+func (c *Runtime) ExecDetachedStdio(ctx context.Context, args []string, proc *specs.Process, stdio Stdio) (pid int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	err = c.loadContainer()
 	if err != nil {
 		return 0, errorf("failed to load container: %w", err)
 	}
+	if c.Sandbox {
+		return 0, errorf("pod sandbox has no container process")
+	}
 
-	opts, err := attachOptions(proc, c.Namespaces)
+	cmd, opts, err := c.execOptions(args, proc, stdio)
 	if err != nil {
-		return 0, errorf("failed to create attach options: %w", err)
+		return 0, err
 	}
 
-	c.Log.Info().Strs("args", args).
-		Int("uid", opts.UID).Int("gid", opts.GID).
-		Ints("groups", opts.Groups).Msg("execute cmd")
-
-	pid, err = c.Container.RunCommandNoWait(args, opts)
+	pid, err = c.Container.RunCommandNoWait(cmd, opts)
 	if err != nil {
 		return pid, errorf("failed to run exec cmd detached: %w", err)
 	}
 	return pid, nil
 }
 
-func (c *Runtime) Exec(args []string, proc *specs.Process) (exitStatus int, err error) {
+// Exec runs the command args with the process settings from proc in the container.
+// It waits for the command to complete and returns the exit status of the command.
+func (c *Runtime) Exec(ctx context.Context, args []string, proc *specs.Process) (exitStatus int, err error) {
+	return c.ExecStdio(ctx, args, proc, Stdio{})
+}
+
+// ExecStdio is like Exec but the command uses the given stdio.
+func (c *Runtime) ExecStdio(ctx context.Context, args []string, proc *specs.Process, stdio Stdio) (exitStatus int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	err = c.loadContainer()
 	if err != nil {
 		return 0, errorf("failed to load container: %w", err)
 	}
-	opts, err := attachOptions(proc, c.Namespaces)
+	if c.Sandbox {
+		return 0, errorf("pod sandbox has no container process")
+	}
+	cmd, opts, err := c.execOptions(args, proc, stdio)
 	if err != nil {
-		return 0, errorf("failed to create attach options: %w", err)
+		return 0, err
 	}
-	exitStatus, err = c.Container.RunCommandStatus(args, opts)
+	exitStatus, err = c.Container.RunCommandStatus(cmd, opts)
 	if err != nil {
 		return exitStatus, errorf("failed to run exec cmd: %w", err)
 	}
@@ -627,12 +813,12 @@ func (c *Runtime) setConfigItem(key, value string) error {
 }
 
 func (c *Runtime) supportsConfigItem(keys ...string) bool {
-	canCheck := lxc.VersionAtLeast(4, 0, 6)
+	canCheck := c.backend().VersionAtLeast(4, 0, 6)
 	if !canCheck {
 		c.Log.Warn().Msg("lxc.IsSupportedConfigItem is broken in liblxc < 4.0.6")
 	}
 	for _, key := range keys {
-		if canCheck && lxc.IsSupportedConfigItem(key) {
+		if canCheck && c.backend().IsSupportedConfigItem(key) {
 			continue
 		}
 		c.Log.Info().Str("lxc.config", key).Msg("unsupported config item")
@@ -641,11 +827,37 @@ func (c *Runtime) supportsConfigItem(keys ...string) bool {
 	return true
 }
 
-func attachOptions(procSpec *specs.Process, ns []specs.LinuxNamespace) (lxc.AttachOptions, error) {
+// execOptions returns the command and the attach options for an exec process.
+func (c *Runtime) execOptions(args []string, proc *specs.Process, stdio Stdio) ([]string, lxc.AttachOptions, error) {
+	cmd, helper, switchUser, err := c.execCommand(args, proc)
+	if err != nil {
+		return nil, lxc.AttachOptions{}, errorf("invalid exec process: %w", err)
+	}
+	opts, err := attachOptions(proc, c.Namespaces, stdio)
+	if err != nil {
+		return nil, opts, errorf("failed to create attach options: %w", err)
+	}
+	if switchUser {
+		// the exec helper switches to the process user
+		opts.UID = 0
+		opts.GID = 0
+		opts.Groups = nil
+	}
+
+	log := c.Log.Info().Strs("args", args).Bool("helper", helper).Bool("switch-user", switchUser)
+	if proc != nil {
+		log = log.Uint32("uid", proc.User.UID).Uint32("gid", proc.User.GID).
+			Uints32("groups", proc.User.AdditionalGids)
+	}
+	log.Msg("execute cmd")
+	return cmd, opts, nil
+}
+
+func attachOptions(procSpec *specs.Process, ns []specs.LinuxNamespace, stdio Stdio) (lxc.AttachOptions, error) {
 	opts := lxc.AttachOptions{
-		StdinFd:  0,
-		StdoutFd: 1,
-		StderrFd: 2,
+		StdinFd:  stdio.stdin().Fd(),
+		StdoutFd: stdio.stdout().Fd(),
+		StderrFd: stdio.stderr().Fd(),
 	}
 
 	clone, err := cloneFlags(ns)
@@ -672,9 +884,10 @@ func attachOptions(procSpec *specs.Process, ns []specs.LinuxNamespace) (lxc.Atta
 	return opts, nil
 }
 
-func ReadSpec(src string) (spec *specs.Spec, err error) {
-	err = decodeFileJSON(spec, src)
-	return
+func ReadSpec(src string) (*specs.Spec, error) {
+	spec := new(specs.Spec)
+	err := decodeFileJSON(spec, src)
+	return spec, err
 }
 
 func ReadSpecProcess(src string) (*specs.Process, error) {
@@ -0,0 +1,375 @@
+package lxcontainer
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+// testInitEnv is set in the environment of a fake container init process.
+const testInitEnv = "CRIO_LXC_TEST_INIT"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testInitEnv) != "" {
+		// Fake container init process started by startFakeInit.
+		// It blocks until it receives a signal. The systemd halt signal is ignored
+		// by the Go runtime, so it is reported by the exit status 128+signum.
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, systemdHaltSignal)
+		// notify startFakeInit that the signal handler is installed
+		os.Stdout.Write([]byte{'\n'})
+		sig := <-sigc
+		os.Exit(128 + int(sig.(unix.Signal)))
+	}
+	os.Exit(m.Run())
+}
+
+// startFakeInit starts a process with the cmdline of a container init process
+// that waits for the start command.
+func startFakeInit(t *testing.T, containerID string) *exec.Cmd {
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	cmd := &exec.Cmd{
+		Path: exe,
+		Args: []string{"/.crio-lxc/init", containerID},
+		Env:  []string{testInitEnv + "=1"},
+	}
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	_, err = stdout.Read(make([]byte, 1))
+	require.NoError(t, err)
+	return cmd
+}
+
+func stopFakeInit(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+func newTestRuntime(t *testing.T) (*Runtime, *fakeBackend) {
+	root, err := ioutil.TempDir("", "crio-lxc-test")
+	require.NoError(t, err)
+
+	backend := newFakeBackend()
+	rt, err := NewRuntime("testcontainer", WithBackend(backend), WithRuntimeRoot(root))
+	require.NoError(t, err)
+	rt.PidFile = filepath.Join(root, "testcontainer.pid")
+	// The cgroup must not exist, the cgroup is drained on kill.
+	rt.CgroupDir = "crio-lxc-test.slice/" + filepath.Base(root) + ".scope"
+	return rt, backend
+}
+
+// createTestContainer creates the runtime files that are left behind by Create.
+func createTestContainer(t *testing.T, rt *Runtime, backend *fakeBackend) *fakeContainer {
+	require.NoError(t, os.MkdirAll(rt.RuntimePath(initDir), 0700))
+	require.NoError(t, rt.ContainerInfo.Create())
+	require.NoError(t, ioutil.WriteFile(rt.ConfigFilePath(), nil, 0640))
+	require.NoError(t, createFifo(rt.syncFifoPath(), os.Getuid(), os.Getgid(), 0600))
+	c, err := backend.NewContainer(rt.ContainerID, rt.RuntimeRoot)
+	require.NoError(t, err)
+	return c.(*fakeContainer)
+}
+
+func TestRuntimeState_notExist(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+
+	_, err := rt.State(context.Background())
+	require.True(t, errors.Is(err, ErrNotExist))
+}
+
+func TestRuntimeState(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+
+	init := startFakeInit(t, rt.ContainerID)
+	defer stopFakeInit(init)
+	require.NoError(t, CreatePidFile(rt.PidFile, init.Process.Pid))
+
+	c.setInit(lxc.RUNNING, init.Process.Pid)
+	state, err := rt.State(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, specs.StateCreated, state.Status)
+	require.Equal(t, rt.ContainerID, state.ID)
+	require.Equal(t, init.Process.Pid, state.Pid)
+
+	c.setInit(lxc.RUNNING, os.Getpid())
+	state, err = rt.State(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, specs.StateRunning, state.Status)
+
+	c.setInit(lxc.STARTING, -1)
+	state, err = rt.State(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, specs.StateCreating, state.Status)
+
+	c.setInit(lxc.STOPPED, -1)
+	state, err = rt.State(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, specs.StateStopped, state.Status)
+}
+
+func TestRuntimeStart(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+
+	init := startFakeInit(t, rt.ContainerID)
+	defer stopFakeInit(init)
+	c.setInit(lxc.RUNNING, init.Process.Pid)
+
+	// Act like crio-lxc-init: write the container ID to the syncfifo
+	// and execute the container process.
+	done := make(chan error, 1)
+	go func() {
+		f, err := os.OpenFile(rt.syncFifoPath(), os.O_WRONLY, 0)
+		if err != nil {
+			done <- err
+			return
+		}
+		c.setInit(lxc.RUNNING, os.Getpid())
+		_, err = f.WriteString(rt.ContainerID)
+		f.Close()
+		done <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, rt.Start(ctx))
+	require.NoError(t, <-done)
+
+	state, err := rt.getContainerState()
+	require.NoError(t, err)
+	require.Equal(t, specs.StateRunning, state)
+}
+
+func TestRuntimeStart_invalidState(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c.setInit(lxc.STOPPED, -1)
+	require.Error(t, rt.Start(ctx))
+
+	c.setInit(lxc.RUNNING, os.Getpid())
+	require.Error(t, rt.Start(ctx))
+}
+
+func TestRuntimeStart_timeout(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+
+	init := startFakeInit(t, rt.ContainerID)
+	defer stopFakeInit(init)
+	c.setInit(lxc.RUNNING, init.Process.Pid)
+
+	// nobody writes to the syncfifo
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	err := rt.Start(ctx)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestRuntimeKill(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c.setInit(lxc.STOPPED, -1)
+	require.Error(t, rt.Kill(ctx, unix.SIGTERM))
+
+	c.setInit(lxc.RUNNING, os.Getpid())
+	require.NoError(t, rt.Kill(ctx, unix.SIGTERM))
+	require.Equal(t, lxc.STOPPED, c.State())
+	require.Equal(t, []string{"15"}, c.ConfigItem("lxc.signal.stop"))
+}
+
+func TestRuntimeKill_signal(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+
+	// Non-terminating signals are sent to the monitor process.
+	monitor := startFakeInit(t, rt.ContainerID)
+	defer stopFakeInit(monitor)
+	require.NoError(t, CreatePidFile(rt.PidFile, monitor.Process.Pid))
+	c.setInit(lxc.RUNNING, os.Getpid())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, rt.Kill(ctx, unix.SIGHUP))
+
+	err := monitor.Wait()
+	require.Error(t, err)
+	status := monitor.ProcessState.Sys().(syscall.WaitStatus)
+	require.True(t, status.Signaled())
+	require.Equal(t, unix.SIGHUP, status.Signal())
+	require.Equal(t, lxc.RUNNING, c.State())
+}
+
+func TestRuntimeDelete(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// deleting a non-existent container is not an error
+	require.NoError(t, rt.Delete(ctx, false))
+
+	c := createTestContainer(t, rt, backend)
+	c.setInit(lxc.RUNNING, os.Getpid())
+	require.Error(t, rt.Delete(ctx, false))
+	require.False(t, c.destroyed)
+
+	require.NoError(t, rt.Delete(ctx, true))
+	require.True(t, c.destroyed)
+	require.Equal(t, lxc.STOPPED, c.State())
+	require.False(t, rt.runtimePathExists())
+}
+
+func TestRuntimeExec(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	// all process settings are applied by liblxc
+	rt.Capabilities = false
+	c := createTestContainer(t, rt, backend)
+
+	proc := &specs.Process{
+		Args: []string{"/bin/true"},
+		Env:  []string{"PATH=/bin"},
+		Cwd:  "/tmp",
+		User: specs.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{10, 11}},
+	}
+
+	c.setInit(lxc.STOPPED, -1)
+	_, err := rt.Exec(context.Background(), proc.Args, proc)
+	require.Error(t, err)
+
+	c.setInit(lxc.RUNNING, os.Getpid())
+	c.execStatus = 3
+	status, err := rt.Exec(context.Background(), proc.Args, proc)
+	require.NoError(t, err)
+	require.Equal(t, 3, status)
+	require.Equal(t, [][]string{proc.Args}, c.execArgs)
+
+	opts := c.execOpts[0]
+	require.Equal(t, "/tmp", opts.Cwd)
+	require.Equal(t, proc.Env, opts.Env)
+	require.True(t, opts.ClearEnv)
+	require.Equal(t, 1000, opts.UID)
+	require.Equal(t, 1000, opts.GID)
+	require.Equal(t, []int{10, 11}, opts.Groups)
+}
+
+func TestRuntimeExec_helper(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	c.setInit(lxc.RUNNING, os.Getpid())
+
+	proc := &specs.Process{
+		Args:            []string{"/bin/true"},
+		Cwd:             "/tmp",
+		User:            specs.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{10, 11}},
+		NoNewPrivileges: true,
+	}
+	_, err := rt.Exec(context.Background(), proc.Args, proc)
+	require.NoError(t, err)
+	// the process has no capabilities (lxc.cap.keep is unset), so liblxc sets the user
+	require.Equal(t, [][]string{{"/.crio-lxc/init", "--exec", "-n", "--", "/bin/true"}}, c.execArgs)
+
+	opts := c.execOpts[0]
+	require.Equal(t, "/tmp", opts.Cwd)
+	require.Equal(t, 1000, opts.UID)
+	require.Equal(t, 1000, opts.GID)
+	require.Equal(t, []int{10, 11}, opts.Groups)
+
+	// the exec helper switches to the user to raise the ambient capabilities
+	require.NoError(t, c.SetConfigItem("lxc.cap.keep", "net_bind_service setgid setuid"))
+	bind := []string{"CAP_NET_BIND_SERVICE"}
+	proc.Capabilities = &specs.LinuxCapabilities{Bounding: []string{"CAP_NET_BIND_SERVICE", "CAP_SETGID", "CAP_SETUID"},
+		Effective: bind, Permitted: bind, Inheritable: bind, Ambient: bind}
+	_, err = rt.Exec(context.Background(), proc.Args, proc)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/.crio-lxc/init", "--exec", "-u", "1000:1000:10,11", "-c", "4c0:400:400:400:400", "-n", "--", "/bin/true"}, c.execArgs[1])
+	opts = c.execOpts[1]
+	require.Equal(t, 0, opts.UID)
+	require.Equal(t, 0, opts.GID)
+	require.Empty(t, opts.Groups)
+
+	proc.Scheduler = &specs.Scheduler{Policy: specs.SchedOther}
+	_, err = rt.Exec(context.Background(), proc.Args, proc)
+	require.Error(t, err)
+	require.Len(t, c.execArgs, 2)
+}
+
+func TestRuntimePauseResume(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+
+	ctx := context.Background()
+	c.setInit(lxc.STOPPED, -1)
+	require.Error(t, rt.Pause(ctx))
+
+	c.setInit(lxc.RUNNING, os.Getpid())
+	require.NoError(t, rt.Pause(ctx))
+	require.Equal(t, lxc.FROZEN, c.State())
+	require.NoError(t, rt.Resume(ctx))
+	require.Equal(t, lxc.RUNNING, c.State())
+	require.Error(t, rt.Resume(ctx))
+}
+
+func TestRuntimeWait_notCreated(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+
+	_, err := rt.Wait(context.Background())
+	require.Error(t, err)
+}
+
+func TestRuntimeExecDetachedStdio(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	c.setInit(lxc.RUNNING, os.Getpid())
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	proc := &specs.Process{Args: []string{"/bin/true"}}
+	pid, err := rt.ExecDetachedStdio(context.Background(), proc.Args, proc, Stdio{Stdin: r, Stdout: w})
+	require.NoError(t, err)
+	require.Equal(t, os.Getpid(), pid)
+
+	opts := c.execOpts[0]
+	require.Equal(t, r.Fd(), opts.StdinFd)
+	require.Equal(t, w.Fd(), opts.StdoutFd)
+	require.Equal(t, os.Stderr.Fd(), opts.StderrFd)
+}
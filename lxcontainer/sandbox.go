@@ -0,0 +1,210 @@
+package lxcontainer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// CRI-O annotations that identify the infra container of a pod.
+const (
+	containerTypeAnnotation    = "io.kubernetes.cri-o.ContainerType"
+	containerTypeSandbox       = "sandbox"
+	namespaceOptionsAnnotation = "io.kubernetes.cri-o.NamespaceOptions"
+)
+
+// sandboxNamespaceDir is the directory within the runtime directory
+// where the namespaces of a pod sandbox are pinned (bind mounted).
+const sandboxNamespaceDir = "ns"
+
+// criNamespaceModePod is the CRI NamespaceMode POD.
+// A pid namespace with mode POD is shared by all containers of the pod.
+const criNamespaceModePod = 0
+
+// isPodSandbox returns true if the container is the infra container of a pod.
+func isPodSandbox(spec *specs.Spec) bool {
+	return spec.Annotations[containerTypeAnnotation] == containerTypeSandbox
+}
+
+// canPinNamespaces returns an error if the pod sandbox requires a container process.
+// The namespaces of a pod sandbox without a container process are created (unshared)
+// by the runtime, which can not create or join a user namespace (the runtime is multithreaded),
+// and a shared pid namespace requires an init process that reaps the orphaned processes of the pod.
+func (c *Runtime) canPinNamespaces(spec *specs.Spec) error {
+	if c.Rootless {
+		return fmt.Errorf("rootless mode requires a user namespace")
+	}
+	if c.usernsAuto(spec) || getNamespace(specs.UserNamespace, spec.Linux.Namespaces) != nil {
+		return fmt.Errorf("user namespace is not supported")
+	}
+	if ns := getNamespace(specs.PIDNamespace, spec.Linux.Namespaces); ns != nil && ns.Path == "" {
+		var opts struct {
+			Pid int `json:"pid"`
+		}
+		// The CRI namespace options are only set by CRI-O.
+		val, exist := spec.Annotations[namespaceOptionsAnnotation]
+		if !exist {
+			return fmt.Errorf("missing annotation %s", namespaceOptionsAnnotation)
+		}
+		if err := json.Unmarshal([]byte(val), &opts); err != nil {
+			return fmt.Errorf("failed to parse annotation %s: %w", namespaceOptionsAnnotation, err)
+		}
+		if opts.Pid == criNamespaceModePod {
+			return fmt.Errorf("pid namespace is shared by the pod")
+		}
+	}
+	return nil
+}
+
+// createSandbox creates a pod sandbox without a container process.
+// The network, IPC and UTS namespaces are created and pinned within the runtime directory,
+// and the (empty) container cgroup is created. New namespaces of other types are not created,
+// since there is no process that could use them.
+func (c *Runtime) createSandbox(spec *specs.Spec) (err error) {
+	if c.runtimePathExists() {
+		return ErrExist
+	}
+
+	if err := os.MkdirAll(c.RuntimePath(sandboxNamespaceDir), 0700); err != nil {
+		return fmt.Errorf("failed to create namespace dir: %w", err)
+	}
+	// The pinned namespaces are accessed by the pod containers.
+	// #nosec
+	if err := os.Chmod(c.RuntimePath(), 0711); err != nil {
+		return err
+	}
+
+	if spec.Linux.CgroupsPath == "" {
+		return fmt.Errorf("empty cgroups path in spec")
+	}
+	if c.SystemdCgroup {
+		c.CgroupDir = parseSystemdCgroupPath(spec.Linux.CgroupsPath)
+	} else {
+		c.CgroupDir = spec.Linux.CgroupsPath
+	}
+	if err := createCgroup("", filepath.Dir(c.CgroupDir), allControllers); err != nil {
+		return fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	// #nosec
+	if err := os.Mkdir(filepath.Join(cgroupRoot, c.CgroupDir), 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	c.Sandbox = true
+	c.Namespaces = nil
+	defer func() {
+		if err == nil {
+			return
+		}
+		if err := c.releaseSandboxNamespaces(); err != nil {
+			c.Log.Warn().Err(err).Msg("failed to release pod sandbox namespaces")
+		}
+	}()
+
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Path != "" {
+			if ns.Type == specs.UTSNamespace && spec.Hostname != "" {
+				if err := setHostname(ns.Path, spec.Hostname); err != nil {
+					return fmt.Errorf("failed to set hostname: %w", err)
+				}
+			}
+			c.Namespaces = append(c.Namespaces, ns)
+			continue
+		}
+		switch ns.Type {
+		case specs.NetworkNamespace, specs.IPCNamespace, specs.UTSNamespace:
+			dst := c.RuntimePath(sandboxNamespaceDir, namespaceMap[ns.Type].Name)
+			// added before pinning, so that it is released on error
+			c.Namespaces = append(c.Namespaces, specs.LinuxNamespace{Type: ns.Type, Path: dst})
+			if err := pinNamespace(ns.Type, dst, spec.Hostname); err != nil {
+				return fmt.Errorf("failed to pin %s namespace: %w", ns.Type, err)
+			}
+			c.Log.Debug().Str("file", dst).Str("ns", string(ns.Type)).Msg("pinned namespace")
+		default:
+			c.Log.Debug().Str("ns", string(ns.Type)).Msg("namespace is not created for pod sandbox")
+		}
+	}
+
+	c.Annotations = spec.Annotations
+	return c.ContainerInfo.Create()
+}
+
+// pinNamespace creates a new namespace of type nsType and bind mounts it to dst.
+// The hostname is set in a new UTS namespace.
+func pinNamespace(nsType specs.LinuxNamespaceType, dst string, hostname string) error {
+	if err := touchFile(dst, 0400); err != nil {
+		return err
+	}
+	errc := make(chan error, 1)
+	go func() {
+		// unshare only affects the current thread
+		runtime.LockOSThread()
+		errc <- unshareAndPin(nsType, dst, hostname)
+	}()
+	return <-errc
+}
+
+// unshareAndPin must be called on a locked thread. The thread is unlocked if it
+// is switched back to its original namespace, otherwise the thread is terminated
+// when the goroutine returns.
+func unshareAndPin(nsType specs.LinuxNamespaceType, dst string, hostname string) error {
+	n := namespaceMap[nsType]
+	nsPath := fmt.Sprintf("/proc/self/task/%d/ns/%s", unix.Gettid(), n.Name)
+	orig, err := os.Open(nsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s namespace: %w", n.Name, err)
+	}
+	// #nosec
+	defer orig.Close()
+
+	if err := unix.Unshare(n.CloneFlag); err != nil {
+		return fmt.Errorf("unshare failed: %w", err)
+	}
+	defer func() {
+		if err := unix.Setns(int(orig.Fd()), n.CloneFlag); err == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	if nsType == specs.UTSNamespace && hostname != "" {
+		if err := unix.Sethostname([]byte(hostname)); err != nil {
+			return fmt.Errorf("unix.Sethostname failed: %w", err)
+		}
+	}
+	return unix.Mount(nsPath, dst, "", unix.MS_BIND, "")
+}
+
+// sandboxState returns the state of a pod sandbox.
+// The sandbox is running until the pinned namespaces are released.
+func (c *Runtime) sandboxState() specs.ContainerState {
+	if _, err := os.Stat(c.RuntimePath(sandboxNamespaceDir)); err == nil {
+		return specs.StateRunning
+	}
+	return specs.StateStopped
+}
+
+// releaseSandboxNamespaces unmounts and removes the pinned namespaces of a pod sandbox.
+// The namespaces are destroyed by the kernel when they are no longer used by the pod containers.
+func (c *Runtime) releaseSandboxNamespaces() error {
+	if !c.Sandbox {
+		return nil
+	}
+	dir := c.RuntimePath(sandboxNamespaceDir)
+	for _, ns := range c.Namespaces {
+		if filepath.Dir(ns.Path) != dir {
+			continue
+		}
+		err := unix.Unmount(ns.Path, unix.MNT_DETACH)
+		// EINVAL: not a mountpoint
+		if err != nil && err != unix.EINVAL && err != unix.ENOENT {
+			return fmt.Errorf("failed to unmount %s: %w", ns.Path, err)
+		}
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,97 @@
+package lxcontainer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestIsPodSandbox(t *testing.T) {
+	require.True(t, isPodSandbox(&specs.Spec{Annotations: map[string]string{containerTypeAnnotation: "sandbox"}}))
+	require.False(t, isPodSandbox(&specs.Spec{Annotations: map[string]string{containerTypeAnnotation: "container"}}))
+	require.False(t, isPodSandbox(&specs.Spec{}))
+}
+
+func TestCanPinNamespaces(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+
+	spec := &specs.Spec{Linux: &specs.Linux{Namespaces: []specs.LinuxNamespace{
+		{Type: specs.NetworkNamespace}, {Type: specs.IPCNamespace}, {Type: specs.UTSNamespace}, {Type: specs.MountNamespace},
+	}}}
+	require.NoError(t, rt.canPinNamespaces(spec))
+
+	// a new pid namespace requires the CRI namespace options
+	spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.PIDNamespace})
+	require.Error(t, rt.canPinNamespaces(spec))
+	spec.Annotations = map[string]string{namespaceOptionsAnnotation: `{"pid":1}`}
+	require.NoError(t, rt.canPinNamespaces(spec))
+	// pid namespace is shared by the pod (mode POD)
+	spec.Annotations = map[string]string{namespaceOptionsAnnotation: `{}`}
+	require.Error(t, rt.canPinNamespaces(spec))
+	spec.Annotations = map[string]string{namespaceOptionsAnnotation: `{"pid":1}`}
+
+	spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.UserNamespace, Path: "/proc/1/ns/user"})
+	require.Error(t, rt.canPinNamespaces(spec))
+	spec.Linux.Namespaces = spec.Linux.Namespaces[:len(spec.Linux.Namespaces)-1]
+
+	rt.UsernsAuto = true
+	require.Error(t, rt.canPinNamespaces(spec))
+	rt.UsernsAuto = false
+
+	rt.Rootless = true
+	require.Error(t, rt.canPinNamespaces(spec))
+}
+
+func TestSandboxLifecycle(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	require.NoError(t, os.MkdirAll(rt.RuntimePath(sandboxNamespaceDir), 0700))
+
+	netns := rt.RuntimePath(sandboxNamespaceDir, "net")
+	err := pinNamespace(specs.NetworkNamespace, netns, "")
+	if errors.Is(err, unix.EPERM) {
+		t.Skipf("unshare not permitted: %s", err)
+	}
+	require.NoError(t, err)
+	utsns := rt.RuntimePath(sandboxNamespaceDir, "uts")
+	require.NoError(t, pinNamespace(specs.UTSNamespace, utsns, "sandbox"))
+
+	// the pinned namespaces are new namespaces
+	for _, ns := range []string{"net", "uts"} {
+		same, err := isSameNamespace(rt.RuntimePath(sandboxNamespaceDir, ns), "/proc/self/ns/"+ns)
+		require.NoError(t, err)
+		require.False(t, same, ns)
+	}
+
+	rt.Sandbox = true
+	rt.Namespaces = []specs.LinuxNamespace{{Type: specs.NetworkNamespace, Path: netns}, {Type: specs.UTSNamespace, Path: utsns}}
+	require.NoError(t, rt.ContainerInfo.Create())
+
+	ctx := context.Background()
+	require.NoError(t, rt.Start(ctx))
+	state, err := rt.State(ctx)
+	require.NoError(t, err)
+	require.Equal(t, specs.StateRunning, state.Status)
+	require.Equal(t, 0, state.Pid)
+
+	_, err = rt.Exec(ctx, []string{"true"}, &specs.Process{})
+	require.Error(t, err)
+	require.Error(t, rt.Delete(ctx, false))
+
+	// signals other than SIGKILL and SIGTERM are ignored
+	require.NoError(t, rt.Kill(ctx, unix.SIGHUP))
+	require.NoError(t, rt.Kill(ctx, unix.SIGKILL))
+	state, err = rt.State(ctx)
+	require.NoError(t, err)
+	require.Equal(t, specs.StateStopped, state.Status)
+
+	require.NoError(t, rt.Delete(ctx, false))
+	_, err = os.Stat(rt.RuntimePath())
+	require.True(t, os.IsNotExist(err))
+}
@@ -2,28 +2,53 @@ package lxcontainer
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"strings"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rs/zerolog"
+	"gopkg.in/lxc/go-lxc.v2"
 )
 
+// The liblxc seccomp profile format supports only the actions kill (thread), trap, errno and allow
+// and notify (if liblxc is compiled with seccomp notify support).
+// The other OCI actions are mapped to the closest supported action,
+// if the mapped action does not weaken the profile.
 var seccompAction = map[specs.LinuxSeccompAction]string{
-	specs.ActKill:  "kill",
-	specs.ActTrap:  "trap",
-	specs.ActErrno: "errno",
-	specs.ActAllow: "allow",
-	//specs.ActTrace: "trace",
-	//specs.ActLog: "log",
-	//specs.ActKillProcess: "kill_process",
-}
-
-// Note seccomp flags (see `man 2 seccomp`) are currently not supported
-// https://github.com/opencontainers/runtime-spec/blob/v1.0.2/config-linux.md#seccomp
-func writeSeccompProfile(profilePath string, seccomp *specs.LinuxSeccomp) error {
+	specs.ActKill:       "kill",
+	specs.ActKillThread: "kill",
+	specs.ActTrap:       "trap",
+	specs.ActErrno:      "errno",
+	specs.ActAllow:      "allow",
+	// Requires liblxc with seccomp notify support (see configureSeccompNotify)
+	specs.ActNotify: "notify",
+	// The syscall is allowed but not logged.
+	specs.ActLog: "allow",
+	// Without a tracer attached the kernel fails the syscall with ENOSYS (see `man 2 seccomp`).
+	// A tracer attached to the container process is not notified.
+	specs.ActTrace: "errno",
+}
+
+// seccompFallback is the log message for actions that are not supported by liblxc.
+var seccompFallback = map[specs.LinuxSeccompAction]string{
+	specs.ActLog:   "log is not supported by liblxc - fallback to allow (syscall is not logged)",
+	specs.ActTrace: "trace is not supported by liblxc - fallback to errno ENOSYS",
+}
+
+// seccompErrno is the errno returned by the errno action if the errno is not set.
+const seccompErrno = uint(unix.EPERM)
+
+// writeSeccompProfile writes the liblxc seccomp profile for the given seccomp spec.
+// https://github.com/opencontainers/runtime-spec/blob/v1.1.0/config-linux.md#seccomp
+func writeSeccompProfile(profilePath string, seccomp *specs.LinuxSeccomp, log zerolog.Logger) error {
 	// #nosec
 	profile, err := os.OpenFile(profilePath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0440)
 	if err != nil {
@@ -37,23 +62,34 @@ func writeSeccompProfile(profilePath string, seccomp *specs.LinuxSeccomp) error
 	// #nosec
 	w.WriteString("2\n")
 
-	action, err := defaultAction(seccomp)
-	if err != nil {
+	if err := checkSeccompFlags(seccomp.Flags, log); err != nil {
 		return err
 	}
+	if seccomp.DefaultAction == specs.ActNotify {
+		return fmt.Errorf("seccomp action %q can not be used as default action", seccomp.DefaultAction)
+	}
+	action, err := seccompActionString(seccomp.DefaultAction, seccomp.DefaultErrnoRet, log)
+	if err != nil {
+		return fmt.Errorf("invalid seccomp default action: %w", err)
+	}
 	fmt.Fprintf(w, "allowlist %s\n", action)
 
-	platformArchs, err := seccompArchs(seccomp)
+	platformArchs, err := seccompArchs(seccomp, log)
 	if err != nil {
-		return fmt.Errorf("failed to detect platform architecture: %w", err)
+		return fmt.Errorf("failed to detect seccomp architectures: %w", err)
+	}
+	// The same rules are written to every architecture section.
+	// liblxc resolves the syscall names for each architecture.
+	var rules bytes.Buffer
+	for _, sc := range seccomp.Syscalls {
+		if err := writeSeccompSyscall(&rules, sc, log); err != nil {
+			return err
+		}
 	}
 	for _, arch := range platformArchs {
 		fmt.Fprintf(w, "[%s]\n", arch)
-		for _, sc := range seccomp.Syscalls {
-			if err := writeSeccompSyscall(w, sc); err != nil {
-				return err
-			}
-		}
+		// #nosec
+		w.Write(rules.Bytes())
 	}
 	// ensure profile is written to disk without errors
 	if err := w.Flush(); err != nil {
@@ -62,73 +98,323 @@ func writeSeccompProfile(profilePath string, seccomp *specs.LinuxSeccomp) error
 	return profile.Sync()
 }
 
-func defaultAction(seccomp *specs.LinuxSeccomp) (string, error) {
-	switch seccomp.DefaultAction {
-	case specs.ActKill:
-		return "kill", nil
-	case specs.ActTrap:
-		return "trap", nil
+// seccompActionString returns the liblxc profile action for the given OCI action.
+// The errno is only valid for the errno and trace action.
+func seccompActionString(action specs.LinuxSeccompAction, errnoRet *uint, log zerolog.Logger) (string, error) {
+	// Killing only the thread instead of the process would weaken the profile.
+	if action == specs.ActKillProcess {
+		return "", fmt.Errorf("seccomp action %q is not supported by liblxc", action)
+	}
+	s, ok := seccompAction[action]
+	if !ok {
+		return "", fmt.Errorf("unsupported seccomp action %q", action)
+	}
+	if msg, exist := seccompFallback[action]; exist {
+		log.Warn().Str("action", string(action)).Msg(msg)
+	}
+	switch action {
 	case specs.ActErrno:
-		return "errno 0", nil
-	case specs.ActAllow:
-		return "allow", nil
-	case specs.ActTrace, specs.ActLog: // Not (yet) supported by lxc
-		fallthrough
-	//case specs.ActKillProcess: fallthrough // specs > 1.0.2
-	default:
-		return "kill", fmt.Errorf("unsupported seccomp default action %q", seccomp.DefaultAction)
+		errno := seccompErrno
+		if errnoRet != nil {
+			errno = *errnoRet
+		}
+		return fmt.Sprintf("%s %d", s, errno), nil
+	case specs.ActTrace:
+		// The errno of the trace action is the message passed to the tracer.
+		return fmt.Sprintf("%s %d", s, unix.ENOSYS), nil
 	}
+	if errnoRet != nil {
+		return "", fmt.Errorf("errno is not supported by seccomp action %q", action)
+	}
+	return s, nil
+}
+
+// seccompArchSections maps the OCI seccomp architectures to the liblxc seccomp profile sections.
+// liblxc applies the rules of a section only if the section architecture is the native architecture
+// or a compat architecture of the native architecture (e.g x86 and x32 on x86_64, arm on arm64).
+// The architectures without a section are not supported by liblxc.
+var seccompArchSections = map[specs.Arch]string{
+	specs.ArchX86:         "x86",
+	specs.ArchX86_64:      "x86_64",
+	specs.ArchX32:         "x32",
+	specs.ArchARM:         "arm",
+	specs.ArchAARCH64:     "arm64",
+	specs.ArchMIPS:        "mips",
+	specs.ArchMIPS64:      "mips64",
+	specs.ArchMIPS64N32:   "mips64n32",
+	specs.ArchMIPSEL:      "mipsel",
+	specs.ArchMIPSEL64:    "mipsel64",
+	specs.ArchMIPSEL64N32: "mipsel64n32",
+	specs.ArchPPC:         "ppc",
+	specs.ArchPPC64:       "ppc64",
+	specs.ArchPPC64LE:     "ppc64le",
+	specs.ArchS390X:       "s390x",
 }
 
-func seccompArchs(seccomp *specs.LinuxSeccomp) ([]string, error) {
+// nativeArchSections maps the machine hardware name (`uname -m`) to the liblxc seccomp profile section.
+var nativeArchSections = map[string]string{
+	"i386":    "x86",
+	"i486":    "x86",
+	"i586":    "x86",
+	"i686":    "x86",
+	"x86_64":  "x86_64",
+	"armv6l":  "arm",
+	"armv7l":  "arm",
+	"armv8l":  "arm",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"mips":    "mips",
+	"mips64":  "mips64",
+	"ppc":     "ppc",
+	"ppc64":   "ppc64",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+func nativeSeccompArch() (string, error) {
 	var uts unix.Utsname
 	if err := unix.Uname(&uts); err != nil {
-		return nil, err
+		return "", err
+	}
+	machine := nullTerminatedString(uts.Machine[:])
+	section, ok := nativeArchSections[machine]
+	if !ok {
+		return "", fmt.Errorf("unsupported machine architecture %q", machine)
+	}
+	return section, nil
+}
+
+func hasSection(sections []string, section string) bool {
+	for _, s := range sections {
+		if s == section {
+			return true
+		}
 	}
-	nativeArch := nullTerminatedString(uts.Machine[:])
+	return false
+}
+
+// seccompArchs returns the liblxc profile sections for the architectures in the seccomp spec.
+// The native architecture is used if the spec has no architectures.
+// Architectures that are not supported by liblxc are skipped.
+func seccompArchs(seccomp *specs.LinuxSeccomp, log zerolog.Logger) ([]string, error) {
 	if len(seccomp.Architectures) == 0 {
-		return []string{nativeArch}, nil
+		native, err := nativeSeccompArch()
+		if err != nil {
+			return nil, err
+		}
+		return []string{native}, nil
 	}
-	archs := make([]string, len(seccomp.Architectures))
+	archs := make([]string, 0, len(seccomp.Architectures))
 	for _, a := range seccomp.Architectures {
-		s := strings.ToLower(strings.TrimLeft(string(a), "SCMP_ARCH_"))
-		if strings.ToLower(nativeArch) == s {
-			// lxc seccomp code automatically adds syscalls to compat architectures
-			return []string{nativeArch}, nil
+		section, ok := seccompArchSections[a]
+		if !ok {
+			log.Warn().Str("arch", string(a)).Msg("seccomp architecture is not supported by liblxc")
+			continue
+		}
+		if !hasSection(archs, section) {
+			archs = append(archs, section)
 		}
-		archs = append(archs, s)
+	}
+	if len(archs) == 0 {
+		return nil, fmt.Errorf("none of the seccomp architectures %s is supported", seccomp.Architectures)
 	}
 	return archs, nil
 }
 
-func writeSeccompSyscall(w *bufio.Writer, sc specs.LinuxSyscall) error {
+func writeSeccompSyscall(w io.Writer, sc specs.LinuxSyscall, log zerolog.Logger) error {
+	action, err := seccompActionString(sc.Action, sc.ErrnoRet, log.With().Strs("syscalls", sc.Names).Logger())
+	if err != nil {
+		return err
+	}
+	args, err := seccompRuleArgs(sc.Args)
+	if err != nil {
+		return fmt.Errorf("invalid seccomp rule for syscalls %s: %w", sc.Names, err)
+	}
 	for _, name := range sc.Names {
-		action, ok := seccompAction[sc.Action]
+		if args == "" {
+			fmt.Fprintf(w, "%s %s\n", name, action)
+		} else {
+			fmt.Fprintf(w, "%s %s %s\n", name, action, args)
+		}
+	}
+	return nil
+}
+
+// seccompMaxArgs is the number of syscall arguments.
+const seccompMaxArgs = 6
+
+var seccompOperators = map[specs.LinuxSeccompOperator]bool{
+	specs.OpNotEqual:     true,
+	specs.OpLessThan:     true,
+	specs.OpLessEqual:    true,
+	specs.OpEqualTo:      true,
+	specs.OpGreaterEqual: true,
+	specs.OpGreaterThan:  true,
+	specs.OpMaskedEqual:  true,
+}
+
+// seccompRuleArgs returns the argument comparisons of a syscall rule.
+// The comparisons of a rule (line) are combined with AND by liblxc.
+// From `man 3 seccomp_rule_add_exact_array`:
+// "When adding syscall argument comparisons to the filter it is important to remember
+// that while it is possible to have multiple comparisons in a single rule,
+// you can only compare each argument once in a single rule.
+// In other words, you can not have multiple comparisons of the 3rd syscall argument in a single rule."
+// Multiple comparisons of the same argument are rejected, since they can not be combined with AND.
+func seccompRuleArgs(args []specs.LinuxSeccompArg) (string, error) {
+	var byIndex [seccompMaxArgs]string
+	for _, arg := range args {
+		if arg.Index >= seccompMaxArgs {
+			return "", fmt.Errorf("invalid argument index %d", arg.Index)
+		}
+		if !seccompOperators[arg.Op] {
+			return "", fmt.Errorf("unsupported operator %q", arg.Op)
+		}
+		if byIndex[arg.Index] != "" {
+			return "", fmt.Errorf("multiple comparisons of argument %d are not supported", arg.Index)
+		}
+		byIndex[arg.Index] = seccompArg(arg)
+	}
+	cmps := make([]string, 0, len(args))
+	for _, cmp := range byIndex {
+		if cmp != "" {
+			cmps = append(cmps, cmp)
+		}
+	}
+	return strings.Join(cmps, " "), nil
+}
+
+// seccompArg returns the liblxc argument comparison [index,value,op,mask].
+// For SCMP_CMP_MASKED_EQ the OCI value is the mask and valueTwo is the value that is compared.
+func seccompArg(arg specs.LinuxSeccompArg) string {
+	if arg.Op == specs.OpMaskedEqual {
+		return fmt.Sprintf("[%d,%d,%s,%d]", arg.Index, arg.ValueTwo, arg.Op, arg.Value)
+	}
+	return fmt.Sprintf("[%d,%d,%s,%d]", arg.Index, arg.Value, arg.Op, arg.ValueTwo)
+}
+
+// seccompFlags are the supported seccomp filter flags (see `man 2 seccomp`).
+// liblxc loads the seccomp filter without flags, so the flags can not be passed through.
+// The flags are ignored because this does not weaken the filter.
+var seccompFlags = map[specs.LinuxSeccompFlag]string{
+	specs.LinuxSeccompFlagLog:              "actions other than allow are not logged",
+	specs.LinuxSeccompFlagSpecAllow:        "speculative store bypass mitigation is not disabled",
+	specs.LinuxSeccompFlagWaitKillableRecv: "notified syscalls are interrupted by all signals",
+	// The container init process is single-threaded when liblxc loads the filter.
+	"SECCOMP_FILTER_FLAG_TSYNC": "",
+}
+
+func checkSeccompFlags(flags []specs.LinuxSeccompFlag, log zerolog.Logger) error {
+	for _, flag := range flags {
+		msg, ok := seccompFlags[flag]
 		if !ok {
-			return fmt.Errorf("unsupported seccomp action: %s", sc.Action)
+			return fmt.Errorf("unsupported seccomp flag %q", flag)
 		}
+		if msg != "" {
+			log.Warn().Str("flag", string(flag)).Msgf("seccomp flag is not supported by liblxc - %s", msg)
+		}
+	}
+	return nil
+}
 
-		if sc.Action == specs.ActErrno {
-			var ret uint = 0
-			if sc.ErrnoRet != nil {
-				ret = *sc.ErrnoRet
-			}
-			action = fmt.Sprintf("%s %d", action, ret)
+func hasSeccompNotify(seccomp *specs.LinuxSeccomp) bool {
+	for _, sc := range seccomp.Syscalls {
+		if sc.Action == specs.ActNotify {
+			return true
 		}
+	}
+	return false
+}
 
-		if len(sc.Args) == 0 {
-			fmt.Fprintf(w, "%s %s\n", name, action)
-		} else {
-			// Only write a single argument per line - this is required when the same arg.Index is used multiple times.
-			// from `man 7 seccomp_rule_add_exact_array`
-			// "When adding syscall argument comparisons to the filter it is important to remember
-			// that while it is possible to have multiple comparisons in a single rule,
-			// you can only compare each argument once in a single rule.
-			// In other words, you can not have multiple comparisons of the 3rd syscall argument in a single rule."
-			for _, arg := range sc.Args {
-				fmt.Fprintf(w, "%s %s [%d,%d,%s,%d]\n", name, action, arg.Index, arg.Value, arg.Op, arg.ValueTwo)
-			}
+// configureSeccompNotify configures the delivery of the seccomp notifications
+// if the seccomp profile contains notify rules.
+// The notify fd is either passed to the seccomp agent listening on seccomp.ListenerPath
+// (see https://github.com/opencontainers/runtime-spec/blob/v1.1.0/config-linux.md#seccomp),
+// or the notifications are forwarded by the container monitor to the Runtime.SeccompNotifyProxy.
+func configureSeccompNotify(c *Runtime, seccomp *specs.LinuxSeccomp) error {
+	if !hasSeccompNotify(seccomp) {
+		return nil
+	}
+	// lxc_container.seccomp_notify_fd_active
+	if !c.backend().VersionAtLeast(4, 0, 5) {
+		return fmt.Errorf("seccomp action %q requires liblxc >= 4.0.5 (was %s)", specs.ActNotify, c.backend().Version())
+	}
+	if c.SeccompNotifyProxy != "" {
+		if seccomp.ListenerPath != "" {
+			c.Log.Warn().Str("file", seccomp.ListenerPath).Msg("seccomp notify proxy is set - ignoring seccomp listenerPath")
 		}
+		return c.setConfigItem("lxc.seccomp.notify.proxy", "unix:"+c.SeccompNotifyProxy)
+	}
+	if seccomp.ListenerPath == "" {
+		return fmt.Errorf("seccomp action %q requires a listenerPath", specs.ActNotify)
+	}
+	return nil
+}
+
+// seccompListenerPath returns the path to the socket of the seccomp agent
+// if the seccomp notify fd must be passed to the agent.
+func (c *Runtime) seccompListenerPath(spec *specs.Spec) string {
+	seccomp := spec.Linux.Seccomp
+	if !c.Seccomp || seccomp == nil || c.SeccompNotifyProxy != "" || !hasSeccompNotify(seccomp) {
+		return ""
+	}
+	return seccomp.ListenerPath
+}
+
+// sendSeccompNotifyFd passes the seccomp notify fd and the container process state
+// to the seccomp agent listening on listenerPath.
+// The container monitor provides the notify fd as soon as the container is running.
+func (c *Runtime) sendSeccompNotifyFd(ctx context.Context, listenerPath string, metadata string) error {
+	if !c.wait(ctx, lxc.RUNNING) {
+		return fmt.Errorf("container is not running: %w", ctx.Err())
+	}
+	notifyFd, err := c.Container.SeccompNotifyFdActive()
+	if err != nil {
+		return err
+	}
+	// #nosec
+	defer notifyFd.Close()
+
+	initPid := c.Container.InitPid()
+	state := specs.ContainerProcessState{
+		Version:  specs.Version,
+		Fds:      []string{specs.SeccompFdName},
+		Pid:      initPid,
+		Metadata: metadata,
+		State: specs.State{
+			Version:     specs.Version,
+			ID:          c.ContainerID,
+			Status:      specs.StateCreating,
+			Pid:         initPid,
+			Bundle:      c.BundlePath,
+			Annotations: c.Annotations,
+		},
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", listenerPath)
+	if err != nil {
+		return err
+	}
+	// #nosec
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	oob := unix.UnixRights(int(notifyFd.Fd()))
+	n, oobn, err := conn.(*net.UnixConn).WriteMsgUnix(data, oob, nil)
+	if err != nil {
+		return err
+	}
+	if n != len(data) || oobn != len(oob) {
+		return fmt.Errorf("short write to seccomp agent socket")
 	}
 	return nil
 }
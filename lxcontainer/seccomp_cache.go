@@ -0,0 +1,218 @@
+package lxcontainer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// seccompCacheDir is the directory within the runtime root for the generated seccomp profiles.
+// The containers of a pod usually share the same seccomp profile.
+const seccompCacheDir = ".seccomp"
+
+// seccompCacheVersion must be incremented if the generated profile changes for the same spec.
+const seccompCacheVersion = 1
+
+// seccompCacheTmpTimeout is the age of incomplete profiles that are removed by pruneSeccompCache.
+const seccompCacheTmpTimeout = time.Minute * 10
+
+// seccompCacheStatsSuffix is the suffix of the per profile stats file within the cache dir.
+// A byte is appended to the stats file of a profile for each cache hit or miss (see countSeccompCache).
+// Appending does not require a lock, so concurrent runtime commands are not serialized.
+const seccompCacheStatsSuffix = ".stats"
+
+const (
+	seccompCacheHit  = 'h'
+	seccompCacheMiss = 'm'
+)
+
+// SeccompCacheStats are the seccomp profile cache counters.
+type SeccompCacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// ReadSeccompCacheStats returns the seccomp profile cache counters of the cached profiles
+// for all runtime commands that use the given runtime root.
+// The counters of a profile are removed when the profile is pruned.
+func ReadSeccompCacheStats(runtimeRoot string) (stats SeccompCacheStats, err error) {
+	cacheDir := filepath.Join(runtimeRoot, seccompCacheDir)
+	entries, err := ioutil.ReadDir(cacheDir)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+	for _, fi := range entries {
+		if !strings.HasSuffix(fi.Name(), seccompCacheStatsSuffix) {
+			continue
+		}
+		// #nosec
+		data, err := ioutil.ReadFile(filepath.Join(cacheDir, fi.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+		for _, b := range data {
+			switch b {
+			case seccompCacheHit:
+				stats.Hits++
+			case seccompCacheMiss:
+				stats.Misses++
+			}
+		}
+	}
+	return stats, nil
+}
+
+// countSeccompCache appends a cache hit or miss to the stats file of the cached profile.
+func countSeccompCache(cachedPath string, hit bool) error {
+	statsPath := strings.TrimSuffix(cachedPath, ".conf") + seccompCacheStatsSuffix
+	// #nosec
+	f, err := os.OpenFile(statsPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	b := []byte{seccompCacheMiss}
+	if hit {
+		b[0] = seccompCacheHit
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// seccompProfileHash returns the cache key for the profile generated from the given spec.
+func seccompProfileHash(seccomp *specs.LinuxSeccomp) (string, error) {
+	s := *seccomp
+	// The listener is not part of the profile.
+	s.ListenerPath = ""
+	s.ListenerMetadata = ""
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", seccompCacheVersion)
+	// #nosec
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// createSeccompProfile creates the seccomp profile at profilePath as a hardlink to the cached profile.
+// The profile is generated and added to the cache if it is not cached yet.
+// The link count of a cached profile is the number of containers that use it (+1).
+func (c *Runtime) createSeccompProfile(profilePath string, seccomp *specs.LinuxSeccomp) error {
+	hash, err := seccompProfileHash(seccomp)
+	if err != nil {
+		return fmt.Errorf("failed to hash seccomp profile: %w", err)
+	}
+	cacheDir := filepath.Join(c.RuntimeRoot, seccompCacheDir)
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return fmt.Errorf("failed to create seccomp cache dir: %w", err)
+	}
+	cachedPath := filepath.Join(cacheDir, hash+".conf")
+
+	// The cached profile may be pruned between adding and linking it.
+	for i := 0; i < 3; i++ {
+		err := os.Link(cachedPath, profilePath)
+		if err == nil {
+			if i == 0 {
+				c.countSeccompCache(cachedPath, true)
+			}
+			c.Log.Debug().Str("hash", hash).Bool("cached", i == 0).Msg("created seccomp profile")
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to link cached seccomp profile: %w", err)
+		}
+		if err := c.addSeccompProfile(cachedPath, seccomp); err != nil {
+			return err
+		}
+		if i == 0 {
+			c.countSeccompCache(cachedPath, false)
+		}
+	}
+	return fmt.Errorf("cached seccomp profile %s was removed concurrently", cachedPath)
+}
+
+// countSeccompCache counts a cache hit or miss. The counters are only statistics,
+// so a failure to update them is logged and does not fail the runtime command.
+func (c *Runtime) countSeccompCache(cachedPath string, hit bool) {
+	if err := countSeccompCache(cachedPath, hit); err != nil {
+		c.Log.Warn().Err(err).Msg("failed to update seccomp profile cache stats")
+	}
+}
+
+// addSeccompProfile generates the profile and atomically adds it to the cache.
+func (c *Runtime) addSeccompProfile(cachedPath string, seccomp *specs.LinuxSeccomp) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(cachedPath), "."+filepath.Base(cachedPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := writeSeccompProfile(tmpPath, seccomp, c.Log); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// #nosec
+	if err := os.Chmod(tmpPath, 0440); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, cachedPath)
+}
+
+// pruneSeccompCache removes the cached profiles that are not used by any container
+// together with their stats, and incomplete profiles from failed runtime calls.
+func pruneSeccompCache(runtimeRoot string) error {
+	cacheDir := filepath.Join(runtimeRoot, seccompCacheDir)
+	entries, err := ioutil.ReadDir(cacheDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		name := fi.Name()
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			if time.Since(fi.ModTime()) < seccompCacheTmpTimeout {
+				continue
+			}
+		case strings.HasSuffix(name, ".conf"):
+			st, ok := fi.Sys().(*syscall.Stat_t)
+			if !ok || st.Nlink > 1 {
+				continue
+			}
+			statsPath := filepath.Join(cacheDir, strings.TrimSuffix(name, ".conf")+seccompCacheStatsSuffix)
+			if err := os.Remove(statsPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		default:
+			continue
+		}
+		if err := os.Remove(filepath.Join(cacheDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package lxcontainer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func linkCount(t *testing.T, path string) uint64 {
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	return uint64(fi.Sys().(*syscall.Stat_t).Nlink)
+}
+
+func TestSeccompProfileHash(t *testing.T) {
+	seccomp := &specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Syscalls:      []specs.LinuxSyscall{{Names: []string{"read"}, Action: specs.ActAllow}},
+	}
+	h1, err := seccompProfileHash(seccomp)
+	require.NoError(t, err)
+
+	// the listener is not part of the profile
+	seccomp.ListenerPath = "/run/agent.sock"
+	h2, err := seccompProfileHash(seccomp)
+	require.NoError(t, err)
+	require.Equal(t, h1, h2)
+	require.Equal(t, "/run/agent.sock", seccomp.ListenerPath)
+
+	seccomp.DefaultAction = specs.ActKill
+	h3, err := seccompProfileHash(seccomp)
+	require.NoError(t, err)
+	require.NotEqual(t, h1, h3)
+}
+
+func TestCreateSeccompProfile(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+
+	seccomp := &specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Syscalls:      []specs.LinuxSyscall{{Names: []string{"read"}, Action: specs.ActAllow}},
+	}
+	hash, err := seccompProfileHash(seccomp)
+	require.NoError(t, err)
+	cachedPath := filepath.Join(rt.RuntimeRoot, seccompCacheDir, hash+".conf")
+
+	var profiles []string
+	for _, id := range []string{"c1", "c2"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(rt.RuntimeRoot, id), 0700))
+		profiles = append(profiles, filepath.Join(rt.RuntimeRoot, id, "seccomp.conf"))
+	}
+
+	stats, err := ReadSeccompCacheStats(rt.RuntimeRoot)
+	require.NoError(t, err)
+	require.Equal(t, SeccompCacheStats{}, stats)
+
+	require.NoError(t, rt.createSeccompProfile(profiles[0], seccomp))
+	require.NoError(t, rt.createSeccompProfile(profiles[1], seccomp))
+	stats, err = ReadSeccompCacheStats(rt.RuntimeRoot)
+	require.NoError(t, err)
+	require.Equal(t, SeccompCacheStats{Hits: 1, Misses: 1}, stats)
+
+	require.Equal(t, uint64(3), linkCount(t, cachedPath))
+	data, err := ioutil.ReadFile(profiles[1])
+	require.NoError(t, err)
+	require.Contains(t, string(data), "read allow\n")
+
+	// a profile is removed when it is not used by any container
+	require.NoError(t, os.Remove(profiles[0]))
+	require.NoError(t, pruneSeccompCache(rt.RuntimeRoot))
+	require.Equal(t, uint64(2), linkCount(t, cachedPath))
+
+	require.NoError(t, os.Remove(profiles[1]))
+	require.NoError(t, GC(rt.RuntimeRoot))
+	_, err = os.Stat(cachedPath)
+	require.True(t, os.IsNotExist(err))
+	// the stats of a pruned profile are removed
+	stats, err = ReadSeccompCacheStats(rt.RuntimeRoot)
+	require.NoError(t, err)
+	require.Equal(t, SeccompCacheStats{}, stats)
+
+	// the profile is added again after it was pruned
+	require.NoError(t, rt.createSeccompProfile(profiles[0], seccomp))
+	require.Equal(t, uint64(2), linkCount(t, cachedPath))
+
+	// invalid profiles are not cached (and not counted)
+	validProfile := *seccomp
+	seccomp.DefaultAction = "SCMP_ACT_FOO"
+	require.Error(t, rt.createSeccompProfile(profiles[1], seccomp))
+	entries, err := ioutil.ReadDir(filepath.Join(rt.RuntimeRoot, seccompCacheDir))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.FileExists(t, cachedPath)
+
+	// the stats of a used profile are not removed by GC
+	require.NoError(t, rt.createSeccompProfile(profiles[1], &validProfile))
+	require.NoError(t, GC(rt.RuntimeRoot))
+	stats, err = ReadSeccompCacheStats(rt.RuntimeRoot)
+	require.NoError(t, err)
+	require.Equal(t, SeccompCacheStats{Hits: 1, Misses: 1}, stats)
+}
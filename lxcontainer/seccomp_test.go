@@ -0,0 +1,314 @@
+package lxcontainer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+func TestSeccompActionString(t *testing.T) {
+	log := zerolog.Nop()
+	errno := uint(5)
+
+	actions := map[specs.LinuxSeccompAction]string{
+		specs.ActKill:       "kill",
+		specs.ActKillThread: "kill",
+		specs.ActTrap:       "trap",
+		specs.ActErrno:      "errno 1",
+		specs.ActAllow:      "allow",
+		specs.ActLog:        "allow",
+		specs.ActTrace:      "errno 38",
+	}
+	for action, expected := range actions {
+		s, err := seccompActionString(action, nil, log)
+		require.NoError(t, err)
+		require.Equal(t, expected, s, action)
+	}
+
+	s, err := seccompActionString(specs.ActErrno, &errno, log)
+	require.NoError(t, err)
+	require.Equal(t, "errno 5", s)
+
+	// the errno of the trace action is passed to the tracer
+	s, err = seccompActionString(specs.ActTrace, &errno, log)
+	require.NoError(t, err)
+	require.Equal(t, "errno 38", s)
+
+	_, err = seccompActionString(specs.ActAllow, &errno, log)
+	require.Error(t, err)
+
+	_, err = seccompActionString(specs.ActKillProcess, nil, log)
+	require.Error(t, err)
+
+	_, err = seccompActionString("SCMP_ACT_FOO", nil, log)
+	require.Error(t, err)
+}
+
+func TestWriteSeccompProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golang.test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	errno := uint(38)
+	seccomp := &specs.LinuxSeccomp{
+		DefaultAction:   specs.ActErrno,
+		DefaultErrnoRet: &errno,
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"read", "write"}, Action: specs.ActAllow},
+			{Names: []string{"ptrace"}, Action: specs.ActKillThread},
+			{Names: []string{"personality"}, Action: specs.ActErrno,
+				Args: []specs.LinuxSeccompArg{{Index: 0, Value: 8, Op: specs.OpEqualTo}}},
+		},
+	}
+	archs, err := seccompArchs(seccomp, zerolog.Nop())
+	require.NoError(t, err)
+
+	profilePath := filepath.Join(dir, "seccomp.conf")
+	require.NoError(t, writeSeccompProfile(profilePath, seccomp, zerolog.Nop()))
+	data, err := ioutil.ReadFile(profilePath)
+	require.NoError(t, err)
+
+	expected := "2\nallowlist errno 38\n[" + archs[0] + "]\n" +
+		"read allow\nwrite allow\nptrace kill\npersonality errno 1 [0,8,SCMP_CMP_EQ,0]\n"
+	require.Equal(t, expected, string(data))
+
+	seccomp.DefaultAction = specs.ActKillProcess
+	seccomp.DefaultErrnoRet = nil
+	require.Error(t, writeSeccompProfile(profilePath, seccomp, zerolog.Nop()))
+
+	seccomp.DefaultAction = specs.ActKill
+	seccomp.DefaultErrnoRet = &errno
+	require.Error(t, writeSeccompProfile(profilePath, seccomp, zerolog.Nop()))
+
+	seccomp.DefaultAction = specs.ActNotify
+	seccomp.DefaultErrnoRet = nil
+	require.Error(t, writeSeccompProfile(profilePath, seccomp, zerolog.Nop()))
+}
+
+// parseSeccompProfile parses the sections of a liblxc seccomp profile (version 2).
+func parseSeccompProfile(t *testing.T, data string) (header []string, sections map[string][]string, order []string) {
+	sections = make(map[string][]string)
+	var section string
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		if strings.HasPrefix(line, "[") {
+			require.True(t, strings.HasSuffix(line, "]"), line)
+			section = strings.Trim(line, "[]")
+			require.NotContains(t, sections, section, "duplicate section")
+			sections[section] = []string{}
+			order = append(order, section)
+			continue
+		}
+		if section == "" {
+			header = append(header, line)
+			continue
+		}
+		sections[section] = append(sections[section], line)
+	}
+	return header, sections, order
+}
+
+func TestSeccompArchs(t *testing.T) {
+	log := zerolog.Nop()
+
+	native, err := nativeSeccompArch()
+	require.NoError(t, err)
+	archs, err := seccompArchs(&specs.LinuxSeccomp{}, log)
+	require.NoError(t, err)
+	require.Equal(t, []string{native}, archs)
+
+	seccomp := &specs.LinuxSeccomp{
+		Architectures: []specs.Arch{specs.ArchX86_64, specs.ArchX86, specs.ArchX32, specs.ArchX86_64},
+	}
+	archs, err = seccompArchs(seccomp, log)
+	require.NoError(t, err)
+	require.Equal(t, []string{"x86_64", "x86", "x32"}, archs)
+
+	// unsupported architectures are skipped
+	seccomp.Architectures = []specs.Arch{specs.ArchAARCH64, specs.ArchARM, specs.ArchRISCV64}
+	archs, err = seccompArchs(seccomp, log)
+	require.NoError(t, err)
+	require.Equal(t, []string{"arm64", "arm"}, archs)
+
+	seccomp.Architectures = []specs.Arch{specs.ArchRISCV64, specs.ArchS390, "SCMP_ARCH_FOO"}
+	_, err = seccompArchs(seccomp, log)
+	require.Error(t, err)
+
+	// every architecture has a section
+	for arch, section := range seccompArchSections {
+		archs, err := seccompArchs(&specs.LinuxSeccomp{Architectures: []specs.Arch{arch}}, log)
+		require.NoError(t, err)
+		require.Equal(t, []string{section}, archs)
+	}
+}
+
+func TestWriteSeccompProfile_archs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golang.test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	seccomp := &specs.LinuxSeccomp{
+		DefaultAction: specs.ActErrno,
+		Architectures: []specs.Arch{specs.ArchAARCH64, specs.ArchARM},
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"read"}, Action: specs.ActAllow},
+			{Names: []string{"clone"}, Action: specs.ActAllow,
+				Args: []specs.LinuxSeccompArg{
+					{Index: 0, Value: 0x7E020000, Op: specs.OpMaskedEqual},
+					{Index: 1, Value: 2, ValueTwo: 3, Op: specs.OpNotEqual},
+				}},
+		},
+	}
+	profilePath := filepath.Join(dir, "seccomp.conf")
+	require.NoError(t, writeSeccompProfile(profilePath, seccomp, zerolog.Nop()))
+	data, err := ioutil.ReadFile(profilePath)
+	require.NoError(t, err)
+
+	header, sections, order := parseSeccompProfile(t, string(data))
+	require.Equal(t, []string{"2", "allowlist errno 1"}, header)
+	require.Equal(t, []string{"arm64", "arm"}, order)
+	rules := []string{
+		"read allow",
+		"clone allow [0,0,SCMP_CMP_MASKED_EQ,2114060288] [1,2,SCMP_CMP_NE,3]",
+	}
+	for _, section := range order {
+		require.Equal(t, rules, sections[section], section)
+	}
+}
+
+func TestSeccompRuleArgs(t *testing.T) {
+	rule, err := seccompRuleArgs(nil)
+	require.NoError(t, err)
+	require.Equal(t, "", rule)
+
+	// comparisons of different arguments are combined with AND
+	rule, err = seccompRuleArgs([]specs.LinuxSeccompArg{
+		{Index: 2, Value: 1, Op: specs.OpGreaterEqual},
+		{Index: 0, Value: 5, Op: specs.OpEqualTo},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "[0,5,SCMP_CMP_EQ,0] [2,1,SCMP_CMP_GE,0]", rule)
+
+	// multiple comparisons of the same argument can not be combined with AND
+	_, err = seccompRuleArgs([]specs.LinuxSeccompArg{
+		{Index: 0, Value: 0, Op: specs.OpEqualTo},
+		{Index: 0, Value: 8, Op: specs.OpEqualTo},
+		{Index: 1, Value: 3, Op: specs.OpLessThan},
+	})
+	require.Error(t, err)
+
+	_, err = seccompRuleArgs([]specs.LinuxSeccompArg{{Index: 6, Op: specs.OpEqualTo}})
+	require.Error(t, err)
+
+	_, err = seccompRuleArgs([]specs.LinuxSeccompArg{{Index: 0, Op: "SCMP_CMP_FOO"}})
+	require.Error(t, err)
+}
+
+func TestCheckSeccompFlags(t *testing.T) {
+	log := zerolog.Nop()
+	require.NoError(t, checkSeccompFlags(nil, log))
+	require.NoError(t, checkSeccompFlags([]specs.LinuxSeccompFlag{
+		specs.LinuxSeccompFlagLog, specs.LinuxSeccompFlagSpecAllow, "SECCOMP_FILTER_FLAG_TSYNC"}, log))
+	require.Error(t, checkSeccompFlags([]specs.LinuxSeccompFlag{"SECCOMP_FILTER_FLAG_FOO"}, log))
+}
+
+func TestConfigureSeccompNotify(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+
+	seccomp := &specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls:      []specs.LinuxSyscall{{Names: []string{"mount"}, Action: specs.ActNotify}},
+	}
+	spec := &specs.Spec{Linux: &specs.Linux{Seccomp: seccomp}}
+
+	// notify requires a listener
+	require.Error(t, configureSeccompNotify(rt, seccomp))
+
+	seccomp.ListenerPath = "/run/agent.sock"
+	require.NoError(t, configureSeccompNotify(rt, seccomp))
+	require.Equal(t, "/run/agent.sock", rt.seccompListenerPath(spec))
+	require.Empty(t, c.ConfigItem("lxc.seccomp.notify.proxy"))
+
+	rt.SeccompNotifyProxy = "/run/proxy.sock"
+	require.NoError(t, configureSeccompNotify(rt, seccomp))
+	require.Equal(t, "", rt.seccompListenerPath(spec))
+	require.Equal(t, []string{"unix:/run/proxy.sock"}, c.ConfigItem("lxc.seccomp.notify.proxy"))
+
+	backend.version = [3]int{4, 0, 4}
+	require.Error(t, configureSeccompNotify(rt, seccomp))
+}
+
+func TestSendSeccompNotifyFd(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+	rt.BundlePath = "/bundle"
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	c.seccompNotifyFd = w
+	c.setInit(lxc.RUNNING, os.Getpid())
+
+	listenerPath := filepath.Join(rt.RuntimeRoot, "agent.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: listenerPath, Net: "unix"})
+	require.NoError(t, err)
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- rt.sendSeccompNotifyFd(ctx, listenerPath, "meta")
+	}()
+
+	conn, err := l.AcceptUnix()
+	require.NoError(t, err)
+	defer conn.Close()
+	buf := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	require.NoError(t, err)
+	require.NoError(t, <-errc)
+
+	var state specs.ContainerProcessState
+	require.NoError(t, json.Unmarshal(buf[:n], &state))
+	require.Equal(t, []string{specs.SeccompFdName}, state.Fds)
+	require.Equal(t, "meta", state.Metadata)
+	require.Equal(t, os.Getpid(), state.Pid)
+	require.Equal(t, rt.ContainerID, state.State.ID)
+	require.Equal(t, "/bundle", state.State.Bundle)
+	require.Equal(t, specs.StateCreating, state.State.Status)
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	require.NoError(t, err)
+	require.Len(t, fds, 1)
+
+	// the received fd is the write end of the pipe
+	notifyFd := os.NewFile(uintptr(fds[0]), "seccomp notify")
+	_, err = notifyFd.WriteString("hello")
+	require.NoError(t, err)
+	notifyFd.Close()
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+}
@@ -0,0 +1,49 @@
+package lxcontainer
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func selinuxEnabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+// configureSelinux sets the selinux label of the container process
+// and of the session keyring created by liblxc.
+func configureSelinux(c *Runtime, spec *specs.Spec) error {
+	label := spec.Process.SelinuxLabel
+	if label == "" {
+		return nil
+	}
+	if !selinuxEnabled() {
+		return fmt.Errorf("selinux label %q is set but selinux is not enabled", label)
+	}
+	if err := c.setConfigItem("lxc.selinux.context", label); err != nil {
+		return err
+	}
+	if c.supportsConfigItem("lxc.selinux.context.keyring") {
+		return c.setConfigItem("lxc.selinux.context.keyring", label)
+	}
+	return nil
+}
+
+// selinuxMountLabel returns the selinux label for the tmpfs and mqueue mounts.
+func selinuxMountLabel(c *Runtime, spec *specs.Spec) (string, error) {
+	if !c.Selinux || spec.Linux == nil || spec.Linux.MountLabel == "" {
+		return "", nil
+	}
+	if !selinuxEnabled() {
+		return "", fmt.Errorf("selinux mount label %q is set but selinux is not enabled", spec.Linux.MountLabel)
+	}
+	return spec.Linux.MountLabel, nil
+}
+
+// selinuxContextOption returns the context mount option for label.
+// The label is quoted because the MCS categories are separated by commas (e.g s0:c1,c2).
+func selinuxContextOption(label string) string {
+	return fmt.Sprintf("context=%q", label)
+}
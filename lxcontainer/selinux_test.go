@@ -0,0 +1,45 @@
+package lxcontainer
+
+import (
+	"os"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigureSelinux(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	c := createTestContainer(t, rt, backend)
+	rt.Container = c
+
+	label := "system_u:system_r:container_t:s0:c1,c2"
+	spec := &specs.Spec{
+		Process: &specs.Process{SelinuxLabel: label},
+		Linux:   &specs.Linux{MountLabel: "system_u:object_r:container_file_t:s0:c1,c2"},
+	}
+
+	if !selinuxEnabled() {
+		require.Error(t, configureSelinux(rt, spec))
+		_, err := selinuxMountLabel(rt, spec)
+		require.Error(t, err)
+	} else {
+		require.NoError(t, configureSelinux(rt, spec))
+		require.Equal(t, []string{label}, c.ConfigItem("lxc.selinux.context"))
+		require.Equal(t, []string{label}, c.ConfigItem("lxc.selinux.context.keyring"))
+		mountLabel, err := selinuxMountLabel(rt, spec)
+		require.NoError(t, err)
+		require.Equal(t, spec.Linux.MountLabel, mountLabel)
+	}
+
+	rt.Selinux = false
+	mountLabel, err := selinuxMountLabel(rt, spec)
+	require.NoError(t, err)
+	require.Empty(t, mountLabel)
+}
+
+func TestSelinuxContextOption(t *testing.T) {
+	require.Equal(t, `context="system_u:object_r:container_file_t:s0:c1,c2"`,
+		selinuxContextOption("system_u:object_r:container_file_t:s0:c1,c2"))
+}
@@ -0,0 +1,113 @@
+package lxcontainer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// SystemContainerAnnotation enables the system container mode if set to "true".
+// The container process is an init system (systemd) that manages the container.
+const SystemContainerAnnotation = "org.linuxcontainers.crio-lxc.system-container"
+
+// systemdHaltSignal (SIGRTMIN+3) halts systemd, SIGTERM is ignored by systemd.
+// The kernel SIGRTMIN is 32, but glibc reserves the first two realtime signals.
+const systemdHaltSignal = unix.Signal(34 + 3)
+
+// systemContainerEnv is detected by systemd (see `man 1 systemd-detect-virt`).
+const systemContainerEnv = "container=lxc"
+
+// systemContainerMounts are the tmpfs mounts required by systemd.
+var systemContainerMounts = []specs.Mount{
+	{Source: "tmpfs", Destination: "/run", Type: "tmpfs", Options: []string{"nosuid", "nodev", "mode=755"}},
+	{Source: "tmpfs", Destination: "/run/lock", Type: "tmpfs", Options: []string{"nosuid", "nodev", "noexec"}},
+}
+
+func isSystemContainer(annotations map[string]string) bool {
+	return annotations[SystemContainerAnnotation] == "true"
+}
+
+// configureSystemContainer adds the namespaces, mounts and environment
+// required by systemd to the spec, if the system container mode is enabled.
+// The container process is started by crio-lxc-init like any other container process.
+func configureSystemContainer(c *Runtime, spec *specs.Spec) error {
+	if !isSystemContainer(spec.Annotations) {
+		return nil
+	}
+	if spec.Process.User.UID != 0 {
+		return fmt.Errorf("the init system of a system container must run as root (uid was %d)", spec.Process.User.UID)
+	}
+	c.Log.Info().Msg("system container mode enabled")
+
+	// systemd manages the container cgroup within the cgroup namespace.
+	if getNamespace(specs.CgroupNamespace, spec.Linux.Namespaces) == nil {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.CgroupNamespace})
+	}
+	cgroupMount := false
+	for i, ms := range spec.Mounts {
+		if filepath.Clean("/"+ms.Destination) != "/sys/fs/cgroup" {
+			continue
+		}
+		cgroupMount = true
+		spec.Mounts[i].Type = "cgroup"
+		spec.Mounts[i].Source = "cgroup"
+		spec.Mounts[i].Options = writableOptions(ms.Options)
+	}
+	if !cgroupMount {
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Source: "cgroup", Destination: "/sys/fs/cgroup", Type: "cgroup",
+			Options: []string{"nosuid", "noexec", "nodev", "rw"},
+		})
+	}
+
+	for _, ms := range systemContainerMounts {
+		if hasMount(spec, ms.Destination) {
+			continue
+		}
+		ms.Options = append([]string{}, ms.Options...)
+		spec.Mounts = append(spec.Mounts, ms)
+	}
+
+	for _, env := range spec.Process.Env {
+		if strings.HasPrefix(env, "container=") {
+			return nil
+		}
+	}
+	spec.Process.Env = append(spec.Process.Env, systemContainerEnv)
+	return nil
+}
+
+// configureHaltSignal sets the signal that is sent to the init process of a system container
+// by Container.Shutdown. The config item is read from the config file by liblxc,
+// so it must be set when the container is created.
+func configureHaltSignal(c *Runtime, spec *specs.Spec) error {
+	if !isSystemContainer(spec.Annotations) {
+		return nil
+	}
+	return c.setConfigItem("lxc.signal.halt", strconv.Itoa(int(systemdHaltSignal)))
+}
+
+// writableOptions replaces the read-only mount options with "rw".
+func writableOptions(options []string) []string {
+	opts := make([]string, 0, len(options)+1)
+	for _, opt := range options {
+		if opt != "ro" && opt != "rro" && opt != "rw" {
+			opts = append(opts, opt)
+		}
+	}
+	return append(opts, "rw")
+}
+
+func hasMount(spec *specs.Spec, dst string) bool {
+	for _, ms := range spec.Mounts {
+		if filepath.Clean("/"+ms.Destination) == dst {
+			return true
+		}
+	}
+	return false
+}
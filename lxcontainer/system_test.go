@@ -0,0 +1,85 @@
+package lxcontainer
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+func TestConfigureSystemContainer(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+
+	spec := &specs.Spec{
+		Process: &specs.Process{Env: []string{"PATH=/bin"}},
+		Linux:   &specs.Linux{},
+		Mounts: []specs.Mount{
+			{Source: "cgroup", Destination: "/sys/fs/cgroup", Type: "cgroup", Options: []string{"nosuid", "ro"}},
+			{Source: "tmpfs", Destination: "/run/", Type: "tmpfs"},
+		},
+	}
+	// disabled
+	require.NoError(t, configureSystemContainer(rt, spec))
+	require.Len(t, spec.Mounts, 2)
+	require.Empty(t, spec.Linux.Namespaces)
+
+	spec.Annotations = map[string]string{SystemContainerAnnotation: "true"}
+	require.NoError(t, configureSystemContainer(rt, spec))
+	require.Equal(t, []specs.LinuxNamespace{{Type: specs.CgroupNamespace}}, spec.Linux.Namespaces)
+	require.Equal(t, []string{"nosuid", "rw"}, spec.Mounts[0].Options)
+	require.Len(t, spec.Mounts, 3)
+	require.Equal(t, "/run/lock", spec.Mounts[2].Destination)
+	require.Equal(t, []string{"PATH=/bin", "container=lxc"}, spec.Process.Env)
+
+	// the cgroup mount is added
+	spec = &specs.Spec{
+		Process:     &specs.Process{Env: []string{"container=other"}},
+		Linux:       &specs.Linux{},
+		Annotations: map[string]string{SystemContainerAnnotation: "true"},
+	}
+	require.NoError(t, configureSystemContainer(rt, spec))
+	require.True(t, hasMount(spec, "/sys/fs/cgroup"))
+	require.True(t, hasMount(spec, "/run"))
+	require.Equal(t, []string{"container=other"}, spec.Process.Env)
+
+	spec.Process.User.UID = 1000
+	require.Error(t, configureSystemContainer(rt, spec))
+}
+
+func TestRuntimeKill_systemContainer(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	spec := &specs.Spec{Annotations: map[string]string{SystemContainerAnnotation: "true"}}
+	rt.Annotations = spec.Annotations
+	c := createTestContainer(t, rt, backend)
+
+	// the halt signal is loaded from the config file written by create
+	rt.Container = c
+	require.NoError(t, configureHaltSignal(rt, spec))
+	require.NoError(t, c.SaveConfigFile(rt.ConfigFilePath()))
+	require.NoError(t, c.LoadConfigFile(os.DevNull))
+	rt.Container = nil
+
+	init := startFakeInit(t, rt.ContainerID)
+	defer stopFakeInit(init)
+	c.setInit(lxc.RUNNING, init.Process.Pid)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, rt.Kill(ctx, unix.SIGTERM))
+	require.Equal(t, lxc.STOPPED, c.State())
+	require.Empty(t, c.ConfigItem("lxc.signal.stop"))
+
+	// the fake init process exits with 128+signum
+	err := init.Wait()
+	require.Error(t, err)
+	status := init.ProcessState.Sys().(syscall.WaitStatus)
+	require.Equal(t, 128+int(systemdHaltSignal), status.ExitStatus())
+}
@@ -0,0 +1,480 @@
+package lxcontainer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// usernsDir is the directory within the runtime root for the allocated ID mappings.
+// The ID mapping of a pod is shared by all containers of the pod.
+const usernsDir = ".userns"
+
+// UsernsAnnotation enables the ID mapping allocation for a container if set to "auto".
+const UsernsAnnotation = "org.linuxcontainers.crio-lxc.userns"
+
+const (
+	// DefaultUsernsUser is the user whose subordinate IDs are allocated.
+	DefaultUsernsUser = "crio-lxc"
+	// DefaultUsernsSize is the number of IDs allocated per pod.
+	DefaultUsernsSize = 65536
+)
+
+var (
+	subuidPath = "/etc/subuid"
+	subgidPath = "/etc/subgid"
+)
+
+// sandboxIDAnnotations identify the pod of a container (CRI-O and containerd).
+var sandboxIDAnnotations = []string{"io.kubernetes.cri-o.SandboxID", "io.kubernetes.cri.sandbox-id"}
+
+// idRange is a range of user or group IDs.
+type idRange struct {
+	Start uint32
+	Size  uint32
+}
+
+func (r idRange) end() uint64 {
+	return uint64(r.Start) + uint64(r.Size)
+}
+
+func (r idRange) overlaps(o idRange) bool {
+	return uint64(r.Start) < o.end() && uint64(o.Start) < r.end()
+}
+
+// usernsAllocation is the ID mapping allocated for a pod.
+// Container ID 0 is mapped to UID and GID on the host.
+type usernsAllocation struct {
+	UID  uint32 `json:"uid"`
+	GID  uint32 `json:"gid"`
+	Size uint32 `json:"size"`
+}
+
+// readSubIDs reads the subordinate ID ranges of user from path (see `man 5 subuid`).
+func readSubIDs(path string, user string) ([]idRange, error) {
+	// #nosec
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges []idRange
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid line %q in %s", line, path)
+		}
+		if fields[0] != user {
+			continue
+		}
+		start, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %q in %s: %w", line, path, err)
+		}
+		size, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %q in %s: %w", line, path, err)
+		}
+		ranges = append(ranges, idRange{Start: uint32(start), Size: uint32(size)})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no subordinate IDs for user %q in %s", user, path)
+	}
+	return ranges, nil
+}
+
+// allocateRange returns the start of the first range of the given size
+// within the available ranges that does not overlap with the used ranges.
+func allocateRange(available []idRange, used []idRange, size uint32) (uint32, bool) {
+	for _, r := range available {
+		candidate := idRange{Start: r.Start, Size: size}
+	next:
+		for candidate.end() <= r.end() {
+			for _, u := range used {
+				if candidate.overlaps(u) {
+					if u.end() > uint64(^uint32(0)) {
+						break next
+					}
+					candidate.Start = uint32(u.end())
+					continue next
+				}
+			}
+			return candidate.Start, true
+		}
+	}
+	return 0, false
+}
+
+// usernsAuto returns true if the ID mappings must be allocated for the container.
+// In rootless mode the ID mappings are allocated unless they are defined in the spec.
+func (c *Runtime) usernsAuto(spec *specs.Spec) bool {
+	if c.Rootless {
+		if len(spec.Linux.UIDMappings) > 0 || len(spec.Linux.GIDMappings) > 0 {
+			return false
+		}
+		userns := getNamespace(specs.UserNamespace, spec.Linux.Namespaces)
+		return userns == nil || userns.Path == ""
+	}
+	return c.UsernsAuto || spec.Annotations[UsernsAnnotation] == "auto"
+}
+
+// configureUserns allocates the ID mappings if enabled and validates the ID mappings.
+func configureUserns(c *Runtime, spec *specs.Spec) error {
+	if c.usernsAuto(spec) {
+		if err := c.allocateUserns(spec); err != nil {
+			return err
+		}
+		// The namespaces are validated by Create before the user namespace is added.
+		if errs := validateNamespaces(spec.Linux.Namespaces); len(errs) > 0 {
+			return errs
+		}
+	}
+	if c.Rootless && getNamespace(specs.UserNamespace, spec.Linux.Namespaces) == nil {
+		return fmt.Errorf("a user namespace is required in rootless mode")
+	}
+	if err := validateIDMappings(spec); err != nil {
+		return err
+	}
+	if len(spec.Linux.UIDMappings) > 0 {
+		// The init files are accessed by the mapped container root.
+		// #nosec
+		if err := os.Chmod(c.RuntimePath(), 0711); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocateUserns sets the ID mappings allocated for the pod of the container
+// and enables the user namespace.
+func (c *Runtime) allocateUserns(spec *specs.Spec) error {
+	if len(spec.Linux.UIDMappings) > 0 || len(spec.Linux.GIDMappings) > 0 {
+		return fmt.Errorf("ID mappings are defined in the container spec")
+	}
+	userns := getNamespace(specs.UserNamespace, spec.Linux.Namespaces)
+	if userns != nil && userns.Path != "" {
+		return fmt.Errorf("can not allocate ID mappings for the shared user namespace %s", userns.Path)
+	}
+
+	podID := c.ContainerID
+	for _, key := range sandboxIDAnnotations {
+		if id := spec.Annotations[key]; id != "" {
+			podID = id
+			break
+		}
+	}
+
+	// A pod container that joins the network namespace of the pod sandbox
+	// must join the user namespace that owns the network namespace as well.
+	var usernsPath string
+	if netns := getNamespace(specs.NetworkNamespace, spec.Linux.Namespaces); podID != c.ContainerID && netns != nil && netns.Path != "" {
+		p, err := c.podUserns(podID, netns.Path)
+		if err != nil {
+			return fmt.Errorf("failed to join user namespace of pod %s: %w", podID, err)
+		}
+		usernsPath = p
+		c.Log.Info().Str("pod", podID).Str("userns", usernsPath).Msg("join pod user namespace")
+	}
+	alloc, err := c.acquireUsernsAllocation(podID)
+	if err != nil {
+		return fmt.Errorf("failed to allocate ID mappings for pod %s: %w", podID, err)
+	}
+	c.Log.Info().Str("pod", podID).Uint32("uid", alloc.UID).Uint32("gid", alloc.GID).
+		Uint32("size", alloc.Size).Msg("allocated ID mappings")
+
+	if c.Rootless {
+		// The container root is mapped to the calling user, so that the container
+		// can access the runtime files that the runtime can not chown.
+		spec.Linux.UIDMappings = []specs.LinuxIDMapping{
+			{ContainerID: 0, HostID: uint32(os.Geteuid()), Size: 1},
+			{ContainerID: 1, HostID: alloc.UID, Size: alloc.Size},
+		}
+		spec.Linux.GIDMappings = []specs.LinuxIDMapping{
+			{ContainerID: 0, HostID: uint32(os.Getegid()), Size: 1},
+			{ContainerID: 1, HostID: alloc.GID, Size: alloc.Size},
+		}
+	} else {
+		spec.Linux.UIDMappings = []specs.LinuxIDMapping{{ContainerID: 0, HostID: alloc.UID, Size: alloc.Size}}
+		spec.Linux.GIDMappings = []specs.LinuxIDMapping{{ContainerID: 0, HostID: alloc.GID, Size: alloc.Size}}
+	}
+	if userns == nil {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.UserNamespace, Path: usernsPath})
+		return nil
+	}
+	for i := range spec.Linux.Namespaces {
+		if spec.Linux.Namespaces[i].Type == specs.UserNamespace {
+			spec.Linux.Namespaces[i].Path = usernsPath
+		}
+	}
+	return nil
+}
+
+// podUserns returns the path of the user namespace of the pod sandbox container podID.
+// It returns an error if the user namespace does not own the network namespace netnsPath.
+func (c *Runtime) podUserns(podID string, netnsPath string) (string, error) {
+	sandbox, err := c.backend().NewContainer(podID, c.RuntimeRoot)
+	if err != nil {
+		return "", err
+	}
+	defer sandbox.Release()
+
+	pid := sandbox.InitPid()
+	if pid <= 0 {
+		return "", fmt.Errorf("pod sandbox container is %s", sandbox.State())
+	}
+	usernsPath := fmt.Sprintf("/proc/%d/ns/user", pid)
+
+	netns, err := os.Open(netnsPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open network namespace: %w", err)
+	}
+	// #nosec
+	defer netns.Close()
+	fd, err := unix.IoctlRetInt(int(netns.Fd()), unix.NS_GET_USERNS)
+	if err != nil {
+		return "", fmt.Errorf("failed to get owner of network namespace %s: %w", netnsPath, err)
+	}
+	owner := fmt.Sprintf("/proc/self/fd/%d", fd)
+	// #nosec
+	defer unix.Close(fd)
+
+	same, err := isSameNamespace(owner, usernsPath)
+	if err != nil {
+		return "", err
+	}
+	if !same {
+		return "", fmt.Errorf("network namespace %s is not owned by user namespace %s", netnsPath, usernsPath)
+	}
+	return usernsPath, nil
+}
+
+// lockUserns acquires the exclusive lock for the ID mapping allocations.
+func lockUserns(dir string) (*os.File, error) {
+	// #nosec
+	f, err := os.OpenFile(filepath.Join(dir, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// acquireUsernsAllocation returns the ID mapping allocated for the pod.
+// A new ID mapping is allocated for the first container of a pod.
+// The allocation is linked into the container runtime directory,
+// so the link count of an allocation is the number of containers that use it (+1).
+func (c *Runtime) acquireUsernsAllocation(podID string) (*usernsAllocation, error) {
+	if podID == "" || filepath.Base(podID) != podID || strings.HasPrefix(podID, ".") {
+		return nil, fmt.Errorf("invalid pod ID %q", podID)
+	}
+	dir := filepath.Join(c.RuntimeRoot, usernsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := lockUserns(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock ID mapping allocations: %w", err)
+	}
+	defer lock.Close()
+
+	allocPath := filepath.Join(dir, podID+".json")
+	alloc := new(usernsAllocation)
+	err = decodeFileJSON(alloc, allocPath)
+	if errors.Is(err, os.ErrNotExist) {
+		alloc, err = c.newUsernsAllocation(dir)
+		if err != nil {
+			return nil, err
+		}
+		err = encodeFileJSON(allocPath, alloc, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0440)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if alloc.Size != c.UsernsSize {
+		return nil, fmt.Errorf("pod ID mapping size %d does not match the requested size %d", alloc.Size, c.UsernsSize)
+	}
+	if err := os.Link(allocPath, c.RuntimePath("userns.json")); err != nil {
+		return nil, err
+	}
+	return alloc, nil
+}
+
+// newUsernsAllocation allocates ID ranges from the subordinate IDs of UsernsUser
+// that do not overlap with the ranges allocated for other pods.
+func (c *Runtime) newUsernsAllocation(dir string) (*usernsAllocation, error) {
+	if c.UsernsSize == 0 {
+		return nil, fmt.Errorf("ID mapping size must be greater than 0")
+	}
+	subuids, err := readSubIDs(subuidPath, c.UsernsUser)
+	if err != nil {
+		return nil, err
+	}
+	subgids, err := readSubIDs(subgidPath, c.UsernsUser)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var usedUIDs, usedGIDs []idRange
+	for _, fi := range entries {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		used := new(usernsAllocation)
+		if err := decodeFileJSON(used, filepath.Join(dir, fi.Name())); err != nil {
+			return nil, err
+		}
+		usedUIDs = append(usedUIDs, idRange{Start: used.UID, Size: used.Size})
+		usedGIDs = append(usedGIDs, idRange{Start: used.GID, Size: used.Size})
+	}
+
+	alloc := &usernsAllocation{Size: c.UsernsSize}
+	var ok bool
+	if alloc.UID, ok = allocateRange(subuids, usedUIDs, c.UsernsSize); !ok {
+		return nil, fmt.Errorf("no free subordinate user IDs for user %q", c.UsernsUser)
+	}
+	if alloc.GID, ok = allocateRange(subgids, usedGIDs, c.UsernsSize); !ok {
+		return nil, fmt.Errorf("no free subordinate group IDs for user %q", c.UsernsUser)
+	}
+	return alloc, nil
+}
+
+// pruneUsernsAllocations releases the ID mappings that are not used by any container.
+func pruneUsernsAllocations(runtimeRoot string) error {
+	dir := filepath.Join(runtimeRoot, usernsDir)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	lock, err := lockUserns(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || st.Nlink > 1 {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateIDMappings checks that the ID mappings are consistent with the user namespace
+// and that the ID mappings do not overlap.
+func validateIDMappings(spec *specs.Spec) error {
+	userns := getNamespace(specs.UserNamespace, spec.Linux.Namespaces)
+	hasMappings := len(spec.Linux.UIDMappings) > 0 || len(spec.Linux.GIDMappings) > 0
+	if userns == nil {
+		if hasMappings {
+			return fmt.Errorf("ID mappings require a user namespace")
+		}
+		return nil
+	}
+	if userns.Path != "" {
+		return nil
+	}
+	if len(spec.Linux.UIDMappings) == 0 || len(spec.Linux.GIDMappings) == 0 {
+		return fmt.Errorf("user namespace requires UID and GID mappings")
+	}
+	if err := validateIDMapping("UID", spec.Linux.UIDMappings); err != nil {
+		return err
+	}
+	if err := validateIDMapping("GID", spec.Linux.GIDMappings); err != nil {
+		return err
+	}
+
+	u := spec.Process.User
+	if _, ok := hostID(spec.Linux.UIDMappings, u.UID); !ok {
+		return fmt.Errorf("process UID %d is not mapped", u.UID)
+	}
+	for _, gid := range append([]uint32{u.GID}, u.AdditionalGids...) {
+		if _, ok := hostID(spec.Linux.GIDMappings, gid); !ok {
+			return fmt.Errorf("process GID %d is not mapped", gid)
+		}
+	}
+	return nil
+}
+
+func validateIDMapping(kind string, mappings []specs.LinuxIDMapping) error {
+	for i, m := range mappings {
+		if m.Size == 0 {
+			return fmt.Errorf("%s mapping %d has size 0", kind, i)
+		}
+		cr := idRange{Start: m.ContainerID, Size: m.Size}
+		hr := idRange{Start: m.HostID, Size: m.Size}
+		if cr.end() > 1<<32 || hr.end() > 1<<32 {
+			return fmt.Errorf("%s mapping %d exceeds the ID range", kind, i)
+		}
+		for j, o := range mappings[:i] {
+			if cr.overlaps(idRange{Start: o.ContainerID, Size: o.Size}) {
+				return fmt.Errorf("%s mapping %d overlaps with mapping %d in the container", kind, i, j)
+			}
+			if hr.overlaps(idRange{Start: o.HostID, Size: o.Size}) {
+				return fmt.Errorf("%s mapping %d overlaps with mapping %d on the host", kind, i, j)
+			}
+		}
+	}
+	return nil
+}
+
+func equalIDMappings(a, b []specs.LinuxIDMapping) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hostID returns the host ID of the container ID id.
+// The ID is returned unchanged if mappings is empty.
+func hostID(mappings []specs.LinuxIDMapping, id uint32) (uint32, bool) {
+	if len(mappings) == 0 {
+		return id, true
+	}
+	for _, m := range mappings {
+		if id >= m.ContainerID && uint64(id) < uint64(m.ContainerID)+uint64(m.Size) {
+			return m.HostID + (id - m.ContainerID), true
+		}
+	}
+	return 0, false
+}
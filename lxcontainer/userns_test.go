@@ -0,0 +1,199 @@
+package lxcontainer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+func TestAllocateRange(t *testing.T) {
+	available := []idRange{{Start: 100000, Size: 65536 * 2}, {Start: 500000, Size: 65536}}
+
+	start, ok := allocateRange(available, nil, 65536)
+	require.True(t, ok)
+	require.Equal(t, uint32(100000), start)
+
+	start, ok = allocateRange(available, []idRange{{Start: 100000, Size: 65536}}, 65536)
+	require.True(t, ok)
+	require.Equal(t, uint32(165536), start)
+
+	used := []idRange{{Start: 165536, Size: 65536}, {Start: 100000, Size: 65536}}
+	start, ok = allocateRange(available, used, 65536)
+	require.True(t, ok)
+	require.Equal(t, uint32(500000), start)
+
+	used = append(used, idRange{Start: 500000, Size: 1})
+	_, ok = allocateRange(available, used, 65536)
+	require.False(t, ok)
+}
+
+func TestReadSubIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crio-lxc-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "subuid")
+	require.NoError(t, ioutil.WriteFile(p, []byte("root:100000:65536\ncrio-lxc:200000:131072\n\ncrio-lxc:400000:65536\n"), 0640))
+	ranges, err := readSubIDs(p, "crio-lxc")
+	require.NoError(t, err)
+	require.Equal(t, []idRange{{Start: 200000, Size: 131072}, {Start: 400000, Size: 65536}}, ranges)
+
+	_, err = readSubIDs(p, "foo")
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(p, []byte("crio-lxc:200000\n"), 0640))
+	_, err = readSubIDs(p, "crio-lxc")
+	require.Error(t, err)
+}
+
+func TestValidateIDMappings(t *testing.T) {
+	mapping := []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	userns := []specs.LinuxNamespace{{Type: specs.UserNamespace}}
+
+	spec := &specs.Spec{Process: &specs.Process{User: specs.User{UID: 1000, GID: 1000}}, Linux: &specs.Linux{}}
+	require.NoError(t, validateIDMappings(spec))
+
+	spec.Linux.UIDMappings = mapping
+	spec.Linux.GIDMappings = mapping
+	require.Error(t, validateIDMappings(spec))
+
+	spec.Linux.Namespaces = userns
+	require.NoError(t, validateIDMappings(spec))
+
+	spec.Process.User.AdditionalGids = []uint32{70000}
+	require.Error(t, validateIDMappings(spec))
+	spec.Process.User.AdditionalGids = nil
+
+	spec.Linux.GIDMappings = nil
+	require.Error(t, validateIDMappings(spec))
+
+	spec.Linux.GIDMappings = append(mapping, specs.LinuxIDMapping{ContainerID: 65536, HostID: 165535, Size: 1})
+	require.Error(t, validateIDMappings(spec))
+
+	spec.Linux.GIDMappings = append(mapping, specs.LinuxIDMapping{ContainerID: 65535, HostID: 200000, Size: 1})
+	require.Error(t, validateIDMappings(spec))
+
+	spec.Linux.GIDMappings = []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 0}}
+	require.Error(t, validateIDMappings(spec))
+
+	// the mappings of a shared user namespace are not validated
+	spec.Linux.Namespaces = []specs.LinuxNamespace{{Type: specs.UserNamespace, Path: "/proc/1/ns/user"}}
+	require.NoError(t, validateIDMappings(spec))
+}
+
+func TestHostID(t *testing.T) {
+	mappings := []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 1000}, {ContainerID: 1000, HostID: 300000, Size: 1000}}
+	id, ok := hostID(mappings, 0)
+	require.True(t, ok)
+	require.Equal(t, uint32(100000), id)
+	id, ok = hostID(mappings, 1500)
+	require.True(t, ok)
+	require.Equal(t, uint32(300500), id)
+	_, ok = hostID(mappings, 2000)
+	require.False(t, ok)
+	id, ok = hostID(nil, 2000)
+	require.True(t, ok)
+	require.Equal(t, uint32(2000), id)
+}
+
+func TestUsernsAllocation(t *testing.T) {
+	root, err := ioutil.TempDir("", "crio-lxc-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	uidPath, gidPath := subuidPath, subgidPath
+	defer func() { subuidPath, subgidPath = uidPath, gidPath }()
+	subuidPath = filepath.Join(root, "subuid")
+	subgidPath = filepath.Join(root, "subgid")
+	require.NoError(t, ioutil.WriteFile(subuidPath, []byte("crio-lxc:100000:131072\n"), 0640))
+	require.NoError(t, ioutil.WriteFile(subgidPath, []byte("crio-lxc:200000:131072\n"), 0640))
+
+	newContainer := func(id string, pod string) (*Runtime, *specs.Spec) {
+		rt, err := NewRuntime(id, WithRuntimeRoot(root), WithUserns(true, "crio-lxc", 65536))
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(rt.RuntimePath(), 0700))
+		spec := &specs.Spec{
+			Process:     &specs.Process{},
+			Linux:       &specs.Linux{},
+			Annotations: map[string]string{"io.kubernetes.cri-o.SandboxID": pod},
+		}
+		require.NoError(t, configureUserns(rt, spec))
+		return rt, spec
+	}
+
+	c1, spec := newContainer("c1", "pod1")
+	require.Equal(t, []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}, spec.Linux.UIDMappings)
+	require.Equal(t, []specs.LinuxIDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}}, spec.Linux.GIDMappings)
+	require.Equal(t, []specs.LinuxNamespace{{Type: specs.UserNamespace}}, spec.Linux.Namespaces)
+
+	// containers of the same pod share the ID mapping
+	c2, spec := newContainer("c2", "pod1")
+	require.Equal(t, uint32(100000), spec.Linux.UIDMappings[0].HostID)
+
+	c3, spec := newContainer("c3", "pod2")
+	require.Equal(t, uint32(165536), spec.Linux.UIDMappings[0].HostID)
+	require.Equal(t, uint32(265536), spec.Linux.GIDMappings[0].HostID)
+
+	rt, err := NewRuntime("c4", WithRuntimeRoot(root), WithUserns(true, "crio-lxc", 65536))
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(rt.RuntimePath(), 0700))
+	require.Error(t, configureUserns(rt, &specs.Spec{Process: &specs.Process{}, Linux: &specs.Linux{}}))
+
+	// the ID mapping is released when all containers of the pod are deleted
+	require.NoError(t, os.RemoveAll(c1.RuntimePath()))
+	require.NoError(t, pruneUsernsAllocations(root))
+	require.FileExists(t, filepath.Join(root, usernsDir, "pod1.json"))
+	require.NoError(t, os.RemoveAll(c2.RuntimePath()))
+	require.NoError(t, pruneUsernsAllocations(root))
+	_, err = os.Stat(filepath.Join(root, usernsDir, "pod1.json"))
+	require.True(t, os.IsNotExist(err))
+	require.FileExists(t, filepath.Join(root, usernsDir, "pod2.json"))
+
+	require.NoError(t, configureUserns(rt, &specs.Spec{Process: &specs.Process{}, Linux: &specs.Linux{}}))
+	require.NoError(t, os.RemoveAll(c3.RuntimePath()))
+}
+
+func TestUsernsAllocation_podContainer(t *testing.T) {
+	rt, backend := newTestRuntime(t)
+	defer os.RemoveAll(rt.RuntimeRoot)
+	require.NoError(t, os.MkdirAll(rt.RuntimePath(), 0700))
+	rt.UsernsAuto = true
+	rt.UsernsUser = "crio-lxc"
+	rt.UsernsSize = 65536
+
+	uidPath, gidPath := subuidPath, subgidPath
+	defer func() { subuidPath, subgidPath = uidPath, gidPath }()
+	subuidPath = filepath.Join(rt.RuntimeRoot, "subuid")
+	subgidPath = filepath.Join(rt.RuntimeRoot, "subgid")
+	require.NoError(t, ioutil.WriteFile(subuidPath, []byte("crio-lxc:100000:65536\n"), 0640))
+	require.NoError(t, ioutil.WriteFile(subgidPath, []byte("crio-lxc:200000:65536\n"), 0640))
+
+	netns := specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: "/proc/self/ns/net"}
+	newSpec := func() *specs.Spec {
+		return &specs.Spec{
+			Process:     &specs.Process{},
+			Linux:       &specs.Linux{Namespaces: []specs.LinuxNamespace{netns}},
+			Annotations: map[string]string{"io.kubernetes.cri-o.SandboxID": "pod1"},
+		}
+	}
+
+	// the pod sandbox container is not running
+	require.Error(t, configureUserns(rt, newSpec()))
+
+	sandbox, err := backend.NewContainer("pod1", rt.RuntimeRoot)
+	require.NoError(t, err)
+	sandbox.(*fakeContainer).setInit(lxc.RUNNING, os.Getpid())
+
+	// the app container joins the user namespace of the pod sandbox, that owns the network namespace
+	spec := newSpec()
+	require.NoError(t, configureUserns(rt, spec))
+	usernsPath := fmt.Sprintf("/proc/%d/ns/user", os.Getpid())
+	require.Equal(t, []specs.LinuxNamespace{netns, {Type: specs.UserNamespace, Path: usernsPath}}, spec.Linux.Namespaces)
+	require.Equal(t, []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}, spec.Linux.UIDMappings)
+}
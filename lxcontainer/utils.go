@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"golang.org/x/sys/unix"
 )
@@ -101,6 +102,7 @@ func encodeFileJSON(dst string, obj interface{}, flags int, mode uint32) error {
 		f.Close()
 		return fmt.Errorf("failed to encode JSON to %s: %w", dst, err)
 	}
+	err = f.Close()
 	if err != nil {
 		return fmt.Errorf("failed to close %s: %w", dst, err)
 	}
@@ -119,46 +121,68 @@ func errorf(sfmt string, args ...interface{}) error {
 	return fmt.Errorf(prefix+sfmt, args...)
 }
 
-// Modified version of golang standard library os.MkdirAll
-func mkdirAll(path string, perm os.FileMode, uid int, gid int) error {
-	// Fast path: if we can tell whether path is a directory or file, stop with success or error.
-	dir, err := os.Stat(path)
-	if err == nil {
-		if dir.IsDir() {
-			return nil
-		}
-		return &os.PathError{"mkdir", path, unix.ENOTDIR}
+// mkdirAllInRoot creates the directory dir (an absolute path within root) and all missing parents.
+// The directories are created relative to the file descriptor of their parent and
+// symlinks are not followed, so no directory can be created outside of root.
+// It returns an O_PATH file descriptor for dir that must be closed by the caller.
+func mkdirAllInRoot(root string, dir string, perm uint32, uid int, gid int) (int, error) {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || !isSubPath(root, dir) {
+		return -1, fmt.Errorf("directory %s is not within %s", dir, root)
 	}
-
-	// Slow path: make sure parent exists and then call Mkdir for path.
-	i := len(path)
-	for i > 0 && os.IsPathSeparator(path[i-1]) { // Skip trailing path separator.
-		i--
-	}
-
-	j := i
-	for j > 0 && !os.IsPathSeparator(path[j-1]) { // Scan backward over element.
-		j--
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open %s: %w", root, err)
 	}
-
-	if j > 1 {
-		// Create parent.
-		err = mkdirAll(path[:j-1], perm, uid, gid)
+	for _, name := range strings.Split(rel, "/") {
+		if name == "." {
+			continue
+		}
+		err := unix.Mkdirat(fd, name, perm)
+		if err == nil {
+			err = chownat(fd, name, uid, gid)
+		} else if err == unix.EEXIST {
+			err = nil
+		}
 		if err != nil {
-			return err
+			unix.Close(fd)
+			return -1, fmt.Errorf("failed to create directory %s: %w", name, err)
 		}
+		next, err := unix.Openat(fd, name, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return -1, fmt.Errorf("failed to open directory %s: %w", name, err)
+		}
+		fd = next
 	}
+	return fd, nil
+}
 
-	// Parent now exists; invoke Mkdir and use its result.
-	err = os.Mkdir(path, perm)
-	if err != nil {
-		// Handle arguments like "foo/." by
-		// double-checking that directory doesn't exist.
-		dir, err1 := os.Lstat(path)
-		if err1 == nil && dir.IsDir() {
-			return nil
-		}
+// isSubPath returns true if the cleaned absolute path p is root or is below root.
+func isSubPath(root string, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// chown changes the owner of path to the host IDs uid and gid (see chownat).
+func chown(path string, uid int, gid int) error {
+	return chownat(unix.AT_FDCWD, path, uid, gid)
+}
+
+// chownat changes the owner of name, relative to dirfd, to the host IDs uid and gid.
+// Symlinks are not followed.
+// An unprivileged runtime (rootless mode) can not chown files to other IDs,
+// so the file remains owned by the runtime user and the owner permissions are
+// granted to group and others instead. The files are accessible within the container
+// but not on the host, because the runtime root is only accessible by the runtime user.
+func chownat(dirfd int, name string, uid int, gid int) error {
+	if os.Geteuid() == 0 || (uid == os.Geteuid() && gid == os.Getegid()) {
+		return unix.Fchownat(dirfd, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+	}
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
 		return err
 	}
-	return unix.Chown(path, uid, gid)
+	perm := st.Mode & 0700
+	return unix.Fchmodat(dirfd, name, st.Mode&07777|perm>>3|perm>>6, 0)
 }
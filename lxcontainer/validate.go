@@ -0,0 +1,131 @@
+package lxcontainer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// hostNamespaceDir is the directory with the namespaces of the runtime process.
+// The runtime is executed in the host namespaces.
+var hostNamespaceDir = "/proc/self/ns"
+
+// ipcSysctls are the sysctls in the IPC namespace (see `man 7 ipc_namespaces`).
+var ipcSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+// utsSysctls are the sysctls in the UTS namespace (see `man 7 uts_namespaces`).
+var utsSysctls = map[string]bool{
+	"kernel.hostname":   true,
+	"kernel.domainname": true,
+}
+
+// specErrors are the violations found by validateSpec.
+type specErrors []error
+
+func (errs specErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// validateSpec checks the namespaces and the sysctls of the spec.
+// All violations are returned as specErrors.
+func validateSpec(spec *specs.Spec) error {
+	var errs specErrors
+	errs = append(errs, validateNamespaces(spec.Linux.Namespaces)...)
+	errs = append(errs, validateSysctls(spec)...)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateNamespaces(namespaces []specs.LinuxNamespace) specErrors {
+	var errs specErrors
+	seen := make(map[specs.LinuxNamespaceType]bool, len(namespaces))
+	for _, ns := range namespaces {
+		if _, ok := namespaceMap[ns.Type]; !ok {
+			errs = append(errs, fmt.Errorf("namespace %s is not supported", ns.Type))
+			continue
+		}
+		if seen[ns.Type] {
+			errs = append(errs, fmt.Errorf("duplicate namespace type %s", ns.Type))
+		}
+		seen[ns.Type] = true
+	}
+
+	// from `man lxc.container.conf` - user and network namespace must be inherited together
+	netns := getNamespace(specs.NetworkNamespace, namespaces)
+	userns := getNamespace(specs.UserNamespace, namespaces)
+	if netns != nil && netns.Path != "" && userns != nil && userns.Path == "" {
+		errs = append(errs, fmt.Errorf("to inherit the network namespace the user namespace must be inherited as well"))
+	}
+	return errs
+}
+
+func validateSysctls(spec *specs.Spec) specErrors {
+	var errs specErrors
+	for key := range spec.Linux.Sysctl {
+		var nsType specs.LinuxNamespaceType
+		switch {
+		case ipcSysctls[key] || strings.HasPrefix(key, "fs.mqueue."):
+			nsType = specs.IPCNamespace
+		case utsSysctls[key]:
+			nsType = specs.UTSNamespace
+		case strings.HasPrefix(key, "net."):
+			nsType = specs.NetworkNamespace
+		default:
+			errs = append(errs, fmt.Errorf("sysctl %q is not in a separate kernel namespace", key))
+			continue
+		}
+		private, err := isPrivateNamespace(nsType, spec.Linux.Namespaces)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("sysctl %q: %w", key, err))
+		} else if !private {
+			errs = append(errs, fmt.Errorf("sysctl %q requires a private %s namespace", key, nsType))
+		}
+	}
+	return errs
+}
+
+// isPrivateNamespace returns true if the container does not run in the host namespace of the given type.
+func isPrivateNamespace(nsType specs.LinuxNamespaceType, namespaces []specs.LinuxNamespace) (bool, error) {
+	ns := getNamespace(nsType, namespaces)
+	if ns == nil {
+		return false, nil
+	}
+	if ns.Path == "" {
+		return true, nil
+	}
+	host, err := isSameNamespace(ns.Path, filepath.Join(hostNamespaceDir, namespaceMap[nsType].Name))
+	if err != nil {
+		return false, err
+	}
+	return !host, nil
+}
+
+func isSameNamespace(a string, b string) (bool, error) {
+	var stA, stB unix.Stat_t
+	if err := unix.Stat(a, &stA); err != nil {
+		return false, fmt.Errorf("failed to stat namespace %s: %w", a, err)
+	}
+	if err := unix.Stat(b, &stB); err != nil {
+		return false, fmt.Errorf("failed to stat namespace %s: %w", b, err)
+	}
+	return stA.Dev == stB.Dev && stA.Ino == stB.Ino, nil
+}
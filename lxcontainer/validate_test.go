@@ -0,0 +1,69 @@
+package lxcontainer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateNamespaces(t *testing.T) {
+	require.Empty(t, validateNamespaces([]specs.LinuxNamespace{
+		{Type: specs.NetworkNamespace}, {Type: specs.UserNamespace},
+	}))
+	// user namespace with host network namespace
+	require.Empty(t, validateNamespaces([]specs.LinuxNamespace{{Type: specs.UserNamespace}}))
+	require.Empty(t, validateNamespaces([]specs.LinuxNamespace{
+		{Type: specs.NetworkNamespace, Path: "/proc/1/ns/net"}, {Type: specs.UserNamespace, Path: "/proc/1/ns/user"},
+	}))
+
+	errs := validateNamespaces([]specs.LinuxNamespace{
+		{Type: specs.NetworkNamespace, Path: "/proc/1/ns/net"},
+		{Type: specs.UserNamespace},
+		{Type: specs.PIDNamespace},
+		{Type: specs.PIDNamespace},
+		{Type: "foo"},
+	})
+	require.Len(t, errs, 3)
+}
+
+func TestValidateSysctls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crio-lxc-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	nsDir := hostNamespaceDir
+	defer func() { hostNamespaceDir = nsDir }()
+	hostNamespaceDir = filepath.Join(dir, "host")
+	require.NoError(t, os.MkdirAll(hostNamespaceDir, 0750))
+	hostNet := filepath.Join(hostNamespaceDir, "net")
+	podNet := filepath.Join(dir, "pod-net")
+	require.NoError(t, ioutil.WriteFile(hostNet, nil, 0640))
+	require.NoError(t, ioutil.WriteFile(podNet, nil, 0640))
+
+	spec := &specs.Spec{Linux: &specs.Linux{
+		Namespaces: []specs.LinuxNamespace{
+			{Type: specs.IPCNamespace},
+			{Type: specs.UTSNamespace},
+			{Type: specs.NetworkNamespace, Path: podNet},
+		},
+		Sysctl: map[string]string{
+			"kernel.shmmax":                       "1024",
+			"fs.mqueue.msg_max":                   "10",
+			"kernel.hostname":                     "foo",
+			"net.ipv4.ip_forward":                 "1",
+			"net.ipv4.ip_unprivileged_port_start": "0",
+		},
+	}}
+	require.NoError(t, validateSpec(spec))
+
+	spec.Linux.Namespaces = []specs.LinuxNamespace{{Type: specs.NetworkNamespace, Path: hostNet}}
+	spec.Linux.Sysctl["kernel.pid_max"] = "4096"
+	err = validateSpec(spec)
+	require.Error(t, err)
+	// all violations are returned
+	require.Len(t, err.(specErrors), 6)
+}
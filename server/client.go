@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/lxc/crio-lxc/lxcontainer"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Client forwards runtime commands to the runtime daemon.
+type Client struct {
+	// Socket is the path to the unix socket of the daemon.
+	Socket string
+	// Stdio are the files passed to the exec process.
+	// The stdio of the calling process is used if unset.
+	Stdio lxcontainer.Stdio
+}
+
+// NewClient returns a new Client for the daemon listening on socket.
+func NewClient(socket string) *Client {
+	return &Client{Socket: socket}
+}
+
+func (c *Client) stdio() []*os.File {
+	files := []*os.File{c.Stdio.Stdin, c.Stdio.Stdout, c.Stdio.Stderr}
+	defaults := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	for i, f := range files {
+		if f == nil {
+			files[i] = defaults[i]
+		}
+	}
+	return files
+}
+
+// do sends the request and waits for the response.
+func (c *Client) do(ctx context.Context, req *Request, files []*os.File) (*Response, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to runtime daemon: %w", err)
+	}
+	// #nosec
+	defer conn.Close()
+	uc := conn.(*net.UnixConn)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Timeout = time.Until(deadline)
+		if err := uc.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeRequest(uc, req, files); err != nil {
+		return nil, fmt.Errorf("failed to write request: %w", err)
+	}
+	resp := new(Response)
+	if err := json.NewDecoder(uc).Decode(resp); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return resp, resp.err()
+}
+
+// Start forwards Runtime.Start
+func (c *Client) Start(ctx context.Context, containerID string) error {
+	_, err := c.do(ctx, &Request{Command: CommandStart, ContainerID: containerID}, nil)
+	return err
+}
+
+// State forwards Runtime.State
+func (c *Client) State(ctx context.Context, containerID string) (*specs.State, error) {
+	resp, err := c.do(ctx, &Request{Command: CommandState, ContainerID: containerID}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.State, nil
+}
+
+// Kill forwards Runtime.Kill
+func (c *Client) Kill(ctx context.Context, containerID string, signum unix.Signal) error {
+	_, err := c.do(ctx, &Request{Command: CommandKill, ContainerID: containerID, Signal: signum}, nil)
+	return err
+}
+
+// Delete forwards Runtime.Delete
+func (c *Client) Delete(ctx context.Context, containerID string, force bool) error {
+	_, err := c.do(ctx, &Request{Command: CommandDelete, ContainerID: containerID, Force: force}, nil)
+	return err
+}
+
+// ExecDetached forwards Runtime.ExecDetachedStdio with the stdio of the client.
+func (c *Client) ExecDetached(ctx context.Context, containerID string, args []string, proc *specs.Process) (pid int, err error) {
+	req := &Request{Command: CommandExec, ContainerID: containerID, Args: args, Process: proc, Detach: true}
+	resp, err := c.do(ctx, req, c.stdio())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Pid, nil
+}
+
+// Exec forwards Runtime.ExecStdio with the stdio of the client.
+func (c *Client) Exec(ctx context.Context, containerID string, args []string, proc *specs.Process) (exitStatus int, err error) {
+	req := &Request{Command: CommandExec, ContainerID: containerID, Args: args, Process: proc}
+	resp, err := c.do(ctx, req, c.stdio())
+	if err != nil {
+		return 0, err
+	}
+	return resp.ExitStatus, nil
+}
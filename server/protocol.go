@@ -0,0 +1,194 @@
+// Package server implements the crio-lxc runtime daemon and its client.
+//
+// The daemon serves the runtime commands (start, state, kill, delete, exec)
+// for all containers over a unix socket and caches a lxcontainer.Runtime per container.
+// The client forwards the runtime commands of the crio-lxc CLI to the daemon.
+// The create command is not forwarded, it is run by the CLI. This deliberately deviates
+// from serving all runtime commands: the container monitor process started by create
+// must be a child of the calling process (conmon), which reaps it as subreaper.
+//
+// Each connection carries a single request and a single response, both encoded as JSON.
+// The stdio file descriptors of the client are passed to the daemon (SCM_RIGHTS)
+// with the request, so the exec process inherits the stdio of the client (e.g conmon).
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/lxc/crio-lxc/lxcontainer"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Runtime commands
+const (
+	CommandStart  = "start"
+	CommandState  = "state"
+	CommandKill   = "kill"
+	CommandDelete = "delete"
+	CommandExec   = "exec"
+)
+
+// Error codes
+const (
+	codeNotExist = "not-exist"
+	codeExist    = "exist"
+)
+
+// maxRequestHeader is the size of the buffer for the first read of a request.
+// The passed file descriptors are received with the first read.
+const maxRequestHeader = 4096
+
+// Request is a runtime command request.
+type Request struct {
+	Command     string `json:"command"`
+	ContainerID string `json:"containerID"`
+	// Timeout is the maximum duration of the command (0 means no timeout).
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// kill
+	Signal unix.Signal `json:"signal,omitempty"`
+
+	// delete
+	Force bool `json:"force,omitempty"`
+
+	// exec
+	Args    []string       `json:"args,omitempty"`
+	Process *specs.Process `json:"process,omitempty"`
+	Detach  bool           `json:"detach,omitempty"`
+}
+
+// Response is the response to a Request.
+type Response struct {
+	Error string `json:"error,omitempty"`
+	// Code identifies errors that are checked by the client (e.g lxcontainer.ErrNotExist).
+	Code string `json:"code,omitempty"`
+
+	State *specs.State `json:"state,omitempty"`
+	// Pid is the PID of a detached exec process.
+	Pid int `json:"pid,omitempty"`
+	// ExitStatus is the exit status of an exec process.
+	ExitStatus int `json:"exitStatus,omitempty"`
+}
+
+func errorResponse(err error) *Response {
+	resp := &Response{Error: err.Error()}
+	switch {
+	case errors.Is(err, lxcontainer.ErrNotExist):
+		resp.Code = codeNotExist
+	case errors.Is(err, lxcontainer.ErrExist):
+		resp.Code = codeExist
+	}
+	return resp
+}
+
+// err returns the error of the response.
+// Errors with a code are wrapped so they can be checked with errors.Is.
+func (r *Response) err() error {
+	if r.Error == "" {
+		return nil
+	}
+	switch r.Code {
+	case codeNotExist:
+		return fmt.Errorf("%s: %w", r.Error, lxcontainer.ErrNotExist)
+	case codeExist:
+		return fmt.Errorf("%s: %w", r.Error, lxcontainer.ErrExist)
+	default:
+		return errors.New(r.Error)
+	}
+}
+
+// writeRequest writes the request and passes the given files.
+func writeRequest(conn *net.UnixConn, req *Request, files []*os.File) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+	n, oobn, err := conn.WriteMsgUnix(data, oob, nil)
+	if err != nil {
+		return err
+	}
+	if oobn != len(oob) {
+		return fmt.Errorf("failed to pass file descriptors")
+	}
+	// write the remaining data (the file descriptors are passed with the first write)
+	_, err = conn.Write(data[n:])
+	return err
+}
+
+// readRequest reads a request and the files passed with it.
+func readRequest(conn *net.UnixConn) (*Request, []*os.File, error) {
+	buf := make([]byte, maxRequestHeader)
+	oob := make([]byte, unix.CmsgSpace(3*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, nil, err
+	}
+	req := new(Request)
+	dec := json.NewDecoder(io.MultiReader(bytes.NewReader(buf[:n]), conn))
+	if err := dec.Decode(req); err != nil {
+		closeFiles(files)
+		return nil, nil, fmt.Errorf("failed to decode request: %w", err)
+	}
+	return req, files, nil
+}
+
+func parseRights(oob []byte) ([]*os.File, error) {
+	if len(oob) == 0 {
+		return nil, nil
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse socket control message: %w", err)
+	}
+	var files []*os.File
+	for i := range msgs {
+		fds, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			closeFiles(files)
+			return nil, fmt.Errorf("failed to parse unix rights: %w", err)
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)))
+		}
+	}
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// stdio returns the stdio from the files passed by the client.
+func stdio(files []*os.File) (lxcontainer.Stdio, error) {
+	switch len(files) {
+	case 0:
+		return lxcontainer.Stdio{}, fmt.Errorf("missing stdio")
+	case 3:
+		return lxcontainer.Stdio{Stdin: files[0], Stdout: files[1], Stderr: files[2]}, nil
+	default:
+		return lxcontainer.Stdio{}, fmt.Errorf("expected 3 stdio file descriptors but got %d", len(files))
+	}
+}
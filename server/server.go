@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lxc/crio-lxc/lxcontainer"
+	"github.com/rs/zerolog"
+)
+
+// RuntimeFunc creates the Runtime for the container with the given ID.
+type RuntimeFunc func(containerID string) (*lxcontainer.Runtime, error)
+
+// runtimeEntry serializes the commands for a single container.
+type runtimeEntry struct {
+	mu sync.Mutex
+	rt *lxcontainer.Runtime
+}
+
+// Server serves the runtime commands for all containers.
+// The Runtime of a container is cached until the container is deleted.
+// Containers are created by the client, so that the container monitor process
+// is a child of the client (e.g of conmon) and not of the daemon.
+type Server struct {
+	newRuntime RuntimeFunc
+	log        zerolog.Logger
+
+	mu       sync.Mutex
+	runtimes map[string]*runtimeEntry
+	wg       sync.WaitGroup
+}
+
+// NewServer returns a new Server that creates container runtimes with newRuntime.
+func NewServer(newRuntime RuntimeFunc, log zerolog.Logger) *Server {
+	return &Server{
+		newRuntime: newRuntime,
+		log:        log,
+		runtimes:   make(map[string]*runtimeEntry),
+	}
+}
+
+// Serve accepts connections on l until ctx is done.
+// Serve waits for all running commands to complete before it returns.
+func (s *Server) Serve(ctx context.Context, l *net.UnixListener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	defer s.wg.Wait()
+
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(ctx, conn)
+		}()
+	}
+}
+
+// Release releases all cached container runtimes.
+func (s *Server) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, e := range s.runtimes {
+		e.mu.Lock()
+		if err := e.rt.Release(); err != nil {
+			s.log.Warn().Err(err).Str("cid", id).Msg("failed to release container")
+		}
+		e.mu.Unlock()
+		delete(s.runtimes, id)
+	}
+}
+
+func (s *Server) runtime(containerID string) (*runtimeEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, exist := s.runtimes[containerID]; exist {
+		return e, nil
+	}
+	rt, err := s.newRuntime(containerID)
+	if err != nil {
+		return nil, err
+	}
+	e := &runtimeEntry{rt: rt}
+	s.runtimes[containerID] = e
+	return e, nil
+}
+
+// remove removes the cached runtime of a deleted container.
+func (s *Server) remove(containerID string, e *runtimeEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.runtimes[containerID] == e {
+		delete(s.runtimes, containerID)
+	}
+}
+
+func (s *Server) handle(ctx context.Context, conn *net.UnixConn) {
+	// #nosec
+	defer conn.Close()
+
+	req, files, err := readRequest(conn)
+	if err != nil {
+		s.log.Error().Err(err).Msg("failed to read request")
+		return
+	}
+	// The files are inherited by the exec process.
+	defer closeFiles(files)
+
+	log := s.log.With().Str("cmd", req.Command).Str("cid", req.ContainerID).Logger()
+	start := time.Now()
+
+	resp := s.do(ctx, req, files)
+	if resp.Error != "" {
+		log.Error().Str("err", resp.Error).Dur("duration", time.Since(start)).Msg("cmd failed")
+	} else {
+		log.Debug().Dur("duration", time.Since(start)).Msg("cmd completed")
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Error().Err(err).Msg("failed to write response")
+	}
+}
+
+func (s *Server) do(ctx context.Context, req *Request, files []*os.File) *Response {
+	if req.ContainerID == "" {
+		return errorResponse(fmt.Errorf("missing container ID"))
+	}
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+
+	if req.Command == CommandExec && !req.Detach {
+		return s.exec(ctx, req, files)
+	}
+
+	e, err := s.runtime(req.ContainerID)
+	if err != nil {
+		return errorResponse(err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rt := e.rt
+
+	resp := &Response{}
+	switch req.Command {
+	case CommandStart:
+		err = rt.Start(ctx)
+	case CommandState:
+		resp.State, err = rt.State(ctx)
+	case CommandKill:
+		err = rt.Kill(ctx, req.Signal)
+	case CommandDelete:
+		err = rt.Delete(ctx, req.Force)
+		if err == nil {
+			s.remove(req.ContainerID, e)
+		}
+	case CommandExec:
+		var execStdio lxcontainer.Stdio
+		execStdio, err = stdio(files)
+		if err != nil {
+			break
+		}
+		resp.Pid, err = rt.ExecDetachedStdio(ctx, req.Args, req.Process, execStdio)
+	default:
+		err = fmt.Errorf("unsupported command %q", req.Command)
+	}
+	if errors.Is(err, lxcontainer.ErrNotExist) {
+		s.remove(req.ContainerID, e)
+	}
+	if err != nil {
+		return errorResponse(err)
+	}
+	return resp
+}
+
+// exec runs an exec command and waits for it to complete.
+// The exec command uses a new Runtime, so that it does not block the other commands
+// of the container until it completes. The cached Runtime can not be used concurrently.
+func (s *Server) exec(ctx context.Context, req *Request, files []*os.File) *Response {
+	execStdio, err := stdio(files)
+	if err != nil {
+		return errorResponse(err)
+	}
+	rt, err := s.newRuntime(req.ContainerID)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer func() {
+		if err := rt.Release(); err != nil {
+			s.log.Warn().Err(err).Str("cid", req.ContainerID).Msg("failed to release container")
+		}
+	}()
+	resp := &Response{}
+	resp.ExitStatus, err = rt.ExecStdio(ctx, req.Args, req.Process, execStdio)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return resp
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/lxc/crio-lxc/lxcontainer"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func startTestServer(t *testing.T) (*Server, *Client, string) {
+	dir, err := ioutil.TempDir("", "crio-lxc-server-test")
+	require.NoError(t, err)
+
+	root := filepath.Join(dir, "root")
+	newRuntime := func(containerID string) (*lxcontainer.Runtime, error) {
+		return lxcontainer.NewRuntime(containerID, lxcontainer.WithRuntimeRoot(root))
+	}
+	socket := filepath.Join(dir, "crio-lxc.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	require.NoError(t, err)
+
+	srv := NewServer(newRuntime, zerolog.Nop())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(ctx, l)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+		srv.Release()
+		os.RemoveAll(dir)
+	})
+	return srv, NewClient(socket), root
+}
+
+func TestClientState_notExist(t *testing.T) {
+	srv, client, _ := startTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_, err := client.State(ctx, "c1")
+	require.Error(t, err)
+	require.True(t, errors.Is(err, lxcontainer.ErrNotExist))
+
+	// the runtime of a non-existent container is not cached
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	require.Empty(t, srv.runtimes)
+}
+
+func TestClientDelete_notExist(t *testing.T) {
+	_, client, _ := startTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	require.NoError(t, client.Delete(ctx, "c1", true))
+}
+
+func TestClientExec_notBlocked(t *testing.T) {
+	srv, client, _ := startTestServer(t)
+
+	// a blocking exec does not wait for the commands of the container
+	e, err := srv.runtime("c1")
+	require.NoError(t, err)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_, err = client.Exec(ctx, "c1", []string{"true"}, nil)
+	require.True(t, errors.Is(err, lxcontainer.ErrNotExist))
+}
+
+func TestClient_invalidRequest(t *testing.T) {
+	_, client, _ := startTestServer(t)
+	ctx := context.Background()
+
+	_, err := client.do(ctx, &Request{Command: CommandState}, nil)
+	require.Error(t, err)
+
+	_, err = client.do(ctx, &Request{Command: "pause", ContainerID: "c1"}, nil)
+	require.Error(t, err)
+
+	// create is run by the client
+	_, err = client.do(ctx, &Request{Command: "create", ContainerID: "c1"}, nil)
+	require.Error(t, err)
+
+	// exec requires stdio
+	_, err = client.do(ctx, &Request{Command: CommandExec, ContainerID: "c1"}, nil)
+	require.Error(t, err)
+}
+
+func TestRequestFiles(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	require.NoError(t, err)
+	newConn := func(fd int) *net.UnixConn {
+		f := os.NewFile(uintptr(fd), "socket")
+		defer f.Close()
+		c, err := net.FileConn(f)
+		require.NoError(t, err)
+		return c.(*net.UnixConn)
+	}
+	client, server := newConn(fds[0]), newConn(fds[1])
+	defer client.Close()
+	defer server.Close()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	// the request is larger than the first read
+	args := make([]string, maxRequestHeader)
+	for i := range args {
+		args[i] = "a"
+	}
+	req := &Request{Command: CommandExec, ContainerID: "c1", Args: args}
+	go func() {
+		require.NoError(t, writeRequest(client, req, []*os.File{r, w, w}))
+	}()
+
+	received, files, err := readRequest(server)
+	require.NoError(t, err)
+	defer closeFiles(files)
+	require.Equal(t, req, received)
+	require.Len(t, files, 3)
+
+	io, err := stdio(files)
+	require.NoError(t, err)
+	_, err = io.Stdout.WriteString("hello")
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = r.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}